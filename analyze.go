@@ -0,0 +1,251 @@
+package netmanage
+
+/*
+The analyze.go looks for rules that can never match or that do not change
+anything, by comparing the rules of a chain two by two.
+*/
+
+import (
+	"fmt"
+	"net"
+)
+
+// Severity tells how bad a finding is
+type Severity int
+
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityError
+)
+
+var severityNames = []string{"info", "warning", "error"}
+
+func (s Severity) String() string {
+	return severityNames[s]
+}
+
+// FindingKind is the kind of problem found by Analyze
+type FindingKind int
+
+const (
+	// FindingShadowed is a rule never matched because an earlier rule with
+	// another action matches everything it does
+	FindingShadowed FindingKind = iota
+	// FindingRedundant is a rule that can be removed without changing what
+	// the policy does
+	FindingRedundant
+	// FindingContradiction is two overlapping rules with different actions,
+	// only their order decides for the packets they both match
+	FindingContradiction
+)
+
+var findingNames = []string{"shadowed", "redundant", "contradiction"}
+
+func (k FindingKind) String() string {
+	return findingNames[k]
+}
+
+// Finding is one problem found in a policy. Rule is the index of the rule it
+// is about, Other the index of the rule that causes it.
+type Finding struct {
+	Severity Severity
+	Kind     FindingKind
+	Rule     int
+	Other    int
+	Message  string
+}
+
+func (f *Finding) String() string {
+	return fmt.Sprintf("%s: rule %d: %s", f.Severity, f.Rule, f.Message)
+}
+
+// Analyze returns the shadowed, redundant and contradicting rules of the
+// policy, in rule order
+func Analyze(policy *Policy) ([]*Finding, error) {
+	rules, err := policy.TypedRules()
+	if err != nil {
+		return nil, err
+	}
+	var findings []*Finding
+	add := func(severity Severity, kind FindingKind, rule, other int, format string, a ...interface{}) {
+		findings = append(findings, &Finding{severity, kind, rule, other, fmt.Sprintf(format, a...)})
+	}
+	for j, later := range rules {
+		covered := false
+		for i, earlier := range rules[:j] {
+			// the packets a JUMP sends away may come back to the next rules,
+			// the packets a LOG logs always go on to them
+			if earlier.Action == ActionJump || earlier.Action == ActionLog || !earlier.Match.sameChain(&later.Match) ||
+				!earlier.Match.covers(&later.Match) || !earlier.activeCovers(later) {
+				continue
+			}
+			if earlier.sameTarget(later) {
+				add(SeverityWarning, FindingRedundant, j, i, "already matched by rule %d with the same action", i)
+			} else {
+				add(SeverityError, FindingShadowed, j, i, "never matched, rule %d %ss all its packets first", i, earlier.Action)
+			}
+			covered = true
+			break
+		}
+		// what a packet becomes after a JUMP, GOTO or RETURN depends on other
+		// chains, and after a LOG on the next rules, only rules deciding are
+		// compared
+		if covered || !later.Action.Decides() {
+			continue
+		}
+		for i, earlier := range rules[:j] {
+			if !earlier.Action.Decides() {
+				continue
+			}
+			if earlier.Match.sameChain(&later.Match) && !earlier.sameTarget(later) &&
+				earlier.Match.overlaps(&later.Match) && earlier.activeOverlaps(later) &&
+				!(later.Match.covers(&earlier.Match) && later.activeCovers(earlier)) {
+				add(SeverityWarning, FindingContradiction, j, i, "overlaps rule %d which %ss part of its packets first", i, earlier.Action)
+			}
+		}
+		if i := redundantBefore(rules, j); i >= 0 {
+			add(SeverityWarning, FindingRedundant, j, i, "makes no difference, rule %d has the same action for all its packets", i)
+		}
+	}
+	return findings, nil
+}
+
+// redundantBefore returns the index of a later rule making rule j useless:
+// it has the same action, covers rule j and no rule in between decides
+// otherwise for a packet of rule j. It returns -1 if there is none.
+func redundantBefore(rules []*TypedRule, j int) int {
+	rule := rules[j]
+	for k := j + 1; k < len(rules); k++ {
+		other := rules[k]
+		if !other.Match.sameChain(&rule.Match) || !other.Match.overlaps(&rule.Match) || !other.activeOverlaps(rule) {
+			continue
+		}
+		if other.Action == ActionLog {
+			continue
+		}
+		if other.Action.Flow() || !other.sameTarget(rule) {
+			return -1
+		}
+		if other.Match.covers(&rule.Match) && other.activeCovers(rule) {
+			return k
+		}
+	}
+	return -1
+}
+
+// HasErrors tells if one of the findings is an error
+func HasErrors(findings []*Finding) bool {
+	for _, f := range findings {
+		if f.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// sameChain tells if both matches are for the same chain of the same table
+func (m *TypedMatch) sameChain(o *TypedMatch) bool {
+	return m.Table == o.Table && m.Chain == o.Chain
+}
+
+// covers tells if m matches every packet o matches, both in the same chain.
+// A match with a rate limit covers nothing, it lets packets go past it.
+func (m *TypedMatch) covers(o *TypedMatch) bool {
+	return m.Limit == nil && m.Family.Includes(o.Family) &&
+		(m.Protocol == ProtocolAll || m.Protocol == o.Protocol) &&
+		m.Src.covers(o.Src) && m.Dest.covers(o.Dest) &&
+		m.Sports.covers(o.Sports) && m.Dports.covers(o.Dports) &&
+		ifaceCovers(m.InIface, o.InIface) && ifaceCovers(m.OutIface, o.OutIface) &&
+		(m.State == 0 || o.State != 0 && o.State&^m.State == 0)
+}
+
+// overlaps tells if a packet can be matched by both m and o
+func (m *TypedMatch) overlaps(o *TypedMatch) bool {
+	return (m.Family.Includes(o.Family) || o.Family.Includes(m.Family)) &&
+		(m.Protocol == ProtocolAll || o.Protocol == ProtocolAll || m.Protocol == o.Protocol) &&
+		m.Src.overlaps(o.Src) && m.Dest.overlaps(o.Dest) &&
+		m.Sports.overlaps(o.Sports) && m.Dports.overlaps(o.Dports) &&
+		ifaceOverlaps(m.InIface, o.InIface) && ifaceOverlaps(m.OutIface, o.OutIface) &&
+		(m.State == 0 || o.State == 0 || m.State&o.State != 0)
+}
+
+func (l AddressList) covers(o AddressList) bool {
+	if l == nil {
+		return true
+	}
+	if o == nil {
+		return false
+	}
+	for _, inner := range o {
+		if !l.coversPrefix(inner) {
+			return false
+		}
+	}
+	return true
+}
+
+func (l AddressList) coversPrefix(inner *net.IPNet) bool {
+	innerOnes, _ := inner.Mask.Size()
+	for _, outer := range l {
+		outerOnes, _ := outer.Mask.Size()
+		if outerOnes <= innerOnes && outer.Contains(inner.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l AddressList) overlaps(o AddressList) bool {
+	if l == nil || o == nil {
+		return true
+	}
+	for _, a := range l {
+		for _, b := range o {
+			if a.Contains(b.IP) || b.Contains(a.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (l PortList) covers(o PortList) bool {
+	if l == nil {
+		return true
+	}
+	if o == nil {
+		return false
+	}
+	for _, inner := range o {
+		// ranges of a list may touch, so walk through them from the first port
+		port := int(inner.First)
+		for port <= int(inner.Last) {
+			next := -1
+			for _, r := range l {
+				if r.Contains(port) && int(r.Last) >= next {
+					next = int(r.Last)
+				}
+			}
+			if next < 0 {
+				return false
+			}
+			port = next + 1
+		}
+	}
+	return true
+}
+
+func (l PortList) overlaps(o PortList) bool {
+	if l == nil || o == nil {
+		return true
+	}
+	for _, a := range l {
+		for _, b := range o {
+			if a.First <= b.Last && b.First <= a.Last {
+				return true
+			}
+		}
+	}
+	return false
+}
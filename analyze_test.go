@@ -0,0 +1,107 @@
+package netmanage_test
+
+import (
+	"testing"
+
+	"github.com/dedis/netmanage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnalyze(t *testing.T) {
+	for _, file := range []string{"netPolicy1.json", "netPolicy2.json"} {
+		policy, err := netmanage.NetPolicyScanner(file)
+		require.Nil(t, err)
+		findings, err := netmanage.Analyze(policy)
+		require.Nil(t, err)
+		assert.Empty(t, findings, file)
+	}
+
+	policy := &netmanage.Policy{Num: 7, Rules: []netmanage.Rule{
+		rule("INPUT", "ALL", "ALL", "ALL", "ACCEPT"),
+		rule("INPUT", "TCP", "ALL", "443,444", "DROP"),
+		rule("FORWARD", "TCP", "10.0.0.0/8", "22", "ACCEPT"),
+		rule("FORWARD", "TCP", "10.1.0.0/16", "22", "ACCEPT"),
+		rule("FORWARD", "TCP", "10.0.0.0/16", "1:1024", "DROP"),
+		rule("OUTPUT", "UDP", "ALL", "53", "DROP"),
+		rule("OUTPUT", "UDP", "ALL", "1:100", "DROP"),
+	}}
+	findings, err := netmanage.Analyze(policy)
+	require.Nil(t, err)
+	type found struct {
+		severity    netmanage.Severity
+		kind        netmanage.FindingKind
+		rule, other int
+	}
+	var got []found
+	for _, f := range findings {
+		got = append(got, found{f.Severity, f.Kind, f.Rule, f.Other})
+	}
+	assert.Equal(t, []found{
+		{netmanage.SeverityError, netmanage.FindingShadowed, 1, 0},
+		{netmanage.SeverityWarning, netmanage.FindingRedundant, 3, 2},
+		{netmanage.SeverityWarning, netmanage.FindingContradiction, 4, 2},
+		{netmanage.SeverityWarning, netmanage.FindingRedundant, 5, 6},
+	}, got)
+	assert.True(t, netmanage.HasErrors(findings))
+	assert.Equal(t, "error: rule 1: never matched, rule 0 ACCEPTs all its packets first", findings[0].String())
+}
+
+func TestAnalyze_Family(t *testing.T) {
+	findings, err := netmanage.Analyze(testPolicy(t, "dualstack"))
+	require.Nil(t, err)
+	assert.Empty(t, findings)
+
+	policy := testPolicy(t, "dualstack")
+	policy.Rules[5].Match.Family = "IPv6"
+	policy.Rules = append(policy.Rules, rule("INPUT", "TCP", "2001:db8::1", "22", "DROP"))
+	policy.Num = len(policy.Rules)
+	findings, err = netmanage.Analyze(policy)
+	require.Nil(t, err)
+	require.Len(t, findings, 1)
+	assert.Equal(t, netmanage.FindingShadowed, findings[0].Kind)
+	assert.Equal(t, 1, findings[0].Other)
+}
+
+func TestAnalyze_State(t *testing.T) {
+	// dropping INVALID packets changes nothing before the final DROP
+	findings, err := netmanage.Analyze(testPolicy(t, "stateful"))
+	require.Nil(t, err)
+	require.Len(t, findings, 1)
+	assert.Equal(t, netmanage.FindingRedundant, findings[0].Kind)
+	assert.Equal(t, 1, findings[0].Rule)
+	assert.Equal(t, 3, findings[0].Other)
+
+	policy := testPolicy(t, "stateful")
+	established := rule("INPUT", "TCP", "ALL", "80", "DROP")
+	established.Match.State = "ESTABLISHED"
+	policy.Rules = append(policy.Rules, established)
+	policy.Num = len(policy.Rules)
+	findings, err = netmanage.Analyze(policy)
+	require.Nil(t, err)
+	require.Len(t, findings, 2)
+	assert.Equal(t, netmanage.FindingShadowed, findings[1].Kind)
+	assert.Equal(t, 4, findings[1].Rule)
+	assert.Equal(t, 0, findings[1].Other)
+}
+
+func TestAnalyze_Chains(t *testing.T) {
+	findings, err := netmanage.Analyze(testPolicy(t, "chains"))
+	require.Nil(t, err)
+	assert.Empty(t, findings)
+
+	// a JUMP comes back, a GOTO does not
+	policy := testPolicy(t, "chains")
+	policy.Rules = append(policy.Rules,
+		rule("INPUT", "TCP", "10.0.0.0/8", "22", "DROP"),
+		rule("INPUT", "TCP", "10.0.0.0/8", "443", "DROP"))
+	policy.Num = len(policy.Rules)
+	findings, err = netmanage.Analyze(policy)
+	require.Nil(t, err)
+	require.Len(t, findings, 2)
+	assert.Equal(t, netmanage.FindingShadowed, findings[0].Kind)
+	assert.Equal(t, 7, findings[0].Rule)
+	assert.Equal(t, 2, findings[0].Other)
+	assert.Equal(t, 8, findings[1].Rule)
+	assert.Equal(t, 1, findings[1].Other)
+}
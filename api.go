@@ -13,12 +13,13 @@ import (
 	"gopkg.in/dedis/onet.v1"
 	"gopkg.in/dedis/onet.v1/log"
 	//"github.com/dedis/netmanage/parsers"
-	//"gopkg.in/dedis/onet.v1/network"
+	"gopkg.in/dedis/onet.v1/network"
 	"io/ioutil"
 	"encoding/json"
 	"encoding/hex"
 	"fmt"
 	"bytes"
+	"time"
 )
 
 const ServiceName = "NetManage"
@@ -35,15 +36,8 @@ func NewClient() *Client {
 }
 
 func (c *Client) GenesisPolicyFromFiles(r *onet.Roster, policyFile, signaturesFile, configFile, outputHashFile string, baseH, maxH int) (*GenesisPolicyResponse, onet.ClientError) {
-	//policyFile and configFile for policyData {Policy, Conf} 
-	policy, err := NetPolicyScanner(policyFile)
-	if err != nil {
-		log.Error(err)
-		return nil, onet.NewClientError(err)
-		//return nil, onet.NewClientErrorCode(ErrorSignPolicy, err.Error())
-	}
-	
-	conf, err := ConfScanner(configFile)
+	//policyFile and configFile for policyData {Policy, Conf}, a genesis policy has no parent
+	policyData, err := PolicyDataFromFiles(policyFile, configFile, "")
 	if err != nil {
 		log.Error(err)
 		return nil, onet.NewClientError(err)
@@ -55,30 +49,16 @@ func (c *Client) GenesisPolicyFromFiles(r *onet.Roster, policyFile, signaturesFi
 		log.Error(err)
 		return nil, onet.NewClientError(err)
 	}
-	//fmt.Printf("GenerateGenesisPolicy policy%v\n",policy)
-	//fmt.Printf("GenerateGenesisPolicy conf pub0 = %s\n",conf.PubKeys[0])
-	//fmt.Printf("GenerateGenesisPolicy signatures%v\n",signatures)
-	policyData := &PolicyData{Policy: policy, Conf: conf}
 	
 	genesisResponse, cerr := c.GenesisPolicyRequest(r, policyData, signatures, baseH, maxH)
 	if cerr != nil {
 		return nil, cerr
 	}
 	
-	//write the BlockID (hash) into outputHashFile
-	pubwr := new(bytes.Buffer)
-	_, err = pubwr.WriteString("blockID = ")
-	_, err = pubwr.WriteString("\"")
-	hash := genesisResponse.BlockID
-	//_, err = pubwr.Write(s.storage.LatestPolicy.Hash)
-	_, err = pubwr.WriteString(hex.EncodeToString(hash))
-	_, err = pubwr.WriteString("\"")
-	//fmt.Printf("WriteLatestID s.storage.LatestPolicy.Hash = %s\n",string(s.storage.LatestPolicy.Hash[:]))
-	//fmt.Printf("WriteLatestID hex hash = %s\n",hex.EncodeToString(hash))
-	if err := ioutil.WriteFile(outputHashFile, pubwr.Bytes(), 0660); err != nil {
+	//write the BlockID (hash) into outputHashFile, the genesis block is also the ID of the chain
+	if err := WriteHashFile(outputHashFile, genesisResponse.BlockID, genesisResponse.BlockID); err != nil {
 		fmt.Printf("Could not write BlockID to the file: %s\n", err.Error())
 	}
-	pubwr.Reset()
 	
 	return genesisResponse, nil
 }
@@ -96,14 +76,8 @@ func (c *Client) GenesisPolicyRequest(r *onet.Roster, data *PolicyData, signatur
 }
 
 func (c *Client) NewPolicyFromFiles(r *onet.Roster, policyFile, signaturesFile, configFile, parentHashFile, outputHashFile string) (*NewPolicyResponse, onet.ClientError) {
-	//policyFile and configFile for policyData {Policy, Conf} 
-	policy, err := NetPolicyScanner(policyFile)
-	if err != nil {
-		log.Error(err)
-		return nil, onet.NewClientError(err)
-	}
-	
-	conf, err := ConfScanner(configFile)
+	//policyFile and configFile for policyData {Policy, Conf}, parentHashFile for the parent block and the chain the admins signed for
+	policyData, err := PolicyDataFromFiles(policyFile, configFile, parentHashFile)
 	if err != nil {
 		log.Error(err)
 		return nil, onet.NewClientError(err)
@@ -116,45 +90,104 @@ func (c *Client) NewPolicyFromFiles(r *onet.Roster, policyFile, signaturesFile,
 		return nil, onet.NewClientError(err)
 	}
 	
-	parentBlockID, err := HashScanner(parentHashFile)
-	if err != nil {
-		log.Error(err)
-		return nil, onet.NewClientError(err)
-	}
-	//fmt.Printf("GenerateGenesisPolicy policy%v\n",policy)
-	//fmt.Printf("GenerateGenesisPolicy conf pub0 = %s\n",conf.PubKeys[0])
-	//fmt.Printf("GenerateGenesisPolicy signatures%v\n",signatures)
-	policyData := &PolicyData{Policy: policy, Conf: conf}
-	
-	newPolicyResponse, cerr := c.NewPolicyRequest(r, policyData, signatures, parentBlockID)
+	newPolicyResponse, cerr := c.NewPolicyRequest(r, policyData, signatures, policyData.ParentID)
 	if cerr != nil {
 		return nil, cerr
 	}
 	
 	//write the BlockID (hash) into outputHashFile
-	pubwr := new(bytes.Buffer)
-	_, err = pubwr.WriteString("blockID = ")
-	_, err = pubwr.WriteString("\"")
-	hash := newPolicyResponse.BlockID
-	//_, err = pubwr.Write(s.storage.LatestPolicy.Hash)
-	_, err = pubwr.WriteString(hex.EncodeToString(hash))
-	_, err = pubwr.WriteString("\"")
-	//fmt.Printf("WriteLatestID s.storage.LatestPolicy.Hash = %s\n",string(s.storage.LatestPolicy.Hash[:]))
-	//fmt.Printf("WriteLatestID hex hash = %s\n",hex.EncodeToString(hash))
-	if err := ioutil.WriteFile(outputHashFile, pubwr.Bytes(), 0660); err != nil {
+	if err := WriteHashFile(outputHashFile, newPolicyResponse.BlockID, policyData.ChainID); err != nil {
 		fmt.Printf("Could not write BlockID to the file: %s\n", err.Error())
 	}
-	pubwr.Reset()
 	
 	return newPolicyResponse, nil
 }
 
 func (c *Client) NewPolicyRequest(r *onet.Roster, data *PolicyData, signatures []string, parentBlockID skipchain.SkipBlockID) (*NewPolicyResponse, onet.ClientError) {
+	return c.NewPolicyWithConfChange(r, data, signatures, nil, parentBlockID)
+}
+
+//append a new policy whose conf changes the admins or the threshold, confSignatures are the current admins' signatures over data.ConfChangeBytes
+func (c *Client) NewPolicyWithConfChange(r *onet.Roster, data *PolicyData, signatures, confSignatures []string, parentBlockID skipchain.SkipBlockID) (*NewPolicyResponse, onet.ClientError) {
 	//dst := r.RandomServerIdentity()
 	dst := r.Get(0)
 	log.Lvl4("Sending NewPolicyRequest message to", dst)
 	reply := &NewPolicyResponse{}
-	err := c.SendProtobuf(dst, &NewPolicyRequest{Roster: r, PolicyData: data, Signatures:signatures, ParentBlockID: parentBlockID}, reply)
+	err := c.SendProtobuf(dst, &NewPolicyRequest{Roster: r, PolicyData: data, Signatures:signatures, ConfSignatures: confSignatures, ParentBlockID: parentBlockID}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+//submit a new policy for the admins to sign on the service instead of gathering their signatures into one file
+func (c *Client) SubmitProposal(r *onet.Roster, data *PolicyData) (*ProposalStatus, onet.ClientError) {
+	dst := r.Get(0)
+	log.Lvl4("Sending SubmitProposalRequest message to", dst)
+	reply := &SubmitProposalResponse{}
+	err := c.SendProtobuf(dst, &SubmitProposalRequest{Roster: r, PolicyData: data}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Status, nil
+}
+
+//add one admin's detached signature to the proposal id, over its ConfChangeBytes if confChange is set.
+//The proposal is appended once approved, the BlockID of the status is then set
+func (c *Client) AddSignature(r *onet.Roster, id, signature string, confChange bool) (*ProposalStatus, onet.ClientError) {
+	dst := r.Get(0)
+	log.Lvl4("Sending AddSignatureRequest message to", dst)
+	reply := &AddSignatureResponse{}
+	err := c.SendProtobuf(dst, &AddSignatureRequest{ID: id, Signature: signature, ConfChange: confChange}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Status, nil
+}
+
+//list the proposals waiting for signatures
+func (c *Client) ListProposals(r *onet.Roster) ([]*ProposalStatus, onet.ClientError) {
+	dst := r.Get(0)
+	log.Lvl4("Sending ListProposalsRequest message to", dst)
+	reply := &ListProposalsResponse{}
+	err := c.SendProtobuf(dst, &ListProposalsRequest{}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Proposals, nil
+}
+
+//get the proposal id with its signatures against the thresholds
+func (c *Client) GetProposal(r *onet.Roster, id string) (*ProposalStatus, onet.ClientError) {
+	dst := r.Get(0)
+	log.Lvl4("Sending GetProposalRequest message to", dst)
+	reply := &GetProposalResponse{}
+	err := c.SendProtobuf(dst, &GetProposalRequest{ID: id}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Status, nil
+}
+
+//append again the approved proposal id after its append failed, the BlockID of the status is then set
+func (c *Client) AppendProposal(r *onet.Roster, id string) (*ProposalStatus, onet.ClientError) {
+	dst := r.Get(0)
+	log.Lvl4("Sending AppendProposalRequest message to", dst)
+	reply := &AppendProposalResponse{}
+	err := c.SendProtobuf(dst, &AppendProposalRequest{ID: id}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Status, nil
+}
+
+//remove a compromised admin key from the conf of the latest block, signatures are the other admins' signatures over
+//rev.SigningBytes, reaching the revocation quorum of the conf
+func (c *Client) RevokeKey(r *onet.Roster, rev *Revocation, signatures []string) (*RevokeKeyResponse, onet.ClientError) {
+	dst := r.Get(0)
+	log.Lvl4("Sending RevokeKeyRequest message to", dst)
+	reply := &RevokeKeyResponse{}
+	err := c.SendProtobuf(dst, &RevokeKeyRequest{Roster: r, Revocation: rev, Signatures: signatures}, reply)
 	if err != nil {
 		return nil, err
 	}
@@ -192,6 +225,30 @@ func (c *Client) GetPolicyRequest(r *onet.Roster) (*CosiPolicy, onet.ClientError
 	return reply.CosiPolicy, nil
 }
 
+//get the latest policy from roster r, with the rules in effect at time at
+func (c *Client) GetPolicyAt(r *onet.Roster, at time.Time) (*GetPolicyResponse, onet.ClientError) {
+	dst := r.Get(0)
+	log.Lvl4("Sending GetPolicyRequest message to", dst)
+	reply := &GetPolicyResponse{}
+	err := c.SendProtobuf(dst, &GetPolicyRequest{At: at.Format(time.RFC3339)}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+//list the rules of the latest policy that stop being in effect within the given duration
+func (c *Client) ExpiringRules(r *onet.Roster, within time.Duration) (*ExpiringRulesResponse, onet.ClientError) {
+	dst := r.Get(0)
+	log.Lvl4("Sending ExpiringRulesRequest message to", dst)
+	reply := &ExpiringRulesResponse{}
+	err := c.SendProtobuf(dst, &ExpiringRulesRequest{Within: within.String()}, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
 //only if nil, nil, the policy is valid
 func (c *Client) VerifyPolicyRequest(r *onet.Roster, policy *CosiPolicy) (*VerifyPolicyResponse, onet.ClientError){
 	//dst := r.RandomServerIdentity()
@@ -212,10 +269,81 @@ func (c *Client) VerifyPolicyRequest(r *onet.Roster, policy *CosiPolicy) (*Verif
 	return reply, nil
 }
 
-//write one policy to file
-func WritePolicyFile(policy *CosiPolicy, pullPolicyFile string) error {
-	//transform policy into JSON and write into file pullPolicyFile
-	buf, err := json.Marshal(policy.PolicyData.Policy)
+//get the policy stored in the block id of the chain held by roster r
+func (c *Client) GetPolicyBlock(r *onet.Roster, id skipchain.SkipBlockID) (*CosiPolicy, onet.ClientError) {
+	log.Lvl4("Fetching policy block", hex.EncodeToString(id))
+	reply, cerr := skipchain.NewClient().GetUpdateChain(r, id)
+	if cerr != nil {
+		return nil, cerr
+	}
+	if len(reply.Update) == 0 || !bytes.Equal(reply.Update[0].Hash, id) {
+		return nil, onet.NewClientError(fmt.Errorf("block %x not found", []byte(id)))
+	}
+	_, msg, err := network.Unmarshal(reply.Update[0].Data)
+	if err != nil {
+		return nil, onet.NewClientError(err)
+	}
+	policy, ok := msg.(*CosiPolicy)
+	if !ok {
+		return nil, onet.NewClientError(fmt.Errorf("block %x does not hold a policy", []byte(id)))
+	}
+	return policy, nil
+}
+
+//compare the policies stored in two blocks of the chain
+func (c *Client) DiffPolicyBlocks(r *onet.Roster, oldID, newID skipchain.SkipBlockID) (*PolicyDiff, onet.ClientError) {
+	oldPolicy, cerr := c.GetPolicyBlock(r, oldID)
+	if cerr != nil {
+		return nil, cerr
+	}
+	newPolicy, cerr := c.GetPolicyBlock(r, newID)
+	if cerr != nil {
+		return nil, cerr
+	}
+	return DiffPolicies(oldPolicy.PolicyData.Policy, newPolicy.PolicyData.Policy), nil
+}
+
+//compare a proposed policy with the latest one on the chain, this is what a NewPolicyRequest with it would change
+func (c *Client) DiffWithLatest(r *onet.Roster, policy *Policy) (*PolicyDiff, onet.ClientError) {
+	latest, cerr := c.GetPolicyRequest(r)
+	if cerr != nil {
+		return nil, cerr
+	}
+	return DiffPolicies(latest.PolicyData.Policy, policy), nil
+}
+
+// PolicyFormat selects how a policy is written out
+type PolicyFormat int
+
+const (
+	// FormatJSON is the policy file format read by NetPolicyScanner
+	FormatJSON PolicyFormat = iota
+	// FormatIptables is a ruleset for iptables-restore
+	FormatIptables
+	// FormatNftables is a script for nft -f
+	FormatNftables
+	// FormatIp6tables is a ruleset for ip6tables-restore
+	FormatIp6tables
+)
+
+//render the policy in the given format
+func RenderPolicy(policy *Policy, format PolicyFormat) ([]byte, error) {
+	switch format {
+	case FormatJSON:
+		return json.Marshal(policy)
+	case FormatIptables:
+		return RenderIptables(policy)
+	case FormatNftables:
+		return RenderNftables(policy)
+	case FormatIp6tables:
+		return RenderIp6tables(policy)
+	}
+	return nil, fmt.Errorf("unknown policy format %d", format)
+}
+
+//write one policy to file, in the given format
+func WritePolicyFile(policy *CosiPolicy, pullPolicyFile string, format PolicyFormat) error {
+	buf, err := RenderPolicy(policy.PolicyData.Policy, format)
 	if err != nil {
 		//fmt.Println("error:", err)
 		return err
@@ -8,9 +8,11 @@ import (
 	"bytes"
 	"io/ioutil"
 	"strconv"
+	"strings"
 	
 	// We need to include the service so it is started.
 	_ "github.com/dedis/netmanage/service"
+	"github.com/BurntSushi/toml"
 	"github.com/dedis/netmanage"
 	"gopkg.in/dedis/onet.v1"
 	"gopkg.in/dedis/onet.v1/log"
@@ -67,8 +69,13 @@ func TestClient_All(t *testing.T) {
 	assert.Equal(t, genesisResponse.BlockID, genesisResponse.GenesisBlock.Hash)		
 	fmt.Printf("11111111111 TestClient GenesisPolicyFromFiles end\n\n")		
 	
+	//the admins of the genesis policy sign the new policy on top of it
+	data2, err2 := netmanage.PolicyDataFromFiles(policyFile2, configFile1, outHashFile1)
+	log.ErrFatal(err2)
+	log.ErrFatal(signPolicyFiles(data2, privFile1, signaturesFile2))
+
 	//NewPolicyFromFiles Test
-	newPolicyResponse, err := c.NewPolicyFromFiles(roster, policyFile2, signaturesFile2, configFile2, outHashFile1, outHashFile2)
+	newPolicyResponse, err := c.NewPolicyFromFiles(roster, policyFile2, signaturesFile2, configFile1, outHashFile1, outHashFile2)
 	log.ErrFatal(err)
 	_, msgn, merrn := network.Unmarshal(newPolicyResponse.LatestBlock.SkipBlockFix.Data)
 	log.ErrFatal(merrn)
@@ -79,6 +86,13 @@ func TestClient_All(t *testing.T) {
 	fmt.Printf("22222222222 TestClient NewPolicyRequest end\n\n")
 	
 	
+	//DiffPolicyBlocks Test
+	diff, err := c.DiffPolicyBlocks(roster, genesisResponse.BlockID, newPolicyResponse.BlockID)
+	log.ErrFatal(err)
+	assert.Equal(t, len(diff.Added), 1)
+	assert.Equal(t, diff.Added[0].NewIndex, 0)
+	fmt.Printf("%s\n", diff)
+
 	//GetPolicyRequest Test
 	latest, err := c.GetPolicyRequest(roster)
 	//fmt.Printf("##########################\n")
@@ -99,7 +113,7 @@ func TestClient_All(t *testing.T) {
 	fmt.Printf("444444444444 TestClient VerifyPolicyRequest end\n\n")
 	
 	//WritePolicyFile Test
-	werr := netmanage.WritePolicyFile(latest, pullLatestPolicy)
+	werr := netmanage.WritePolicyFile(latest, pullLatestPolicy, netmanage.FormatJSON)
 	assert.Equal(t, werr, nil)
 	fmt.Printf("5555555555555 TestClient WritePolicyFile end\n")
 }
@@ -107,23 +121,7 @@ func TestClient_All(t *testing.T) {
 
 //simulate admin behaviors: give policy json file and amdin numbers, make sig and conf file
 func GenerateAmdinFiles(policyFile, signaturesFile, configFile, privFile string, adminNum int) {
-	//read the Policy json file, get a policy struct and turn it into bytes using network.Marshal, then we get the buf to be signed
-	policy, err := netmanage.NetPolicyScanner(policyFile)
-	if err != nil {
-		log.Error(err)
-	}
-	
-	for _, msg := range []interface{}{
-		netmanage.Policy{}, 
-	} {
-		network.RegisterMessage(msg)
-	}
-		
-	text, err := network.Marshal(policy)
-	if err != nil {
-		log.Error(err)
-	}
-
+	var err error
 	var developers openpgp.EntityList
 
 	for i := 0; i < adminNum; i++ {
@@ -146,7 +144,7 @@ func GenerateAmdinFiles(policyFile, signaturesFile, configFile, privFile string,
 
 	fpub, _ := os.OpenFile(configFile, os.O_APPEND|os.O_WRONLY, 0660)
 	defer fpub.Close()
-	fpriv, _ := os.OpenFile(privFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0660)
+	fpriv, _ := os.OpenFile(privFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
 	defer fpriv.Close()
 	fpriv.WriteString("Entities = [\n")
 
@@ -185,6 +183,15 @@ func GenerateAmdinFiles(policyFile, signaturesFile, configFile, privFile string,
 		pubwr.Reset()
 	}
 
+	//the admins sign the genesis policy data, which covers the conf written above
+	data, err := netmanage.PolicyDataFromFiles(policyFile, configFile, "")
+	if err != nil {
+		log.Error(err)
+	}
+	text, err := data.SigningBytes()
+	if err != nil {
+		log.Error(err)
+	}
 	for _, entity := range developers {
 		openpgp.ArmoredDetachSign(pubwr, entity, bytes.NewReader(text), nil)
 		pubwr.WriteByte(byte('\n'))
@@ -195,4 +202,32 @@ func GenerateAmdinFiles(policyFile, signaturesFile, configFile, privFile string,
 		log.Error("Could not write to a signatures file", err)
 	}
 	
-}
\ No newline at end of file
+}
+
+//simulate the admins whose private keys GenerateAmdinFiles wrote into privFile signing the policy data into signaturesFile
+func signPolicyFiles(policyData *netmanage.PolicyData, privFile, signaturesFile string) error {
+	var ring struct {
+		Entities []string
+	}
+	if _, err := toml.DecodeFile(privFile, &ring); err != nil {
+		return err
+	}
+	text, err := policyData.SigningBytes()
+	if err != nil {
+		return err
+	}
+	sigs := new(bytes.Buffer)
+	for _, armored := range ring.Entities {
+		entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+		if err != nil {
+			return err
+		}
+		for _, entity := range entities {
+			if err := openpgp.ArmoredDetachSign(sigs, entity, bytes.NewReader(text), nil); err != nil {
+				return err
+			}
+			sigs.WriteByte('\n')
+		}
+	}
+	return ioutil.WriteFile(signaturesFile, sigs.Bytes(), 0660)
+}
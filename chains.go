@@ -0,0 +1,201 @@
+package netmanage
+
+/*
+The chains.go checks the chains of a Policy: the default policy of the
+built-in chains, the custom chains rules can jump to, and that no sequence
+of jumps comes back to a chain it started from.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// maxChainName is the longest chain name iptables accepts
+const maxChainName = 28
+
+type chainKey struct {
+	table Table
+	chain Chain
+}
+
+// chainSet holds the chains of a policy. Built-in chains missing from
+// Policy.Chains have the ACCEPT policy.
+type chainSet struct {
+	defaults map[chainKey]Action
+	custom   map[chainKey]bool
+	// order lists the custom chains as declared
+	order []chainKey
+}
+
+// chains parses Policy.Chains, the chains with problems are left out
+func (p *Policy) chains() (*chainSet, ValidationError) {
+	var errs ValidationError
+	fail := func(def *ChainDef, format string, a ...interface{}) {
+		errs = append(errs, &RuleError{-1, "Chains", fmt.Errorf("chain %q: %s", def.Name, fmt.Sprintf(format, a...))})
+	}
+	set := &chainSet{defaults: make(map[chainKey]Action), custom: make(map[chainKey]bool)}
+	for i := range p.Chains {
+		def := &p.Chains[i]
+		table, err := ParseTable(def.Table)
+		if err != nil {
+			fail(def, "%s", err)
+			continue
+		}
+		if builtin, err := ParseChain(def.Name); err == nil {
+			key := chainKey{table, builtin}
+			policy, err := ParseAction(def.Policy)
+			switch {
+			case !containsChain(table.Chains(), builtin):
+				fail(def, "not in the %s table", table)
+			case err != nil:
+				fail(def, "%s", err)
+			case policy != ActionAccept && (policy != ActionDrop || table != TableFilter):
+				fail(def, "the default policy of a %s chain is ACCEPT or DROP, not %s", table, policy)
+			case hasDefault(set.defaults, key):
+				fail(def, "declared twice in the %s table", table)
+			default:
+				set.defaults[key] = policy
+			}
+			continue
+		}
+		key := chainKey{table, Chain(def.Name)}
+		if err := checkChainName(def.Name); err != nil {
+			fail(def, "%s", err)
+			continue
+		}
+		switch {
+		case def.Policy != "":
+			fail(def, "a custom chain has no default policy")
+		case set.custom[key]:
+			fail(def, "declared twice in the %s table", table)
+		default:
+			set.custom[key] = true
+			set.order = append(set.order, key)
+		}
+	}
+	return set, errs
+}
+
+func hasDefault(defaults map[chainKey]Action, key chainKey) bool {
+	_, ok := defaults[key]
+	return ok
+}
+
+func checkChainName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("chain has no name")
+	case len(name) > maxChainName:
+		return fmt.Errorf("name is longer than %d characters", maxChainName)
+	case strings.ContainsAny(name, " \t\"'"):
+		return errors.New("name cannot contain spaces or quotes")
+	case strings.HasPrefix(name, "-") || strings.HasPrefix(name, "!"):
+		return errors.New("name cannot start with '-' or '!'")
+	}
+	for _, builtin := range builtinChains {
+		if strings.EqualFold(name, string(builtin)) {
+			return errors.New("name is reserved for a built-in chain")
+		}
+	}
+	for _, action := range actionNames {
+		if strings.EqualFold(name, action) {
+			return errors.New("name is reserved for an action")
+		}
+	}
+	return nil
+}
+
+// resolve returns the chain called name in the table, built-in or custom
+func (s *chainSet) resolve(table Table, name string) (Chain, error) {
+	if builtin, err := ParseChain(name); err == nil {
+		if !containsChain(table.Chains(), builtin) {
+			return builtin, fmt.Errorf("chain %s is not in the %s table", builtin, table)
+		}
+		return builtin, nil
+	}
+	if !s.custom[chainKey{table, Chain(name)}] {
+		return Chain(name), fmt.Errorf("unknown chain %q in the %s table", name, table)
+	}
+	return Chain(name), nil
+}
+
+// resolveTarget returns the custom chain a JUMP or GOTO of the table goes to
+func (s *chainSet) resolveTarget(table Table, name string) (Chain, error) {
+	if _, err := ParseChain(name); err == nil {
+		return Chain(name), fmt.Errorf("cannot jump to the built-in chain %s", name)
+	}
+	if !s.custom[chainKey{table, Chain(name)}] {
+		return Chain(name), fmt.Errorf("unknown chain %q in the %s table", name, table)
+	}
+	return Chain(name), nil
+}
+
+// policy returns the default policy of a built-in chain
+func (s *chainSet) policy(table Table, chain Chain) Action {
+	return s.defaults[chainKey{table, chain}]
+}
+
+// customChains returns the custom chains of the table as declared
+func (s *chainSet) customChains(table Table) []Chain {
+	var chains []Chain
+	for _, key := range s.order {
+		if key.table == table {
+			chains = append(chains, key.chain)
+		}
+	}
+	return chains
+}
+
+// declares tells if the policy has something to say about the table, a
+// custom chain or a default policy other than ACCEPT
+func (s *chainSet) declares(table Table) bool {
+	for key, policy := range s.defaults {
+		if key.table == table && policy != ActionAccept {
+			return true
+		}
+	}
+	return len(s.customChains(table)) > 0
+}
+
+// checkLoops reports the JUMP and GOTO rules closing a loop of chains,
+// the packets following them would never leave the loop
+func checkLoops(rules []*TypedRule) ValidationError {
+	edges := make(map[chainKey][]int)
+	for i, rule := range rules {
+		if (rule.Action == ActionJump || rule.Action == ActionGoto) && rule.Target != "" {
+			key := chainKey{rule.Match.Table, rule.Match.Chain}
+			edges[key] = append(edges[key], i)
+		}
+	}
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	var errs ValidationError
+	state := make(map[chainKey]int)
+	var visit func(key chainKey)
+	visit = func(key chainKey) {
+		state[key] = visiting
+		for _, i := range edges[key] {
+			target := chainKey{key.table, rules[i].Target}
+			switch state[target] {
+			case visiting:
+				errs = append(errs, &RuleError{i, "Target", fmt.Errorf("%s to %s closes a loop of chains",
+					rules[i].Action, target.chain)})
+			case unvisited:
+				visit(target)
+			}
+		}
+		state[key] = done
+	}
+	for _, rule := range rules {
+		key := chainKey{rule.Match.Table, rule.Match.Chain}
+		if state[key] == unvisited && len(edges[key]) > 0 {
+			visit(key)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,116 @@
+package netmanage_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dedis/netmanage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy_ValidateChains(t *testing.T) {
+	assert.Nil(t, testPolicy(t, "chains").Validate())
+
+	policy := testPolicy(t, "chains")
+	policy.Chains = append(policy.Chains,
+		netmanage.ChainDef{Name: "OUTPUT", Policy: "REJECT"},
+		netmanage.ChainDef{Table: "nat", Name: "PREROUTING", Policy: "DROP"},
+		netmanage.ChainDef{Name: "web-in"},
+		netmanage.ChainDef{Name: "input"},
+		netmanage.ChainDef{Name: "lan", Policy: "DROP"},
+	)
+	policy.Rules = append(policy.Rules,
+		rule("lan", "ALL", "ALL", "ALL", "ACCEPT"),
+		rule("INPUT", "ALL", "ALL", "ALL", "JUMP"),
+		rule("INPUT", "ALL", "ALL", "ALL", "ACCEPT"),
+	)
+	policy.Rules[len(policy.Rules)-1].Target = "web-in"
+	policy.Num = len(policy.Rules)
+	got := make(map[int][]string)
+	for _, e := range policy.Validate().(netmanage.ValidationError) {
+		got[e.Index] = append(got[e.Index], e.Field)
+	}
+	assert.Equal(t, map[int][]string{
+		-1: {"Chains", "Chains", "Chains", "Chains", "Chains"},
+		7:  {"Chain"},
+		8:  {"Target"},
+		9:  {"Target"},
+	}, got)
+}
+
+func TestPolicy_ValidateLoops(t *testing.T) {
+	policy := testPolicy(t, "chains")
+	policy.Chains = append(policy.Chains, netmanage.ChainDef{Name: "a"}, netmanage.ChainDef{Name: "b"})
+	loop := []netmanage.Rule{
+		rule("a", "ALL", "ALL", "ALL", "JUMP"),
+		rule("b", "UDP", "ALL", "53", "GOTO"),
+		rule("web-in", "TCP", "ALL", "8080", "JUMP"),
+	}
+	loop[0].Target, loop[1].Target, loop[2].Target = "b", "a", "web-in"
+	policy.Rules = append(policy.Rules, loop...)
+	policy.Num = len(policy.Rules)
+	verrs := policy.Validate().(netmanage.ValidationError)
+	require.Len(t, verrs, 2)
+	assert.Equal(t, "rule 9: Target: JUMP to web-in closes a loop of chains", verrs[0].Error())
+	assert.Equal(t, "rule 8: Target: GOTO to a closes a loop of chains", verrs[1].Error())
+}
+
+func TestEvaluator_Chains(t *testing.T) {
+	e, err := netmanage.NewEvaluator(testPolicy(t, "chains"))
+	require.Nil(t, err)
+	for _, c := range []struct {
+		packet string
+		action netmanage.Action
+		rule   int
+	}{
+		// jumps to ssh-guard and accepted there
+		{"INPUT TCP 10.0.0.5:5555 -> 10.0.0.1:22", netmanage.ActionAccept, 4},
+		// returns from ssh-guard and falls to the default policy
+		{"INPUT TCP 192.168.1.5:5555 -> 10.0.0.1:22", netmanage.ActionDrop, -1},
+		// goes to web-in and never comes back
+		{"INPUT TCP 10.66.0.5:5555 -> 10.0.0.1:443", netmanage.ActionDrop, 5},
+		{"INPUT TCP 8.8.8.8:5555 -> 10.0.0.1:443", netmanage.ActionAccept, 6},
+		{"INPUT TCP 10.0.0.5:5555 -> 10.0.0.1:8080", netmanage.ActionAccept, 2},
+		{"FORWARD TCP 10.0.0.5:5555 -> 10.0.0.1:8080", netmanage.ActionDrop, -1},
+		{"OUTPUT TCP 10.0.0.1:5555 -> 8.8.8.8:53", netmanage.ActionAccept, -1},
+	} {
+		p, err := netmanage.ParsePacket(c.packet)
+		require.Nil(t, err, c.packet)
+		v := e.Evaluate(p)
+		assert.Equal(t, c.action, v.Action, c.packet)
+		assert.Equal(t, c.rule, v.Rule, c.packet)
+	}
+
+	p, err := netmanage.ParsePacket("INPUT TCP 192.168.1.5:5555 -> 10.0.0.1:22")
+	require.Nil(t, err)
+	assert.Equal(t, []netmanage.TraceStep{{0, ""}, {3, ""}, {1, "Dports"}, {2, "Src"}}, e.Evaluate(p).Trace)
+}
+
+func TestParseIptablesSave_Chains(t *testing.T) {
+	out, err := netmanage.RenderIptables(testPolicy(t, "chains"))
+	require.Nil(t, err)
+
+	imported, problems, err := netmanage.ParseIptablesSave(bytes.NewReader(out))
+	require.Nil(t, err)
+	assert.Empty(t, problems)
+	assert.Equal(t, testPolicy(t, "chains").Chains, imported.Chains)
+	assert.Nil(t, imported.Validate())
+}
+
+func TestDiffPolicies_Chains(t *testing.T) {
+	newPolicy := testPolicy(t, "chains")
+	newPolicy.Chains = []netmanage.ChainDef{{Name: "INPUT", Policy: "ACCEPT"}, {Name: "ssh-guard"}, {Name: "OUTPUT", Policy: "DROP"}}
+	d := netmanage.DiffPolicies(testPolicy(t, "chains"), newPolicy)
+	var got []string
+	for _, c := range d.Chains {
+		got = append(got, c.String())
+	}
+	assert.Equal(t, []string{
+		"chain filter INPUT policy DROP -> ACCEPT",
+		"chain filter OUTPUT policy ACCEPT -> DROP",
+		"chain filter FORWARD policy DROP -> ACCEPT",
+		"chain filter web-in removed",
+	}, got)
+	assert.False(t, d.Empty())
+}
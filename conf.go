@@ -0,0 +1,303 @@
+package netmanage
+
+/*
+The conf.go handles the admin set of a policy chain. The Conf stored in the
+latest block lists the admins who approve the next policy, so a new policy
+carrying another Conf changes who governs the chain. The current admins
+approve such a change on its own, by signing its ConfChange, besides the new
+policy.
+
+Admins approve with their weight, 1 unless the conf says otherwise, and the
+total weight of the approving admins must reach the Threshold. Each of the
+Rules adds a threshold for the approving admins holding a role, so a rule
+asking for 1 from "security" gives the security team a veto. The Scopes
+add the thresholds of the parts of the policy a change touches, see scope.go.
+A compromised key is removed with the reduced RevocationThreshold, see
+revocation.go.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dedis/cothority/skipchain"
+)
+
+// ConfChange is what the current admins sign to approve a new admin set or
+// threshold on top of the parent block
+type ConfChange struct {
+	ChainID  skipchain.SkipBlockID
+	ParentID skipchain.SkipBlockID
+	Nonce    string
+	From     *Conf
+	To       *Conf
+}
+
+// Equal tells if both confs have the same thresholds, admins and scopes, in any order
+func (c *Conf) Equal(o *Conf) bool {
+	if c == nil || o == nil {
+		return c == o
+	}
+	a, errA := CanonicalJSON(c.normalized())
+	b, errB := CanonicalJSON(o.normalized())
+	return errA == nil && errB == nil && bytes.Equal(a, b)
+}
+
+// Hash returns the sha256 of the canonical JSON of the conf, two confs listing
+// the same admins in another order have different hashes
+func (c *Conf) Hash() ([]byte, error) {
+	buf, err := CanonicalJSON(c)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(buf)
+	return hash[:], nil
+}
+
+// normalized returns the conf with its admins, rules and scopes sorted
+func (c *Conf) normalized() *Conf {
+	n := &Conf{Threshold: c.Threshold, RevocationThreshold: c.RevocationThreshold, PubKeys: append([]string(nil), c.PubKeys...)}
+	sort.Strings(n.PubKeys)
+	for _, admin := range c.Admins {
+		admin.Roles = append([]string(nil), admin.Roles...)
+		sort.Strings(admin.Roles)
+		n.Admins = append(n.Admins, admin)
+	}
+	sort.Slice(n.Admins, func(i, j int) bool { return n.Admins[i].PubKey < n.Admins[j].PubKey })
+	n.Rules = append(n.Rules, c.Rules...)
+	sort.Slice(n.Rules, func(i, j int) bool { return n.Rules[i].Role < n.Rules[j].Role })
+	n.Scopes = append(n.Scopes, c.Scopes...)
+	sort.Slice(n.Scopes, func(i, j int) bool { return n.Scopes[i].Name < n.Scopes[j].Name })
+	return n
+}
+
+// Members returns every admin of the conf, the ones of PubKeys first with a
+// weight of 1
+func (c *Conf) Members() []Admin {
+	var members []Admin
+	for _, key := range c.PubKeys {
+		members = append(members, Admin{PubKey: key, Weight: 1})
+	}
+	for _, admin := range c.Admins {
+		if admin.Weight == 0 {
+			admin.Weight = 1
+		}
+		members = append(members, admin)
+	}
+	return members
+}
+
+// Validate checks the thresholds and weights of the conf, and that no key
+// or role of an admin appears twice, which Decide would count twice
+func (c *Conf) Validate() error {
+	//a threshold of 0 would let anyone append the next policy
+	if c.Threshold < 1 {
+		return errors.New("the conf needs a threshold of at least 1")
+	}
+	if c.RevocationThreshold < 0 || c.RevocationThreshold > c.Threshold {
+		return fmt.Errorf("the revocation threshold %d is not between 0 and the threshold", c.RevocationThreshold)
+	}
+	roles := make(map[string]bool)
+	for _, admin := range c.Admins {
+		if admin.PubKey == "" {
+			return errors.New("an admin of the conf has no public key")
+		}
+		if admin.Weight < 0 {
+			return fmt.Errorf("admin weight %d is negative", admin.Weight)
+		}
+		held := make(map[string]bool)
+		for _, role := range admin.Roles {
+			if held[role] {
+				return fmt.Errorf("an admin holds the role %q twice", role)
+			}
+			held[role], roles[role] = true, true
+		}
+	}
+	//the same key armored twice is told apart by its KeyID, a key that cannot be read only by its text
+	keys := make(map[string]bool)
+	for _, member := range c.Members() {
+		id := member.PubKey
+		if verifier, err := NewVerifier(member.PubKey); err == nil {
+			id = verifier.KeyID()
+		}
+		if keys[id] {
+			return errors.New("a key appears twice among the admins of the conf")
+		}
+		keys[id] = true
+	}
+	for _, rule := range c.Rules {
+		if !roles[rule.Role] {
+			return fmt.Errorf("no admin holds the role %q of an approval rule", rule.Role)
+		}
+		if rule.Threshold < 1 {
+			return fmt.Errorf("the approval rule of %q needs a threshold of at least 1", rule.Role)
+		}
+	}
+	return c.validateScopes(roles)
+}
+
+// ApprovalDecision explains whether a set of admins approves, rule by rule
+type ApprovalDecision struct {
+	Approved bool
+	// the overall threshold first, then the Rules of the conf, then the
+	// Scopes the change touches
+	Rules []RuleDecision
+	// the outcome of each signature checked, in their order
+	Signatures []SignatureReport
+}
+
+// SignatureReport tells who made one signature and whether it counts
+type SignatureReport struct {
+	// KeyID is the issuer of the signature, in the hex of
+	// openpgp.PublicKey.KeyIdString, empty when it cannot be read
+	KeyID string
+	// Identity is the name of the admin owning the key, empty for a key
+	// of no admin
+	Identity string
+	Valid    bool
+	// Reason tells why an invalid signature does not count
+	Reason string
+}
+
+// String returns the outcome of the signature, like
+// "valid from 8A1B2C3D4E5F6071 (alice)"
+func (r SignatureReport) String() string {
+	from := r.KeyID
+	if from == "" {
+		from = "unknown key"
+	}
+	if r.Identity != "" {
+		from += " (" + r.Identity + ")"
+	}
+	if r.Valid {
+		return "valid from " + from
+	}
+	return "invalid from " + from + ": " + r.Reason
+}
+
+// RuleDecision is the weight of the approving admins for one threshold
+type RuleDecision struct {
+	// Role is empty for the overall threshold, Scope is set for the
+	// threshold of an approval scope
+	Role      string
+	Scope     string
+	Threshold int
+	Weight    int
+	Passed    bool
+}
+
+// String returns the outcome of the rule, like "role security: 1 of 2, failed"
+// or "scope dns: 0 of 1, failed"
+func (r RuleDecision) String() string {
+	name, outcome := "overall", "passed"
+	if r.Scope != "" {
+		name = "scope " + r.Scope
+	} else if r.Role != "" {
+		name = "role " + r.Role
+	}
+	if !r.Passed {
+		outcome = "failed"
+	}
+	return fmt.Sprintf("%s: %d of %d, %s", name, r.Weight, r.Threshold, outcome)
+}
+
+// String returns the outcome of every rule
+func (d *ApprovalDecision) String() string {
+	var rules []string
+	for _, r := range d.Rules {
+		rules = append(rules, r.String())
+	}
+	return strings.Join(rules, "; ")
+}
+
+// Err returns nil when approved, or an error with the failed rules
+func (d *ApprovalDecision) Err() error {
+	if d.Approved {
+		return nil
+	}
+	var failed []string
+	for _, r := range d.Rules {
+		if !r.Passed {
+			failed = append(failed, r.String())
+		}
+	}
+	return errors.New("not approved, " + strings.Join(failed, "; "))
+}
+
+// Approvers returns the key IDs of the valid signatures
+func (d *ApprovalDecision) Approvers() []string {
+	var approvers []string
+	for _, r := range d.Signatures {
+		if r.Valid {
+			approvers = append(approvers, r.KeyID)
+		}
+	}
+	return approvers
+}
+
+// Decide returns the decision of the conf when the members at the given
+// indexes of Members approve
+func (c *Conf) Decide(approvers []int) *ApprovalDecision {
+	members := c.Members()
+	total := 0
+	weights := make(map[string]int)
+	for _, i := range approvers {
+		total += members[i].Weight
+		for _, role := range members[i].Roles {
+			weights[role] += members[i].Weight
+		}
+	}
+	d := &ApprovalDecision{Approved: true}
+	d.add(RuleDecision{Threshold: c.Threshold, Weight: total})
+	for _, rule := range c.Rules {
+		d.add(RuleDecision{Role: rule.Role, Threshold: rule.Threshold, Weight: weights[rule.Role]})
+	}
+	return d
+}
+
+// DecideChange is Decide for a change touching the scopes at the given
+// indexes of Scopes, whose thresholds must be reached as well
+func (c *Conf) DecideChange(approvers, scopes []int) *ApprovalDecision {
+	d := c.Decide(approvers)
+	members := c.Members()
+	for _, i := range scopes {
+		scope := c.Scopes[i]
+		weight := 0
+		for _, j := range approvers {
+			for _, role := range members[j].Roles {
+				if role == scope.Role {
+					weight += members[j].Weight
+					break
+				}
+			}
+		}
+		d.add(RuleDecision{Role: scope.Role, Scope: scope.Name, Threshold: scope.Threshold, Weight: weight})
+	}
+	return d
+}
+
+func (d *ApprovalDecision) add(r RuleDecision) {
+	r.Passed = r.Weight >= r.Threshold
+	d.Approved = d.Approved && r.Passed
+	d.Rules = append(d.Rules, r)
+}
+
+// ConfChange returns the change from the current conf to the one of the
+// policy data
+func (d *PolicyData) ConfChange(current *Conf) *ConfChange {
+	return &ConfChange{ChainID: d.ChainID, ParentID: d.ParentID, Nonce: d.Nonce, From: current, To: d.Conf}
+}
+
+// ConfChangeBytes returns the exact bytes the current admins sign to approve
+// the conf of the policy data replacing the current one. They only exist in
+// the canonical encoding.
+func (d *PolicyData) ConfChangeBytes(current *Conf) ([]byte, error) {
+	if d.Encoding != EncodingCanonicalV1 {
+		return nil, errors.New("conf changes are only signed in the canonical encoding")
+	}
+	return canonicalEnvelope("ConfChange", d.ConfChange(current))
+}
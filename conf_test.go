@@ -0,0 +1,111 @@
+package netmanage_test
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/dedis/netmanage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rolesConf needs 3 overall and 2 from security, bob weighs 2
+func rolesConf() *netmanage.Conf {
+	return &netmanage.Conf{Threshold: 3, PubKeys: []string{"key-ops"},
+		Admins: []netmanage.Admin{
+			{PubKey: "key-alice", Roles: []string{"security"}},
+			{PubKey: "key-bob", Weight: 2, Roles: []string{"security", "network"}},
+			{PubKey: "key-carol", Roles: []string{"network"}},
+		},
+		Rules: []netmanage.ApprovalRule{{Role: "security", Threshold: 2}},
+		Scopes: []netmanage.ApprovalScope{
+			{Name: "dns", Chain: "OUTPUT", Protocol: "UDP", Dports: "53", Role: "network", Threshold: 1},
+			{Name: "input-open", Chain: "INPUT", Action: "ACCEPT", Role: "security", Threshold: 2},
+		},
+	}
+}
+
+func TestConfScanner_Roles(t *testing.T) {
+	conf, err := netmanage.ConfScanner("testdata/conf-roles.toml")
+	require.Nil(t, err)
+	assert.Equal(t, rolesConf(), conf)
+	assert.Nil(t, conf.Validate())
+}
+
+func TestConf_Decide(t *testing.T) {
+	// ops, alice, bob and carol are members 0 to 3
+	for _, c := range []struct {
+		approvers []int
+		approved  bool
+		decision  string
+	}{
+		{[]int{0, 1, 3}, false, "overall: 3 of 3, passed; role security: 1 of 2, failed"},
+		{[]int{2}, false, "overall: 2 of 3, failed; role security: 2 of 2, passed"},
+		{[]int{1, 2}, true, "overall: 3 of 3, passed; role security: 3 of 2, passed"},
+		{[]int{2, 3}, true, "overall: 3 of 3, passed; role security: 2 of 2, passed"},
+	} {
+		d := rolesConf().Decide(c.approvers)
+		assert.Equal(t, c.approved, d.Approved, c.decision)
+		assert.Equal(t, c.decision, d.String())
+		if c.approved {
+			assert.Nil(t, d.Err())
+		} else {
+			assert.NotNil(t, d.Err())
+		}
+	}
+
+	// a flat conf counts the admins
+	d := (&netmanage.Conf{Threshold: 2, PubKeys: []string{"a", "b", "c"}}).Decide([]int{0, 2})
+	assert.True(t, d.Approved)
+	assert.Equal(t, "overall: 2 of 2, passed", d.String())
+}
+
+func TestConf_Validate(t *testing.T) {
+	for _, change := range []func(*netmanage.Conf){
+		func(c *netmanage.Conf) { c.Threshold = 0 },
+		func(c *netmanage.Conf) { c.Admins[0].Weight = -1 },
+		func(c *netmanage.Conf) { c.Admins[1].PubKey = "" },
+		func(c *netmanage.Conf) { c.Rules[0].Role = "audit" },
+		func(c *netmanage.Conf) { c.Rules[0].Threshold = 0 },
+		func(c *netmanage.Conf) { c.Scopes[1].Name = "dns" },
+		func(c *netmanage.Conf) { c.Scopes[0].Dports = "53-" },
+		func(c *netmanage.Conf) { c.Scopes[0].Role = "audit" },
+		func(c *netmanage.Conf) { c.Scopes[1].Threshold = 0 },
+		func(c *netmanage.Conf) { c.RevocationThreshold = -1 },
+		func(c *netmanage.Conf) { c.RevocationThreshold = 4 },
+		func(c *netmanage.Conf) { c.Admins[1].Roles = []string{"security", "network", "security"} },
+		func(c *netmanage.Conf) { c.Admins[0].PubKey = "key-ops" },
+		func(c *netmanage.Conf) { c.Admins[2].PubKey = "key-bob" },
+	} {
+		conf := rolesConf()
+		change(conf)
+		assert.NotNil(t, conf.Validate())
+	}
+}
+
+func TestConf_ValidateSameKey(t *testing.T) {
+	key, err := ioutil.ReadFile("testdata/pgp/expired.asc")
+	require.Nil(t, err)
+	conf := &netmanage.Conf{Threshold: 1, PubKeys: []string{string(key)}}
+	require.Nil(t, conf.Validate())
+	// the same key armored again is still the same admin
+	conf.Admins = []netmanage.Admin{{PubKey: "\n" + string(key), Roles: []string{"security"}}}
+	assert.NotNil(t, conf.Validate())
+}
+
+func TestConf_Equal(t *testing.T) {
+	reordered := rolesConf()
+	reordered.Admins[0], reordered.Admins[2] = reordered.Admins[2], reordered.Admins[0]
+	reordered.Admins[1].Roles = []string{"network", "security"}
+	assert.True(t, rolesConf().Equal(reordered))
+
+	heavier := rolesConf()
+	heavier.Admins[2].Weight = 3
+	assert.False(t, rolesConf().Equal(heavier))
+	stricter := rolesConf()
+	stricter.Rules[0].Threshold = 3
+	assert.False(t, rolesConf().Equal(stricter))
+	unscoped := rolesConf()
+	unscoped.Scopes = unscoped.Scopes[:1]
+	assert.False(t, rolesConf().Equal(unscoped))
+}
@@ -0,0 +1,426 @@
+package netmanage
+
+/*
+The diff.go compares two policies rule by rule, so admins can review what
+a NewPolicyRequest changes before they sign it.
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+)
+
+// ChangeKind tells how a rule changed between two policies
+type ChangeKind int
+
+const (
+	RuleAdded ChangeKind = iota
+	RuleRemoved
+	RuleModified
+	RuleReordered
+)
+
+var changeNames = []string{"added", "removed", "modified", "reordered"}
+
+func (k ChangeKind) String() string {
+	return changeNames[k]
+}
+
+// RuleChange is one difference between two policies. OldIndex is -1 for an
+// added rule and NewIndex is -1 for a removed one.
+type RuleChange struct {
+	Kind     ChangeKind
+	OldIndex int
+	NewIndex int
+	Old      *Rule
+	New      *Rule
+	// Fields lists the fields that differ for a modified rule
+	Fields []string
+}
+
+// GroupChange is an address or service group added, removed or modified
+// between two policies. Rules lists the rules using the group in the new
+// policy, or in the old one for a removed group: a modified group changes
+// what they match even though the rules themselves did not change.
+type GroupChange struct {
+	Kind    ChangeKind
+	Name    string
+	Service bool
+	Rules   []int
+}
+
+// ChainChange is a custom chain added or removed, or a built-in chain whose
+// default policy changed
+type ChainChange struct {
+	Kind      ChangeKind
+	Table     string
+	Name      string
+	OldPolicy string
+	NewPolicy string
+}
+
+// PolicyDiff holds the differences between an old and a new policy
+type PolicyDiff struct {
+	OldDescription string
+	NewDescription string
+	Added          []*RuleChange
+	Removed        []*RuleChange
+	Modified       []*RuleChange
+	Reordered      []*RuleChange
+	Chains         []*ChainChange
+	Groups         []*GroupChange
+}
+
+// Empty tells if both policies have the same rules in the same order, the
+// same chains and the same groups
+func (d *PolicyDiff) Empty() bool {
+	return len(d.Added)+len(d.Removed)+len(d.Modified)+len(d.Reordered)+len(d.Chains)+len(d.Groups) == 0
+}
+
+// maxModifiedFields is how many fields a rule can change and still be seen
+// as a modification of the old rule rather than a new one
+const maxModifiedFields = 2
+
+// DiffPolicies compares the rules of two policies. Rules kept in the same
+// relative order are unchanged; a rule found on both sides out of that order
+// is reordered; a new rule in the same chain as an old one and differing in
+// at most maxModifiedFields fields is modified; the rest is added or removed.
+func DiffPolicies(oldPolicy, newPolicy *Policy) *PolicyDiff {
+	d := &PolicyDiff{OldDescription: oldPolicy.Description, NewDescription: newPolicy.Description}
+	oldKeys := ruleKeys(oldPolicy.Rules)
+	newKeys := ruleKeys(newPolicy.Rules)
+	anchors := longestCommon(oldKeys, newKeys)
+
+	oldLeft := make(map[int]bool)
+	newLeft := make(map[int]bool)
+	for i := range oldKeys {
+		oldLeft[i] = true
+	}
+	for j := range newKeys {
+		newLeft[j] = true
+	}
+	for _, a := range anchors {
+		delete(oldLeft, a[0])
+		delete(newLeft, a[1])
+	}
+
+	change := func(kind ChangeKind, i, j int) *RuleChange {
+		c := &RuleChange{Kind: kind, OldIndex: i, NewIndex: j}
+		if i >= 0 {
+			c.Old = &oldPolicy.Rules[i]
+		}
+		if j >= 0 {
+			c.New = &newPolicy.Rules[j]
+		}
+		return c
+	}
+
+	// identical rules that are not in the common sequence moved
+	for j := range newKeys {
+		if !newLeft[j] {
+			continue
+		}
+		for i := range oldKeys {
+			if oldLeft[i] && oldKeys[i] == newKeys[j] {
+				d.Reordered = append(d.Reordered, change(RuleReordered, i, j))
+				delete(oldLeft, i)
+				delete(newLeft, j)
+				break
+			}
+		}
+	}
+
+	// a new rule close to an old one is a modification of it, the rest is
+	// added or removed
+	for j := range newKeys {
+		if !newLeft[j] {
+			continue
+		}
+		best, bestFields := -1, []string(nil)
+		for i := range oldKeys {
+			if !oldLeft[i] {
+				continue
+			}
+			fields := changedFields(&oldPolicy.Rules[i], &newPolicy.Rules[j])
+			if len(fields) > maxModifiedFields || contains(fields, "Chain") || contains(fields, "Match") {
+				continue
+			}
+			if best < 0 || len(fields) < len(bestFields) {
+				best, bestFields = i, fields
+			}
+		}
+		if best >= 0 {
+			c := change(RuleModified, best, j)
+			c.Fields = bestFields
+			d.Modified = append(d.Modified, c)
+			delete(oldLeft, best)
+			delete(newLeft, j)
+		}
+	}
+	for i := range oldKeys {
+		if oldLeft[i] {
+			d.Removed = append(d.Removed, change(RuleRemoved, i, -1))
+		}
+	}
+	for j := range newKeys {
+		if newLeft[j] {
+			d.Added = append(d.Added, change(RuleAdded, -1, j))
+		}
+	}
+	d.Chains = diffChains(oldPolicy, newPolicy)
+	d.Groups = diffGroups(oldPolicy, newPolicy)
+	return d
+}
+
+// diffChains compares the chains declared by two policies, in the order of
+// the new policy, removed chains last. A built-in chain left out of
+// Policy.Chains has the ACCEPT policy.
+func diffChains(oldPolicy, newPolicy *Policy) []*ChainChange {
+	type key struct{ table, name string }
+	keyOf := func(def ChainDef) key {
+		k := key{def.Table, def.Name}
+		if table, err := ParseTable(def.Table); err == nil {
+			k.table = table.String()
+		}
+		if chain, err := ParseChain(def.Name); err == nil {
+			k.name = chain.String()
+		}
+		return k
+	}
+	policyOf := func(def ChainDef) string {
+		if _, err := ParseChain(def.Name); err == nil {
+			if action, err := ParseAction(def.Policy); err == nil {
+				return action.String()
+			}
+		}
+		return def.Policy
+	}
+	oldChains := make(map[key]string)
+	for _, def := range oldPolicy.Chains {
+		oldChains[keyOf(def)] = policyOf(def)
+	}
+	var changes []*ChainChange
+	for _, def := range newPolicy.Chains {
+		k := keyOf(def)
+		before, ok := oldChains[k]
+		delete(oldChains, k)
+		after := policyOf(def)
+		if _, err := ParseChain(def.Name); err == nil && !ok {
+			before, ok = ActionAccept.String(), true
+		}
+		switch {
+		case !ok:
+			changes = append(changes, &ChainChange{Kind: RuleAdded, Table: k.table, Name: k.name})
+		case before != after:
+			changes = append(changes, &ChainChange{RuleModified, k.table, k.name, before, after})
+		}
+	}
+	for _, def := range oldPolicy.Chains {
+		k := keyOf(def)
+		before, ok := oldChains[k]
+		if !ok {
+			continue
+		}
+		delete(oldChains, k)
+		if _, err := ParseChain(def.Name); err != nil {
+			changes = append(changes, &ChainChange{Kind: RuleRemoved, Table: k.table, Name: k.name})
+		} else if before != ActionAccept.String() {
+			changes = append(changes, &ChainChange{RuleModified, k.table, k.name, before, ActionAccept.String()})
+		}
+	}
+	return changes
+}
+
+func (c *ChainChange) String() string {
+	if c.Kind == RuleModified {
+		return fmt.Sprintf("chain %s %s policy %s -> %s", c.Table, c.Name, c.OldPolicy, c.NewPolicy)
+	}
+	return fmt.Sprintf("chain %s %s %s", c.Table, c.Name, c.Kind)
+}
+
+// diffGroups compares the groups of two policies by name, in the order of
+// the new policy, removed groups last
+func diffGroups(oldPolicy, newPolicy *Policy) []*GroupChange {
+	var changes []*GroupChange
+	add := func(kind ChangeKind, name string, service bool, policy *Policy) {
+		c := &GroupChange{Kind: kind, Name: name, Service: service}
+		for i := range policy.Rules {
+			m := policy.Rules[i].Match
+			if m != nil && (service && m.Service == name || !service && m.usesAddressGroup(name)) {
+				c.Rules = append(c.Rules, i)
+			}
+		}
+		changes = append(changes, c)
+	}
+	oldAddresses := make(map[string]AddressGroup)
+	for _, g := range oldPolicy.AddressGroups {
+		oldAddresses[g.Name] = g
+	}
+	oldServices := make(map[string]ServiceGroup)
+	for _, g := range oldPolicy.ServiceGroups {
+		oldServices[g.Name] = g
+	}
+	for _, g := range newPolicy.AddressGroups {
+		old, ok := oldAddresses[g.Name]
+		delete(oldAddresses, g.Name)
+		switch {
+		case !ok:
+			add(RuleAdded, g.Name, false, newPolicy)
+		case !reflect.DeepEqual(old.Addresses, g.Addresses):
+			add(RuleModified, g.Name, false, newPolicy)
+		}
+	}
+	for _, g := range newPolicy.ServiceGroups {
+		old, ok := oldServices[g.Name]
+		delete(oldServices, g.Name)
+		switch {
+		case !ok:
+			add(RuleAdded, g.Name, true, newPolicy)
+		case old != g:
+			add(RuleModified, g.Name, true, newPolicy)
+		}
+	}
+	for _, g := range oldPolicy.AddressGroups {
+		if _, ok := oldAddresses[g.Name]; ok {
+			add(RuleRemoved, g.Name, false, oldPolicy)
+		}
+	}
+	for _, g := range oldPolicy.ServiceGroups {
+		if _, ok := oldServices[g.Name]; ok {
+			add(RuleRemoved, g.Name, true, oldPolicy)
+		}
+	}
+	return changes
+}
+
+func (c *GroupChange) String() string {
+	name := "address group @" + c.Name
+	if c.Service {
+		name = "service group " + c.Name
+	}
+	if len(c.Rules) == 0 {
+		return fmt.Sprintf("%s %s, unused", name, c.Kind)
+	}
+	return fmt.Sprintf("%s %s, used by rules %v", name, c.Kind, c.Rules)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func ruleKeys(rules []Rule) []string {
+	keys := make([]string, len(rules))
+	for i := range rules {
+		keys[i] = rules[i].String()
+	}
+	return keys
+}
+
+// longestCommon returns the index pairs of a longest common subsequence of
+// a and b
+func longestCommon(a, b []string) [][2]int {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var pairs [][2]int
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] == b[j]:
+			pairs = append(pairs, [2]int{i, j})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return pairs
+}
+
+// changedFields lists the Rule and Match fields that differ
+func changedFields(oldRule, newRule *Rule) []string {
+	var fields []string
+	compare := func(o, n reflect.Value) {
+		for f := 0; f < o.NumField(); f++ {
+			name := o.Type().Field(f).Name
+			if name == "Match" {
+				continue
+			}
+			if !reflect.DeepEqual(o.Field(f).Interface(), n.Field(f).Interface()) {
+				fields = append(fields, name)
+			}
+		}
+	}
+	oldMatch, newMatch := oldRule.Match, newRule.Match
+	if oldMatch == nil || newMatch == nil {
+		if oldMatch != newMatch {
+			fields = append(fields, "Match")
+		}
+	} else {
+		compare(reflect.ValueOf(*oldMatch), reflect.ValueOf(*newMatch))
+	}
+	compare(reflect.ValueOf(*oldRule), reflect.ValueOf(*newRule))
+	return fields
+}
+
+// String renders the diff for reviewers, one line per change in the order
+// of the new policy, removed rules last, then the changed chains and groups
+func (d *PolicyDiff) String() string {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "--- %q\n+++ %q\n", d.OldDescription, d.NewDescription)
+	if d.Empty() {
+		buf.WriteString("  no rule changed\n")
+		return buf.String()
+	}
+	byNew := make(map[int]*RuleChange)
+	for _, list := range [][]*RuleChange{d.Added, d.Modified, d.Reordered} {
+		for _, c := range list {
+			byNew[c.NewIndex] = c
+		}
+	}
+	for j := 0; len(byNew) > 0; j++ {
+		c, ok := byNew[j]
+		if !ok {
+			continue
+		}
+		delete(byNew, j)
+		switch c.Kind {
+		case RuleAdded:
+			fmt.Fprintf(buf, "+ [%d] %s\n", j, c.New)
+		case RuleModified:
+			fmt.Fprintf(buf, "~ [%d] %s\n", j, c.New)
+			fmt.Fprintf(buf, "      was [%d] %s (changed %v)\n", c.OldIndex, c.Old, c.Fields)
+		case RuleReordered:
+			fmt.Fprintf(buf, "> [%d] %s (was [%d])\n", j, c.New, c.OldIndex)
+		}
+	}
+	for _, c := range d.Removed {
+		fmt.Fprintf(buf, "- [%d] %s\n", c.OldIndex, c.Old)
+	}
+	for _, c := range d.Chains {
+		fmt.Fprintf(buf, "* %s\n", c)
+	}
+	for _, c := range d.Groups {
+		fmt.Fprintf(buf, "* %s\n", c)
+	}
+	return buf.String()
+}
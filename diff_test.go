@@ -0,0 +1,64 @@
+package netmanage_test
+
+import (
+	"testing"
+
+	"github.com/dedis/netmanage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func rule(chain, protocol, src, dports, action string) netmanage.Rule {
+	return netmanage.Rule{Match: &netmanage.Match{Chain: chain, Protocol: protocol, Src: src, Sports: "ALL",
+		Dest: "ALL", Dports: dports}, Action: action}
+}
+
+func TestDiffPolicies(t *testing.T) {
+	policy1, err := netmanage.NetPolicyScanner("netPolicy1.json")
+	require.Nil(t, err)
+	policy2, err := netmanage.NetPolicyScanner("netPolicy2.json")
+	require.Nil(t, err)
+
+	d := netmanage.DiffPolicies(policy1, policy2)
+	require.Len(t, d.Added, 1)
+	assert.Equal(t, 0, d.Added[0].NewIndex)
+	assert.Equal(t, "999,1000", d.Added[0].New.Match.Dports)
+	assert.Empty(t, d.Removed)
+	assert.Empty(t, d.Modified)
+	assert.Empty(t, d.Reordered)
+
+	assert.True(t, netmanage.DiffPolicies(policy2, policy2).Empty())
+}
+
+func TestDiffPolicies_Kinds(t *testing.T) {
+	ssh := rule("INPUT", "TCP", "10.0.0.0/8", "22", "ACCEPT")
+	web := rule("INPUT", "TCP", "ALL", "80,443", "ACCEPT")
+	dns := rule("OUTPUT", "UDP", "ALL", "53", "ACCEPT")
+	telnet := rule("INPUT", "TCP", "ALL", "23", "DROP")
+	all := rule("INPUT", "ALL", "ALL", "ALL", "DROP")
+	oldPolicy := &netmanage.Policy{Description: "old", Num: 5, Rules: []netmanage.Rule{ssh, web, dns, telnet, all}}
+
+	web2 := rule("INPUT", "TCP", "ALL", "80,443,8443", "ACCEPT")
+	ntp := rule("OUTPUT", "UDP", "ALL", "123", "ACCEPT")
+	newPolicy := &netmanage.Policy{Description: "new", Num: 5, Rules: []netmanage.Rule{dns, ssh, web2, all, ntp}}
+
+	d := netmanage.DiffPolicies(oldPolicy, newPolicy)
+	require.Len(t, d.Reordered, 1)
+	assert.Equal(t, [2]int{0, 1}, [2]int{d.Reordered[0].OldIndex, d.Reordered[0].NewIndex})
+	require.Len(t, d.Modified, 1)
+	assert.Equal(t, [2]int{1, 2}, [2]int{d.Modified[0].OldIndex, d.Modified[0].NewIndex})
+	assert.Equal(t, []string{"Dports"}, d.Modified[0].Fields)
+	require.Len(t, d.Removed, 1)
+	assert.Equal(t, 3, d.Removed[0].OldIndex)
+	require.Len(t, d.Added, 1)
+	assert.Equal(t, 4, d.Added[0].NewIndex)
+
+	assert.Equal(t, `--- "old"
++++ "new"
+> [1] INPUT TCP src=10.0.0.0/8 sports=ALL dest=ALL dports=22 -> ACCEPT (was [0])
+~ [2] INPUT TCP src=ALL sports=ALL dest=ALL dports=80,443,8443 -> ACCEPT
+      was [1] INPUT TCP src=ALL sports=ALL dest=ALL dports=80,443 -> ACCEPT (changed [Dports])
++ [4] OUTPUT UDP src=ALL sports=ALL dest=ALL dports=123 -> ACCEPT
+- [3] INPUT TCP src=ALL sports=ALL dest=ALL dports=23 -> DROP
+`, d.String())
+}
@@ -0,0 +1,327 @@
+package netmanage
+
+/*
+The encoding.go defines the bytes admins sign for a policy and the bytes the
+roster cosigns for a PolicyData.
+
+The first blocks of the chain were signed over network.Marshal, whose output
+depends on the Go struct layout and on the protobuf library, so it cannot be
+reproduced by other tools and changes whenever a field is added. PolicyData
+with EncodingCanonicalV1 are signed over canonical JSON instead:
+
+  - objects have the Go field names as keys, sorted by their bytes, and no
+    whitespace
+  - fields holding their zero value ("", 0, false, a nil pointer, an empty
+    list) are left out, so adding a field does not change the encoding of
+    data that does not use it
+  - numbers are integers written in decimal, without exponent or fraction
+  - strings are UTF-8, only '"', '\' and the control characters are escaped,
+    the control characters as \u00XX with lowercase hex digits
+  - list items are all written, in order, zero values included, and lists of
+    bytes, like block IDs, are written as strings of lowercase hex digits
+
+The signed value wraps the data with its type and the encoding version, like
+{"Approval":{...},"Type":"Approval","Version":1}, so an admin signature is
+never valid as the cosignature of the roster or for another kind of data. The
+roster cosigns a "PolicyData", or a "CosiPolicy" with the PolicyData and the
+key IDs of the admins who approved it.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+
+	legacy "github.com/dedis/netmanage/legacy"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// Encoding selects how the signed bytes of a PolicyData are built
+type Encoding int
+
+const (
+	// EncodingLegacy is network.Marshal of the structs frozen in legacy/,
+	// kept to verify the blocks signed before the canonical encoding
+	EncodingLegacy Encoding = iota
+	// EncodingCanonicalV1 is the canonical JSON described in encoding.go
+	EncodingCanonicalV1
+)
+
+// String returns the name of the encoding
+func (e Encoding) String() string {
+	switch e {
+	case EncodingLegacy:
+		return "legacy"
+	case EncodingCanonicalV1:
+		return "canonical-v1"
+	}
+	return fmt.Sprintf("unknown(%d)", int(e))
+}
+
+// SigningBytes returns the exact bytes the admins sign to approve the policy.
+// The canonical encoding covers the whole policy data, so that the signatures
+// are bound to the conf, the parent block and the chain; the legacy one only
+// covers the policy.
+func (d *PolicyData) SigningBytes() ([]byte, error) {
+	if d.Policy == nil {
+		return nil, errors.New("the policy data has no policy")
+	}
+	switch d.Encoding {
+	case EncodingLegacy:
+		policy, err := legacyPolicy(d.Policy)
+		if err != nil {
+			return nil, err
+		}
+		return network.Marshal(policy)
+	case EncodingCanonicalV1:
+		return canonicalEnvelope("Approval", d)
+	}
+	return nil, fmt.Errorf("unknown policy encoding %s", d.Encoding)
+}
+
+// CosiBytes returns the exact bytes the roster cosigns for the policy data
+func (d *PolicyData) CosiBytes() ([]byte, error) {
+	switch d.Encoding {
+	case EncodingLegacy:
+		data, err := legacyPolicyData(d)
+		if err != nil {
+			return nil, err
+		}
+		return network.Marshal(data)
+	case EncodingCanonicalV1:
+		return canonicalEnvelope("PolicyData", d)
+	}
+	return nil, fmt.Errorf("unknown policy encoding %s", d.Encoding)
+}
+
+// legacyPolicyData returns the policy data in the layout of the legacy
+// blocks, which it must fit in whole: a field added since would not be
+// covered by the signatures
+func legacyPolicyData(d *PolicyData) (*legacy.PolicyData, error) {
+	data := &legacy.PolicyData{}
+	if d.Policy != nil {
+		var err error
+		if data.Policy, err = legacyPolicy(d.Policy); err != nil {
+			return nil, err
+		}
+	}
+	if d.Conf != nil {
+		data.Conf = &legacy.Conf{Threshold: d.Conf.Threshold, PubKeys: d.Conf.PubKeys}
+	}
+	if err := checkLegacy(d, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func legacyPolicy(p *Policy) (*legacy.Policy, error) {
+	policy := &legacy.Policy{Description: p.Description, Num: p.Num}
+	for _, r := range p.Rules {
+		rule := legacy.Rule{Action: r.Action}
+		if m := r.Match; m != nil {
+			rule.Match = &legacy.Match{Chain: m.Chain, Protocol: m.Protocol, Src: m.Src, Sports: m.Sports,
+				Dest: m.Dest, Dports: m.Dports}
+		}
+		policy.Rules = append(policy.Rules, rule)
+	}
+	if err := checkLegacy(p, policy); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// checkLegacy refuses the value v whose legacy copy lost some fields, the
+// canonical JSON leaves out the empty fields and has the same names for the
+// legacy ones
+func checkLegacy(v, copy interface{}) error {
+	a, err := CanonicalJSON(v)
+	if err != nil {
+		return err
+	}
+	b, err := CanonicalJSON(copy)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(a, b) {
+		return errors.New("the legacy encoding only holds the fields of the first policies, sign the canonical encoding")
+	}
+	return nil
+}
+
+// cosignedApprovals is what the roster cosigns for a policy recording its
+// approvers
+type cosignedApprovals struct {
+	PolicyData    *PolicyData
+	Approvers     []string
+	ConfApprovers []string
+}
+
+// CosiBytes returns the exact bytes the roster cosigns for the policy. They
+// cover the approvers along with the policy data, and are the ones of
+// PolicyData.CosiBytes for the blocks recording no approvers.
+func (p *CosiPolicy) CosiBytes() ([]byte, error) {
+	if len(p.Approvers) == 0 && len(p.ConfApprovers) == 0 {
+		return p.PolicyData.CosiBytes()
+	}
+	if p.PolicyData.Encoding != EncodingCanonicalV1 {
+		return nil, errors.New("approvers are only cosigned in the canonical encoding")
+	}
+	return canonicalEnvelope("CosiPolicy", &cosignedApprovals{p.PolicyData, p.Approvers, p.ConfApprovers})
+}
+
+// canonicalEnvelope encodes v along with its type and the encoding version
+func canonicalEnvelope(name string, v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.WriteString(`{"` + name + `":`)
+	if err := writeCanonical(buf, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	buf.WriteString(`,"Type":`)
+	writeCanonicalString(buf, name)
+	buf.WriteString(`,"Version":` + strconv.Itoa(int(EncodingCanonicalV1)) + "}")
+	return buf.Bytes(), nil
+}
+
+// CanonicalJSON returns the canonical JSON of v, as described in encoding.go
+func CanonicalJSON(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := writeCanonical(buf, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeCanonical(buf *bytes.Buffer, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Invalid:
+		buf.WriteString("null")
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+		return writeCanonical(buf, v.Elem())
+	case reflect.Bool:
+		buf.WriteString(strconv.FormatBool(v.Bool()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf.WriteString(strconv.FormatInt(v.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		buf.WriteString(strconv.FormatUint(v.Uint(), 10))
+	case reflect.String:
+		if !utf8.ValidString(v.String()) {
+			return fmt.Errorf("string %q is not UTF-8", v.String())
+		}
+		writeCanonicalString(buf, v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			buf.WriteString(`"`)
+			for i := 0; i < v.Len(); i++ {
+				fmt.Fprintf(buf, "%02x", v.Index(i).Uint())
+			}
+			buf.WriteString(`"`)
+			return nil
+		}
+		buf.WriteByte('[')
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanonical(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("cannot encode %s, keys must be strings", v.Type())
+		}
+		keys := make([]string, 0, v.Len())
+		for _, k := range v.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		sort.Strings(keys)
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeCanonicalString(buf, k)
+			buf.WriteByte(':')
+			if err := writeCanonical(buf, v.MapIndex(reflect.ValueOf(k).Convert(v.Type().Key()))); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case reflect.Struct:
+		t := v.Type()
+		var names []string
+		fields := make(map[string]reflect.Value)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" || isZero(v.Field(i)) {
+				continue
+			}
+			names = append(names, f.Name)
+			fields[f.Name] = v.Field(i)
+		}
+		sort.Strings(names)
+		buf.WriteByte('{')
+		for i, name := range names {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeCanonicalString(buf, name)
+			buf.WriteByte(':')
+			if err := writeCanonical(buf, fields[name]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("cannot encode %s canonically", v.Type())
+	}
+	return nil
+}
+
+// isZero tells if a struct field is left out of the canonical JSON
+func isZero(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.String:
+		return v.Len() == 0
+	}
+	return false
+}
+
+func writeCanonicalString(buf *bytes.Buffer, s string) {
+	const hex = "0123456789abcdef"
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c < 0x20:
+			buf.WriteString(`\u00`)
+			buf.WriteByte(hex[c>>4])
+			buf.WriteByte(hex[c&0xf])
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	buf.WriteByte('"')
+}
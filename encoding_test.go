@@ -0,0 +1,146 @@
+package netmanage_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dedis/netmanage"
+	legacy "github.com/dedis/netmanage/legacy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	policy := &netmanage.Policy{Description: "café \"lab\"\n<web>", Num: 1, Rules: []netmanage.Rule{
+		{Match: &netmanage.Match{Chain: "INPUT", Protocol: "TCP", Dports: "22", LimitBurst: 10}, Action: "ACCEPT"},
+	}}
+	buf, err := netmanage.CanonicalJSON(policy)
+	require.Nil(t, err)
+	// sorted keys, no zero fields, only quotes, backslashes and control
+	// characters escaped
+	assert.Equal(t, `{"Description":"café \"lab\"\u000a<web>","Num":1,`+
+		`"Rules":[{"Action":"ACCEPT","Match":{"Chain":"INPUT","Dports":"22","LimitBurst":10,"Protocol":"TCP"}}]}`,
+		string(buf))
+
+	_, err = netmanage.CanonicalJSON(&netmanage.Policy{Description: "\xff"})
+	assert.NotNil(t, err)
+}
+
+func TestPolicyData_SigningBytes(t *testing.T) {
+	policy, err := netmanage.NetPolicyScanner("netPolicy1.json")
+	require.Nil(t, err)
+	data := &netmanage.PolicyData{Policy: policy, Conf: &netmanage.Conf{Threshold: 2, PubKeys: []string{"a", "b"}},
+		Encoding: netmanage.EncodingCanonicalV1}
+
+	signed, err := data.SigningBytes()
+	require.Nil(t, err)
+	checkGolden(t, "netPolicy1.signed", signed)
+	cosigned, err := data.CosiBytes()
+	require.Nil(t, err)
+	checkGolden(t, "netPolicy1.cosigned", cosigned)
+
+	// the admins sign the parent block and the chain, block IDs as hex
+	data.ParentID, data.ChainID, data.Nonce = []byte{0xbe, 0xef}, []byte{0x0a}, "n1"
+	bound, err := data.SigningBytes()
+	require.Nil(t, err)
+	assert.NotEqual(t, signed, bound)
+	assert.Contains(t, string(bound), `"ChainID":"0a","Conf":`)
+	assert.Contains(t, string(bound), `"Nonce":"n1","ParentID":"beef","Policy":`)
+
+	// the blocks signed before keep verifying over the network.Marshal bytes
+	// of the structs of then, whatever fields were added since
+	data = &netmanage.PolicyData{Policy: policy, Conf: data.Conf}
+	frozen := &legacy.Policy{Description: policy.Description, Num: 4}
+	for _, r := range policy.Rules {
+		m := r.Match
+		frozen.Rules = append(frozen.Rules, legacy.Rule{Action: r.Action, Match: &legacy.Match{Chain: m.Chain,
+			Protocol: m.Protocol, Src: m.Src, Sports: m.Sports, Dest: m.Dest, Dports: m.Dports}})
+	}
+	signedLegacy, err := data.SigningBytes()
+	require.Nil(t, err)
+	expected, err := network.Marshal(frozen)
+	require.Nil(t, err)
+	assert.Equal(t, expected, signedLegacy)
+	cosignedLegacy, err := data.CosiBytes()
+	require.Nil(t, err)
+	expected, err = network.Marshal(&legacy.PolicyData{Policy: frozen, Conf: &legacy.Conf{Threshold: 2, PubKeys: []string{"a", "b"}}})
+	require.Nil(t, err)
+	assert.Equal(t, expected, cosignedLegacy)
+
+	// the fields added since are not covered by the legacy signatures
+	for _, change := range []func(*netmanage.PolicyData){
+		func(d *netmanage.PolicyData) { d.Policy.Rules[0].Match.Table = "filter" },
+		func(d *netmanage.PolicyData) { d.Policy.Rules[0].Target = "web" },
+		func(d *netmanage.PolicyData) { d.Policy.Chains = []netmanage.ChainDef{{Name: "web"}} },
+		func(d *netmanage.PolicyData) {
+			d.Conf.Rules = []netmanage.ApprovalRule{{Role: "security", Threshold: 1}}
+		},
+		func(d *netmanage.PolicyData) { d.Expiry = "2100-01-01T00:00:00Z" },
+		func(d *netmanage.PolicyData) { d.ParentID = []byte{1} },
+	} {
+		changed, err := netmanage.NetPolicyScanner("netPolicy1.json")
+		require.Nil(t, err)
+		d := &netmanage.PolicyData{Policy: changed, Conf: &netmanage.Conf{Threshold: 2}}
+		change(d)
+		_, err = d.CosiBytes()
+		assert.NotNil(t, err)
+	}
+	policy.Rules[0].Match.Family = "IPv4"
+	_, err = data.SigningBytes()
+	assert.NotNil(t, err)
+
+	data.Encoding = 7
+	_, err = data.SigningBytes()
+	assert.NotNil(t, err)
+	_, err = data.CosiBytes()
+	assert.NotNil(t, err)
+}
+
+func TestCosiPolicy_CosiBytes(t *testing.T) {
+	policy, err := netmanage.NetPolicyScanner("netPolicy1.json")
+	require.Nil(t, err)
+	data := &netmanage.PolicyData{Policy: policy, Conf: &netmanage.Conf{Threshold: 1, PubKeys: []string{"a"}},
+		Encoding: netmanage.EncodingCanonicalV1}
+	cosiPolicy := &netmanage.CosiPolicy{PolicyData: data}
+
+	// blocks without approvers keep the bytes of their policy data
+	cosigned, err := cosiPolicy.CosiBytes()
+	require.Nil(t, err)
+	expected, err := data.CosiBytes()
+	require.Nil(t, err)
+	assert.Equal(t, expected, cosigned)
+
+	cosiPolicy.Approvers = []string{"8A1B2C3D4E5F6071"}
+	cosigned, err = cosiPolicy.CosiBytes()
+	require.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(cosigned), `{"CosiPolicy":{"Approvers":["8A1B2C3D4E5F6071"],"PolicyData":{"Conf":`))
+	assert.True(t, strings.HasSuffix(string(cosigned), `},"Type":"CosiPolicy","Version":1}`))
+
+	data.Encoding = netmanage.EncodingLegacy
+	_, err = cosiPolicy.CosiBytes()
+	assert.NotNil(t, err)
+}
+
+// network.Marshal numbers the fields by their position, the structs of the
+// blocks must start with the fields of the first blocks, in their order
+func TestLegacy_FieldOrder(t *testing.T) {
+	for _, types := range [][2]interface{}{
+		{netmanage.Policy{}, legacy.Policy{}},
+		{netmanage.Rule{}, legacy.Rule{}},
+		{netmanage.Match{}, legacy.Match{}},
+		{netmanage.Conf{}, legacy.Conf{}},
+		{netmanage.PolicyData{}, legacy.PolicyData{}},
+		{netmanage.CosiPolicy{}, struct {
+			PolicyData  *netmanage.PolicyData
+			CoSignature interface{}
+		}{}},
+	} {
+		current, frozen := reflect.TypeOf(types[0]), reflect.TypeOf(types[1])
+		require.True(t, current.NumField() >= frozen.NumField(), current.Name())
+		for i := 0; i < frozen.NumField(); i++ {
+			assert.Equal(t, frozen.Field(i).Name, current.Field(i).Name, current.Name())
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package netmanage
+
+/*
+The eval.go tells what a policy does to a packet without touching a real
+firewall. Rules are checked in order and the first one matching the packet
+decides, like iptables does.
+*/
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Packet describes the flow to evaluate. Ports are only looked at for TCP
+// and UDP. State is the single conntrack state of the packet, a zero State
+// is only matched by the rules for any state. Table and Chain select the
+// rules the packet goes through.
+type Packet struct {
+	Table    Table
+	Chain    Chain
+	Protocol Protocol
+	Src      net.IP
+	Sport    int
+	Dest     net.IP
+	Dport    int
+	State    State
+	// InIface and OutIface are the interfaces the packet comes in and goes
+	// out through, empty when the chain has none or it is not known
+	InIface  string
+	OutIface string
+}
+
+// ParsePacket reads a packet written as
+// "[TABLE] CHAIN PROTOCOL SRC[:PORT] -> DEST[:PORT] [STATE] [in=IFACE] [out=IFACE]",
+// like "INPUT TCP 10.0.0.5:5555 -> 192.168.1.1:443",
+// "FORWARD UDP [2001:db8::1]:5353 -> [2001:db8::2]:53 ESTABLISHED in=eth0 out=wan0" or
+// "nat PREROUTING TCP 8.8.8.8:5555 -> 203.0.113.1:80". Without a table the
+// packet goes through the filter table, without a state it opens a NEW
+// connection.
+func ParsePacket(s string) (*Packet, error) {
+	p := &Packet{State: StateNew}
+	fields, err := p.parseIfaces(strings.Fields(s))
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) > 0 {
+		if table, err := ParseTable(fields[0]); err == nil {
+			p.Table = table
+			fields = fields[1:]
+		}
+	}
+	if len(fields) < 5 || len(fields) > 6 || fields[3] != "->" {
+		return nil, fmt.Errorf("packet %q is not [TABLE] CHAIN PROTOCOL SRC -> DEST [STATE]", s)
+	}
+	if len(fields) == 6 {
+		if p.State, err = ParseState(fields[5]); err != nil {
+			return nil, err
+		}
+		if len(p.State.Names()) != 1 {
+			return nil, fmt.Errorf("a packet has one connection state, not %q", fields[5])
+		}
+	}
+	if p.Chain, err = ParseChain(fields[0]); err != nil {
+		return nil, err
+	}
+	if !containsChain(p.Table.Chains(), p.Chain) {
+		return nil, fmt.Errorf("chain %s is not in the %s table", p.Chain, p.Table)
+	}
+	if p.InIface != "" && !p.Chain.HasInIface() {
+		return nil, fmt.Errorf("packets of %s have no input interface", p.Chain)
+	}
+	if p.OutIface != "" && !p.Chain.HasOutIface() {
+		return nil, fmt.Errorf("packets of %s have no output interface", p.Chain)
+	}
+	if p.Protocol, err = ParseProtocol(fields[1]); err != nil {
+		return nil, err
+	}
+	if p.Protocol == ProtocolAll {
+		return nil, fmt.Errorf("a packet has one protocol, not %s", Any)
+	}
+	if p.Src, p.Sport, err = parseEndpoint(fields[2], p.Protocol); err != nil {
+		return nil, err
+	}
+	if p.Dest, p.Dport, err = parseEndpoint(fields[4], p.Protocol); err != nil {
+		return nil, err
+	}
+	if IPFamily(p.Src) != IPFamily(p.Dest) {
+		return nil, fmt.Errorf("packet %q mixes IPv4 and IPv6", s)
+	}
+	return p, nil
+}
+
+func parseEndpoint(s string, protocol Protocol) (net.IP, int, error) {
+	if !protocol.HasPorts() {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, 0, fmt.Errorf("invalid address %q", s)
+		}
+		return ip, 0, nil
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, 0, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("invalid address %q", host)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return nil, 0, fmt.Errorf("invalid port %q", port)
+	}
+	return ip, n, nil
+}
+
+func (p *Packet) String() string {
+	state := ""
+	if p.State != StateNew {
+		state = " " + p.State.String()
+	}
+	if p.InIface != "" {
+		state += " in=" + p.InIface
+	}
+	if p.OutIface != "" {
+		state += " out=" + p.OutIface
+	}
+	chain := p.Chain.String()
+	if p.Table != TableFilter {
+		chain = p.Table.String() + " " + chain
+	}
+	if !p.Protocol.HasPorts() {
+		return fmt.Sprintf("%s %s %s -> %s%s", chain, p.Protocol, p.Src, p.Dest, state)
+	}
+	return fmt.Sprintf("%s %s %s -> %s%s", chain, p.Protocol,
+		net.JoinHostPort(p.Src.String(), strconv.Itoa(p.Sport)),
+		net.JoinHostPort(p.Dest.String(), strconv.Itoa(p.Dport)), state)
+}
+
+// TraceStep is one rule checked during an evaluation. Mismatch names the
+// first field of the rule that did not match, it is empty for the rule that
+// matched.
+type TraceStep struct {
+	Rule     int
+	Mismatch string
+}
+
+// Verdict is the result of an evaluation. Rule is the index of the rule that
+// matched in Policy.Rules, or -1 when no rule matched and the default policy
+// of the chain applied. The JUMP, GOTO and RETURN rules followed on the way,
+// and the LOG rules that logged the packet, are in the trace with an empty
+// Mismatch.
+type Verdict struct {
+	Action Action
+	Rule   int
+	Trace  []TraceStep
+}
+
+// Evaluator evaluates packets against one policy
+type Evaluator struct {
+	rules  []*TypedRule
+	chains *chainSet
+	// byChain lists the indexes of the rules of each chain
+	byChain map[chainKey][]int
+}
+
+// NewEvaluator parses the policy once for all the packets to evaluate
+func NewEvaluator(policy *Policy) (*Evaluator, error) {
+	rules, chains, errs := policy.typedPolicy()
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	e := &Evaluator{rules: rules, chains: chains, byChain: make(map[chainKey][]int)}
+	for i, rule := range rules {
+		key := chainKey{rule.Match.Table, rule.Match.Chain}
+		e.byChain[key] = append(e.byChain[key], i)
+	}
+	return e, nil
+}
+
+// Evaluate returns the verdict of the policy for the packet. A JUMP comes
+// back after the target chain when no rule of it decided, a GOTO comes back
+// to where the last JUMP came from, like in iptables. Rate limits are taken
+// as not reached, a limited rule matches like one without a limit.
+func (e *Evaluator) Evaluate(p *Packet) *Verdict {
+	v := &Verdict{Action: e.chains.policy(p.Table, p.Chain), Rule: -1}
+	type position struct {
+		chain Chain
+		next  int
+	}
+	var stack []position
+	current := position{p.Chain, 0}
+	for {
+		list := e.byChain[chainKey{p.Table, current.chain}]
+		if current.next >= len(list) {
+			if len(stack) == 0 {
+				// end of the built-in chain, its default policy applies
+				return v
+			}
+			current, stack = stack[len(stack)-1], stack[:len(stack)-1]
+			continue
+		}
+		i := list[current.next]
+		current.next++
+		rule := e.rules[i]
+		mismatch := rule.Match.mismatch(p)
+		v.Trace = append(v.Trace, TraceStep{Rule: i, Mismatch: mismatch})
+		if mismatch != "" {
+			continue
+		}
+		switch rule.Action {
+		case ActionJump:
+			stack = append(stack, current)
+			current = position{rule.Target, 0}
+		case ActionGoto:
+			current = position{rule.Target, 0}
+		case ActionReturn:
+			current.next = len(list)
+		case ActionLog:
+			// logged, the next rule decides
+		default:
+			v.Action = rule.Action
+			v.Rule = i
+			return v
+		}
+	}
+}
+
+// flatten returns the indexes of the rules a packet of the built-in chain may
+// go through, in order, the rules of the custom chains it jumps or goes to
+// following the JUMP or GOTO. The policy has no loop of chains, Validate
+// refuses them.
+func (e *Evaluator) flatten(table Table, chain Chain) []int {
+	var order []int
+	for _, i := range e.byChain[chainKey{table, chain}] {
+		order = append(order, i)
+		if rule := e.rules[i]; rule.Action == ActionJump || rule.Action == ActionGoto {
+			order = append(order, e.flatten(table, rule.Target)...)
+		}
+	}
+	return order
+}
+
+// Evaluate is a shortcut to evaluate a single packet against a policy
+func Evaluate(policy *Policy, p *Packet) (*Verdict, error) {
+	e, err := NewEvaluator(policy)
+	if err != nil {
+		return nil, err
+	}
+	return e.Evaluate(p), nil
+}
+
+// mismatch returns the name of the first field not matching the packet, or
+// "" if the packet is matched
+func (m *TypedMatch) mismatch(p *Packet) string {
+	switch {
+	case !m.Family.Includes(IPFamily(p.Src)):
+		return "Family"
+	case m.Protocol != ProtocolAll && m.Protocol != p.Protocol:
+		return "Protocol"
+	case !m.Src.Contains(p.Src):
+		return "Src"
+	case !m.Dest.Contains(p.Dest):
+		return "Dest"
+	case !m.Sports.Contains(p.Sport):
+		return "Sports"
+	case !m.Dports.Contains(p.Dport):
+		return "Dports"
+	case !m.State.Contains(p.State):
+		return "State"
+	case !ifaceMatches(m.InIface, p.InIface):
+		return "InIface"
+	case !ifaceMatches(m.OutIface, p.OutIface):
+		return "OutIface"
+	}
+	return ""
+}
@@ -0,0 +1,133 @@
+package netmanage_test
+
+import (
+	"testing"
+
+	"github.com/dedis/netmanage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvaluator(t *testing.T) {
+	policy, err := netmanage.NetPolicyScanner("netPolicy2.json")
+	require.Nil(t, err)
+	e, err := netmanage.NewEvaluator(policy)
+	require.Nil(t, err)
+
+	for _, c := range []struct {
+		packet string
+		action netmanage.Action
+		rule   int
+		trace  []netmanage.TraceStep
+	}{
+		{"INPUT TCP 10.0.0.5:5555 -> 192.168.1.1:443", netmanage.ActionDrop, 1,
+			[]netmanage.TraceStep{{0, "Protocol"}, {1, ""}}},
+		{"INPUT UDP 10.0.0.5:5555 -> 192.168.1.1:1000", netmanage.ActionDrop, 0,
+			[]netmanage.TraceStep{{0, ""}}},
+		{"INPUT TCP 10.0.0.5:5555 -> 192.168.1.1:22", netmanage.ActionAccept, 2,
+			[]netmanage.TraceStep{{0, "Protocol"}, {1, "Dports"}, {2, ""}}},
+		{"OUTPUT ICMP 192.168.1.1 -> 8.8.8.8", netmanage.ActionAccept, 3,
+			[]netmanage.TraceStep{{3, ""}}},
+	} {
+		p, err := netmanage.ParsePacket(c.packet)
+		require.Nil(t, err, c.packet)
+		v := e.Evaluate(p)
+		assert.Equal(t, c.action, v.Action, c.packet)
+		assert.Equal(t, c.rule, v.Rule, c.packet)
+		assert.Equal(t, c.trace, v.Trace, c.packet)
+	}
+}
+
+func TestEvaluate_Default(t *testing.T) {
+	policy := &netmanage.Policy{Num: 1, Rules: []netmanage.Rule{
+		{Match: &netmanage.Match{Chain: "INPUT", Protocol: "TCP", Src: "10.0.0.0/8", Sports: "ALL", Dest: "ALL",
+			Dports: "22"}, Action: "DROP"},
+	}}
+	p, err := netmanage.ParsePacket("INPUT TCP 192.168.1.5:40000 -> 192.168.1.1:22")
+	require.Nil(t, err)
+	v, err := netmanage.Evaluate(policy, p)
+	require.Nil(t, err)
+	assert.Equal(t, netmanage.ActionAccept, v.Action)
+	assert.Equal(t, -1, v.Rule)
+	assert.Equal(t, []netmanage.TraceStep{{0, "Src"}}, v.Trace)
+
+	for _, bad := range []string{"INPUT TCP 10.0.0.1 -> 10.0.0.2:22", "INPUT ALL 10.0.0.1 -> 10.0.0.2",
+		"SIDEWAYS UDP 10.0.0.1:1 -> 10.0.0.2:2", "INPUT UDP 10.0.0.1:1 10.0.0.2:2"} {
+		_, err = netmanage.ParsePacket(bad)
+		assert.NotNil(t, err, bad)
+	}
+}
+
+func TestEvaluator_IPv6(t *testing.T) {
+	e, err := netmanage.NewEvaluator(testPolicy(t, "dualstack"))
+	require.Nil(t, err)
+	for packet, rule := range map[string]int{
+		"INPUT TCP [2001:db8::5]:40000 -> [2001:db8::1]:22": 1,
+		"INPUT TCP 10.1.2.3:40000 -> 10.0.0.1:22":           0,
+		"INPUT TCP [2001:db9::5]:40000 -> [2001:db8::1]:22": 5,
+		"INPUT ICMPv6 fe80::1 -> fe80::2":                   3,
+		"INPUT ICMP 192.168.1.1 -> 192.168.1.2":             2,
+		"INPUT UDP 10.1.2.3:547 -> 10.0.0.1:546":            -1,
+		"INPUT UDP [fe80::1]:547 -> [fe80::2]:546":          4,
+	} {
+		p, err := netmanage.ParsePacket(packet)
+		require.Nil(t, err, packet)
+		assert.Equal(t, rule, e.Evaluate(p).Rule, packet)
+	}
+	_, err = netmanage.ParsePacket("INPUT TCP 10.0.0.1:1 -> [::1]:22")
+	assert.NotNil(t, err)
+}
+
+func TestEvaluator_State(t *testing.T) {
+	e, err := netmanage.NewEvaluator(testPolicy(t, "stateful"))
+	require.Nil(t, err)
+	for _, c := range []struct {
+		packet string
+		action netmanage.Action
+		rule   int
+	}{
+		{"INPUT TCP 8.8.8.8:443 -> 10.0.0.1:40000 ESTABLISHED", netmanage.ActionAccept, 0},
+		{"INPUT ICMP 8.8.8.8 -> 10.0.0.1 RELATED", netmanage.ActionAccept, 0},
+		{"INPUT TCP 8.8.8.8:443 -> 10.0.0.1:40000 INVALID", netmanage.ActionDrop, 1},
+		{"INPUT TCP 10.0.0.5:40000 -> 10.0.0.1:22", netmanage.ActionAccept, 2},
+		{"INPUT TCP 8.8.8.8:40000 -> 10.0.0.1:22 NEW", netmanage.ActionDrop, 3},
+	} {
+		p, err := netmanage.ParsePacket(c.packet)
+		require.Nil(t, err, c.packet)
+		v := e.Evaluate(p)
+		assert.Equal(t, c.action, v.Action, c.packet)
+		assert.Equal(t, c.rule, v.Rule, c.packet)
+	}
+
+	for _, bad := range []string{"INPUT ICMP 8.8.8.8 -> 10.0.0.1 NEW,ESTABLISHED", "INPUT ICMP 8.8.8.8 -> 10.0.0.1 ALL"} {
+		_, err = netmanage.ParsePacket(bad)
+		assert.NotNil(t, err, bad)
+	}
+}
+
+func TestEvaluator_NAT(t *testing.T) {
+	e, err := netmanage.NewEvaluator(testPolicy(t, "nat"))
+	require.Nil(t, err)
+	for _, c := range []struct {
+		packet string
+		action netmanage.Action
+		rule   int
+	}{
+		{"nat PREROUTING TCP 8.8.8.8:5555 -> 203.0.113.1:80", netmanage.ActionDNAT, 0},
+		{"nat PREROUTING TCP 8.8.8.8:5555 -> 203.0.113.1:22", netmanage.ActionAccept, -1},
+		{"nat POSTROUTING TCP 192.168.1.5:5555 -> 192.168.2.1:80", netmanage.ActionAccept, 2},
+		{"nat POSTROUTING UDP 192.168.1.5:5555 -> 8.8.8.8:53", netmanage.ActionMasquerade, 3},
+		{"nat POSTROUTING TCP 192.168.1.5:5555 -> 8.8.8.8:443", netmanage.ActionSNAT, 4},
+		// the filter table has no rule
+		{"OUTPUT TCP 192.168.1.5:5555 -> 8.8.8.8:443", netmanage.ActionAccept, -1},
+	} {
+		p, err := netmanage.ParsePacket(c.packet)
+		require.Nil(t, err, c.packet)
+		v := e.Evaluate(p)
+		assert.Equal(t, c.action, v.Action, c.packet)
+		assert.Equal(t, c.rule, v.Rule, c.packet)
+	}
+
+	_, err = netmanage.ParsePacket("nat INPUT TCP 8.8.8.8:5555 -> 203.0.113.1:80")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,223 @@
+package netmanage
+
+/*
+The extensions.go handles the actions and matches that go beyond deciding
+the fate of a packet: REJECT with the reply sent back, LOG with its prefix
+and level, and the rate limits a rule can put on the packets it matches.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RejectType is the reply REJECT sends back. The names do not depend on the
+// family, the ICMP or ICMPv6 message is picked when rendering.
+type RejectType int
+
+const (
+	RejectPortUnreachable RejectType = iota
+	RejectHostUnreachable
+	RejectNetUnreachable
+	RejectAdminProhibited
+	RejectTCPReset
+)
+
+var rejectNames = []string{"port-unreachable", "host-unreachable", "net-unreachable", "admin-prohibited", "tcp-reset"}
+
+// the --reject-with values of iptables and ip6tables, in RejectType order
+var (
+	rejectIptables  = []string{"icmp-port-unreachable", "icmp-host-unreachable", "icmp-net-unreachable", "icmp-admin-prohibited", "tcp-reset"}
+	rejectIp6tables = []string{"icmp6-port-unreachable", "icmp6-addr-unreachable", "icmp6-no-route", "icmp6-adm-prohibited", "tcp-reset"}
+	rejectNft       = []string{"icmpx type port-unreachable", "icmpx type host-unreachable", "icmpx type no-route", "icmpx type admin-prohibited", "tcp reset"}
+)
+
+func (t RejectType) String() string {
+	return rejectNames[t]
+}
+
+// ParseRejectType reads a Rule.RejectWith value, empty is
+// port-unreachable. The iptables and ip6tables names are accepted too.
+func ParseRejectType(s string) (RejectType, error) {
+	if s == "" {
+		return RejectPortUnreachable, nil
+	}
+	for _, names := range [][]string{rejectNames, rejectIptables, rejectIp6tables} {
+		for i, name := range names {
+			if strings.EqualFold(s, name) {
+				return RejectType(i), nil
+			}
+		}
+	}
+	return RejectPortUnreachable, fmt.Errorf("unknown reject type %q", s)
+}
+
+// LogLevel is the syslog level of the LOG action
+type LogLevel int
+
+const (
+	LogEmerg LogLevel = iota
+	LogAlert
+	LogCrit
+	LogError
+	LogWarning
+	LogNotice
+	LogInfo
+	LogDebug
+)
+
+var logLevelNames = []string{"emerg", "alert", "crit", "error", "warning", "notice", "info", "debug"}
+
+// the level names of nft, in LogLevel order
+var logLevelNft = []string{"emerg", "alert", "crit", "err", "warn", "notice", "info", "debug"}
+
+func (l LogLevel) String() string {
+	return logLevelNames[l]
+}
+
+// ParseLogLevel reads a Rule.LogLevel value, a syslog level name or number,
+// empty is warning like for iptables
+func ParseLogLevel(s string) (LogLevel, error) {
+	if s == "" {
+		return LogWarning, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 && n < len(logLevelNames) {
+		return LogLevel(n), nil
+	}
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(i), nil
+		}
+	}
+	return LogWarning, fmt.Errorf("unknown log level %q", s)
+}
+
+// maxLogPrefix is the longest prefix the LOG target accepts
+const maxLogPrefix = 29
+
+// RateLimit is the parsed form of Match.Limit, LimitBurst and
+// LimitPerSource. A rule with a limit only matches the packets within it.
+type RateLimit struct {
+	Rate uint32
+	Unit string
+	// Burst is how many packets can match at once before the rate applies
+	Burst uint32
+	// PerSource gives every source address its own limit
+	PerSource bool
+}
+
+// defaultBurst is the burst of iptables when none is given
+const defaultBurst = 5
+
+var limitUnits = []string{"second", "minute", "hour", "day"}
+
+func (l *RateLimit) String() string {
+	s := fmt.Sprintf("%d/%s burst %d", l.Rate, l.Unit, l.Burst)
+	if l.PerSource {
+		s += " per source"
+	}
+	return s
+}
+
+// ParseRateLimit reads a Match.Limit value written as rate/unit, like
+// "10/second" or "100/minute". The unit can be cut short like iptables does,
+// "10/sec" or "10/s". An empty value is no limit.
+func ParseRateLimit(limit string, burst int, perSource bool) (*RateLimit, error) {
+	if limit == "" {
+		if burst != 0 || perSource {
+			return nil, errors.New("burst and per source need a limit")
+		}
+		return nil, nil
+	}
+	parts := strings.SplitN(limit, "/", 2)
+	rate, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) != 2 || rate < 1 {
+		return nil, fmt.Errorf("limit %q is not rate/unit", limit)
+	}
+	l := &RateLimit{Rate: uint32(rate), Burst: defaultBurst, PerSource: perSource}
+	for _, unit := range limitUnits {
+		if parts[1] != "" && strings.HasPrefix(unit, strings.ToLower(parts[1])) {
+			l.Unit = unit
+		}
+	}
+	if l.Unit == "" {
+		return nil, fmt.Errorf("unknown unit %q, use %s", parts[1], strings.Join(limitUnits, ", "))
+	}
+	switch {
+	case burst < 0:
+		return nil, fmt.Errorf("negative burst %d", burst)
+	case burst > 0:
+		l.Burst = uint32(burst)
+	}
+	return l, nil
+}
+
+// typedExtensions parses the limit of the match and the REJECT and LOG
+// options of the rule, and checks they go with its action and protocol
+func (r *Rule) typedExtensions(rule *TypedRule, fail func(string, error)) {
+	var err error
+	m := r.Match
+	if rule.Match.Limit, err = ParseRateLimit(m.Limit, m.LimitBurst, m.LimitPerSource); err != nil {
+		fail("Limit", err)
+	}
+
+	if rule.Action != ActionReject && r.RejectWith != "" {
+		fail("RejectWith", fmt.Errorf("%s sends no reply", rule.Action))
+	} else if rule.RejectWith, err = ParseRejectType(r.RejectWith); err != nil {
+		fail("RejectWith", err)
+	} else if rule.RejectWith == RejectTCPReset && rule.Action == ActionReject && rule.Match.Protocol != ProtocolTCP {
+		fail("RejectWith", fmt.Errorf("tcp-reset needs TCP, not %s", rule.Match.Protocol))
+	}
+
+	if rule.Action != ActionLog {
+		if r.LogPrefix != "" {
+			fail("LogPrefix", fmt.Errorf("%s does not log", rule.Action))
+		}
+		if r.LogLevel != "" {
+			fail("LogLevel", fmt.Errorf("%s does not log", rule.Action))
+		}
+		return
+	}
+	rule.LogPrefix = r.LogPrefix
+	switch {
+	case len(r.LogPrefix) > maxLogPrefix:
+		fail("LogPrefix", fmt.Errorf("prefix is longer than %d characters", maxLogPrefix))
+	case strings.IndexFunc(r.LogPrefix, func(c rune) bool { return c < ' ' || c > '~' || c == '"' || c == '\\' }) >= 0:
+		fail("LogPrefix", errors.New("prefix can only hold printable ASCII without quotes and backslashes"))
+	}
+	if rule.LogLevel, err = ParseLogLevel(r.LogLevel); err != nil {
+		fail("LogLevel", err)
+	}
+}
+
+// iptablesLimit returns the match arguments of a rate limit. name is used
+// by hashlimit to share the limit between the lines of one rule.
+func iptablesLimit(l *RateLimit, name string, lines int) []string {
+	rate := fmt.Sprintf("%d/%s", l.Rate, l.Unit)
+	burst := strconv.Itoa(int(l.Burst))
+	if !l.PerSource && lines == 1 {
+		return []string{"-m", "limit", "--limit", rate, "--limit-burst", burst}
+	}
+	args := []string{"-m", "hashlimit", "--hashlimit-upto", rate, "--hashlimit-burst", burst}
+	if l.PerSource {
+		args = append(args, "--hashlimit-mode", "srcip")
+	}
+	return append(args, "--hashlimit-name", name)
+}
+
+// nftLimit returns the limit statement of a rate limit. A limit per source
+// is a meter on the source address of family, a meter has a name unique in
+// the table.
+func nftLimit(l *RateLimit, name string, family Family) string {
+	limit := fmt.Sprintf("limit rate %d/%s burst %d packets", l.Rate, l.Unit, l.Burst)
+	if !l.PerSource {
+		return limit
+	}
+	saddr := "ip saddr"
+	if family == FamilyIPv6 {
+		saddr = "ip6 saddr"
+	}
+	return fmt.Sprintf("meter %s { %s %s }", name, saddr, limit)
+}
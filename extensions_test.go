@@ -0,0 +1,117 @@
+package netmanage_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dedis/netmanage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy_ValidateExtensions(t *testing.T) {
+	assert.Nil(t, testPolicy(t, "extensions").Validate())
+
+	bad := []netmanage.Rule{
+		rule("INPUT", "TCP", "ALL", "ALL", "DROP"),
+		rule("INPUT", "UDP", "ALL", "ALL", "REJECT"),
+		rule("INPUT", "TCP", "ALL", "ALL", "REJECT"),
+		rule("INPUT", "TCP", "ALL", "ALL", "ACCEPT"),
+		rule("INPUT", "TCP", "ALL", "ALL", "LOG"),
+		rule("INPUT", "TCP", "ALL", "ALL", "LOG"),
+		rule("INPUT", "TCP", "ALL", "ALL", "ACCEPT"),
+		rule("INPUT", "TCP", "ALL", "ALL", "ACCEPT"),
+		rule("PREROUTING", "TCP", "ALL", "ALL", "REJECT"),
+	}
+	bad[0].RejectWith = "port-unreachable"
+	bad[1].RejectWith = "tcp-reset"
+	bad[2].RejectWith = "go-away"
+	bad[3].LogPrefix = "accepted: "
+	bad[4].LogPrefix = "a prefix longer than the kernel allows"
+	bad[5].LogLevel = "loud"
+	bad[6].Match.Limit = "10/fortnight"
+	bad[7].Match.LimitBurst = 10
+	bad[8].Match.Table = "nat"
+	policy := &netmanage.Policy{Num: len(bad), Rules: bad}
+	got := make(map[int][]string)
+	for _, e := range policy.Validate().(netmanage.ValidationError) {
+		got[e.Index] = append(got[e.Index], e.Field)
+	}
+	assert.Equal(t, map[int][]string{
+		0: {"RejectWith"},
+		1: {"RejectWith"},
+		2: {"RejectWith"},
+		3: {"LogPrefix"},
+		4: {"LogPrefix"},
+		5: {"LogLevel"},
+		6: {"Limit"},
+		7: {"Limit"},
+		8: {"Action"},
+	}, got)
+}
+
+func TestParseRateLimit(t *testing.T) {
+	l, err := netmanage.ParseRateLimit("10/sec", 0, false)
+	require.Nil(t, err)
+	assert.Equal(t, &netmanage.RateLimit{Rate: 10, Unit: "second", Burst: 5}, l)
+	l, err = netmanage.ParseRateLimit("3/m", 3, true)
+	require.Nil(t, err)
+	assert.Equal(t, "3/minute burst 3 per source", l.String())
+	l, err = netmanage.ParseRateLimit("", 0, false)
+	assert.Nil(t, err)
+	assert.Nil(t, l)
+
+	for _, limit := range []string{"10", "0/second", "ten/second", "10/"} {
+		_, err = netmanage.ParseRateLimit(limit, 0, false)
+		assert.NotNil(t, err, limit)
+	}
+	_, err = netmanage.ParseRateLimit("10/second", -1, false)
+	assert.NotNil(t, err)
+}
+
+func TestParseIptablesSave_Extensions(t *testing.T) {
+	out, err := netmanage.RenderIptables(testPolicy(t, "extensions"))
+	require.Nil(t, err)
+
+	imported, problems, err := netmanage.ParseIptablesSave(bytes.NewReader(out))
+	require.Nil(t, err)
+	assert.Empty(t, problems)
+	assert.Nil(t, imported.Validate())
+	// the ports of rule 3 take two lines
+	assert.Equal(t, 6, imported.Num)
+}
+
+func TestEvaluator_Extensions(t *testing.T) {
+	e, err := netmanage.NewEvaluator(testPolicy(t, "extensions"))
+	require.Nil(t, err)
+	p, err := netmanage.ParsePacket("INPUT TCP 8.8.8.8:5555 -> 10.0.0.1:22")
+	require.Nil(t, err)
+	v := e.Evaluate(p)
+	assert.Equal(t, netmanage.ActionAccept, v.Action)
+	assert.Equal(t, 0, v.Rule)
+
+	// logged then rejected
+	p, err = netmanage.ParsePacket("INPUT TCP 8.8.8.8:5555 -> 10.0.0.1:80")
+	require.Nil(t, err)
+	v = e.Evaluate(p)
+	assert.Equal(t, netmanage.ActionReject, v.Action)
+	assert.Equal(t, 2, v.Rule)
+	assert.Equal(t, []netmanage.TraceStep{{0, "Dports"}, {1, ""}, {2, ""}}, v.Trace)
+}
+
+func TestAnalyze_Extensions(t *testing.T) {
+	findings, err := netmanage.Analyze(testPolicy(t, "extensions"))
+	require.Nil(t, err)
+	assert.Empty(t, findings)
+
+	// neither the limited ACCEPT nor the LOG match every packet
+	policy := testPolicy(t, "extensions")
+	policy.Rules = append(policy.Rules, rule("INPUT", "TCP", "ALL", "22", "ACCEPT"))
+	policy.Num = len(policy.Rules)
+	findings, err = netmanage.Analyze(policy)
+	require.Nil(t, err)
+	require.Len(t, findings, 1)
+	assert.Equal(t, netmanage.FindingShadowed, findings[0].Kind)
+	assert.Equal(t, 5, findings[0].Rule)
+	assert.Equal(t, 2, findings[0].Other)
+}
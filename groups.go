@@ -0,0 +1,198 @@
+package netmanage
+
+/*
+The groups.go resolves the named address and service groups of a Policy.
+Rules reference an address group as "@name" in Match.Src/Dest, among
+literal addresses, and a service group by its name in Match.Service. Groups
+are resolved before a rule is parsed, so changing a group changes every rule
+using it.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// groupSet indexes the groups of a policy by name
+type groupSet struct {
+	addresses map[string]*AddressGroup
+	services  map[string]*ServiceGroup
+}
+
+// CheckGroups checks the groups of the policy and that every group a rule
+// references exists. It returns a ValidationError, or nil.
+func (p *Policy) CheckGroups() error {
+	groups, errs := p.groups()
+	for i := range p.Rules {
+		if p.Rules[i].Match == nil {
+			continue
+		}
+		_, ruleErrs := groups.resolve(i, p.Rules[i].Match)
+		errs = append(errs, ruleErrs...)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// groups indexes the groups of the policy, the groups with problems are left
+// out of the index
+func (p *Policy) groups() (*groupSet, ValidationError) {
+	var errs ValidationError
+	g := &groupSet{
+		addresses: make(map[string]*AddressGroup),
+		services:  make(map[string]*ServiceGroup),
+	}
+	for i := range p.AddressGroups {
+		group := &p.AddressGroups[i]
+		err := checkGroupName(group.Name, g.addresses[group.Name] != nil)
+		if err == nil {
+			err = group.check()
+		}
+		if err != nil {
+			errs = append(errs, &RuleError{-1, "AddressGroups", err})
+			continue
+		}
+		g.addresses[group.Name] = group
+	}
+	for i := range p.ServiceGroups {
+		group := &p.ServiceGroups[i]
+		err := checkGroupName(group.Name, g.services[group.Name] != nil)
+		if err == nil {
+			err = group.check()
+		}
+		if err != nil {
+			errs = append(errs, &RuleError{-1, "ServiceGroups", err})
+			continue
+		}
+		g.services[group.Name] = group
+	}
+	return g, errs
+}
+
+func checkGroupName(name string, taken bool) error {
+	switch {
+	case name == "":
+		return errors.New("group has no name")
+	case strings.ContainsAny(name, "@, \t"):
+		return fmt.Errorf("group name %q cannot contain '@', ',' or spaces", name)
+	case strings.EqualFold(name, Any):
+		return fmt.Errorf("group name %q is reserved", name)
+	case taken:
+		return fmt.Errorf("group %q is defined twice", name)
+	}
+	return nil
+}
+
+func (g *AddressGroup) check() error {
+	if len(g.Addresses) == 0 {
+		return fmt.Errorf("group %q has no address", g.Name)
+	}
+	for _, a := range g.Addresses {
+		if strings.HasPrefix(strings.TrimSpace(a), "@") {
+			return fmt.Errorf("group %q: groups cannot reference other groups", g.Name)
+		}
+	}
+	list, err := ParseAddresses(strings.Join(g.Addresses, ","))
+	if err == nil && list == nil {
+		err = fmt.Errorf("%s is not an address", Any)
+	}
+	if err != nil {
+		return fmt.Errorf("group %q: %s", g.Name, err)
+	}
+	return nil
+}
+
+// ports returns the ports of the service, an empty Ports is any port
+func (g *ServiceGroup) ports() string {
+	if g.Ports == "" {
+		return Any
+	}
+	return g.Ports
+}
+
+func (g *ServiceGroup) check() error {
+	protocol, err := ParseProtocol(g.Protocol)
+	if err != nil {
+		return fmt.Errorf("group %q: %s", g.Name, err)
+	}
+	ports, err := ParsePorts(g.ports())
+	if err != nil {
+		return fmt.Errorf("group %q: %s", g.Name, err)
+	}
+	if ports != nil && !protocol.HasPorts() {
+		return fmt.Errorf("group %q: ports need TCP or UDP, not %s", g.Name, protocol)
+	}
+	return nil
+}
+
+// resolve returns a copy of the match with its groups replaced by what they
+// contain, the service giving the protocol and the destination ports
+func (g *groupSet) resolve(index int, m *Match) (*Match, ValidationError) {
+	var errs ValidationError
+	fail := func(field string, err error) {
+		errs = append(errs, &RuleError{index, field, err})
+	}
+	resolved := *m
+	var err error
+	if resolved.Src, err = g.expandAddresses(m.Src); err != nil {
+		fail("Src", err)
+	}
+	if resolved.Dest, err = g.expandAddresses(m.Dest); err != nil {
+		fail("Dest", err)
+	}
+	if m.Service == "" {
+		return &resolved, errs
+	}
+	service, ok := g.services[m.Service]
+	if !ok {
+		fail("Service", fmt.Errorf("unknown service group %q", m.Service))
+		resolved.Protocol, resolved.Dports = Any, Any
+		return &resolved, errs
+	}
+	if m.Protocol != "" && !strings.EqualFold(m.Protocol, Any) {
+		fail("Protocol", fmt.Errorf("protocol is given by service %q", m.Service))
+	}
+	if m.Dports != "" && !strings.EqualFold(m.Dports, Any) {
+		fail("Dports", fmt.Errorf("destination ports are given by service %q", m.Service))
+	}
+	resolved.Protocol, resolved.Dports = service.Protocol, service.ports()
+	return &resolved, errs
+}
+
+// expandAddresses replaces the "@name" items of an address list by the
+// addresses of the group
+func (g *groupSet) expandAddresses(s string) (string, error) {
+	if !strings.Contains(s, "@") {
+		return s, nil
+	}
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if !strings.HasPrefix(item, "@") {
+			items = append(items, item)
+			continue
+		}
+		group, ok := g.addresses[item[1:]]
+		if !ok {
+			// the error is reported, the rule is parsed as matching any address
+			return Any, fmt.Errorf("unknown address group %q", item[1:])
+		}
+		items = append(items, group.Addresses...)
+	}
+	return strings.Join(items, ","), nil
+}
+
+// usesAddressGroup tells if the match references the address group name
+func (m *Match) usesAddressGroup(name string) bool {
+	for _, list := range []string{m.Src, m.Dest} {
+		for _, item := range strings.Split(list, ",") {
+			if strings.TrimSpace(item) == "@"+name {
+				return true
+			}
+		}
+	}
+	return false
+}
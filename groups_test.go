@@ -0,0 +1,90 @@
+package netmanage_test
+
+import (
+	"testing"
+
+	"github.com/dedis/netmanage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetPolicyScanner_Groups(t *testing.T) {
+	policy, err := netmanage.NetPolicyScanner("testdata/groups.json")
+	require.Nil(t, err)
+	assert.Nil(t, policy.Validate())
+
+	rules, err := policy.TypedRules()
+	require.Nil(t, err)
+	assert.Equal(t, netmanage.ProtocolTCP, rules[0].Match.Protocol)
+	assert.Equal(t, "443,8443", rules[0].Match.Dports.String())
+	assert.Equal(t, "192.168.10.0/24,192.168.11.5/32", rules[0].Match.Dest.String())
+	assert.Equal(t, "10.1.0.0/16,10.2.0.1/32", rules[1].Match.Src.String())
+
+	_, err = netmanage.NetPolicyScanner("testdata/groups-unknown.json")
+	require.NotNil(t, err)
+	verrs := err.(netmanage.ValidationError)
+	require.Len(t, verrs, 1)
+	assert.Equal(t, 1, verrs[0].Index)
+	assert.Equal(t, "Src", verrs[0].Field)
+}
+
+func TestPolicy_ValidateGroups(t *testing.T) {
+	policy := &netmanage.Policy{Num: 3,
+		AddressGroups: []netmanage.AddressGroup{
+			{Name: "mixed", Addresses: []string{"10.0.0.0/8", "2001:db8::/32"}},
+			{Name: "lan", Addresses: []string{"10.0.0.0/8"}},
+			{Name: "lan", Addresses: []string{"192.168.0.0/16"}},
+			{Name: "", Addresses: []string{"10.0.0.1"}},
+		},
+		ServiceGroups: []netmanage.ServiceGroup{
+			{Name: "ping", Protocol: "ICMP"},
+			{Name: "bad", Protocol: "ICMP", Ports: "22"},
+		},
+		Rules: []netmanage.Rule{
+			{Match: &netmanage.Match{Chain: "INPUT", Service: "ping", Src: "@lan", Sports: "ALL", Dest: "ALL"}, Action: "ACCEPT"},
+			{Match: &netmanage.Match{Chain: "INPUT", Service: "ping", Protocol: "TCP", Src: "ALL", Sports: "ALL", Dest: "ALL"}, Action: "ACCEPT"},
+			{Match: &netmanage.Match{Chain: "INPUT", Service: "bad", Src: "@mixed", Sports: "ALL", Dest: "ALL"}, Action: "DROP"},
+		}}
+	err := policy.Validate()
+	require.NotNil(t, err)
+	got := make(map[int][]string)
+	for _, e := range err.(netmanage.ValidationError) {
+		got[e.Index] = append(got[e.Index], e.Field)
+	}
+	assert.Equal(t, map[int][]string{
+		-1: {"AddressGroups", "AddressGroups", "AddressGroups", "ServiceGroups"},
+		1:  {"Protocol"},
+		2:  {"Src", "Service"},
+	}, got)
+}
+
+func TestDiffPolicies_Groups(t *testing.T) {
+	oldPolicy, err := netmanage.NetPolicyScanner("testdata/groups.json")
+	require.Nil(t, err)
+	newPolicy, err := netmanage.NetPolicyScanner("testdata/groups.json")
+	require.Nil(t, err)
+	newPolicy.AddressGroups[0].Addresses = append(newPolicy.AddressGroups[0].Addresses, "192.168.12.0/24")
+	newPolicy.ServiceGroups = newPolicy.ServiceGroups[:1]
+	newPolicy.Rules, newPolicy.Num = newPolicy.Rules[:2], 2
+	newPolicy.Rules[1].Match.Service = "https"
+
+	d := netmanage.DiffPolicies(oldPolicy, newPolicy)
+	require.Len(t, d.Groups, 2)
+	assert.Equal(t, netmanage.RuleModified, d.Groups[0].Kind)
+	assert.Equal(t, "web", d.Groups[0].Name)
+	assert.Equal(t, []int{0, 1}, d.Groups[0].Rules)
+	assert.Equal(t, netmanage.RuleRemoved, d.Groups[1].Kind)
+	assert.True(t, d.Groups[1].Service)
+	assert.Equal(t, []int{1}, d.Groups[1].Rules)
+	assert.Contains(t, d.String(), "* address group @web modified, used by rules [0 1]\n")
+
+	// the new addresses of the group reach every rule using it
+	p, err := netmanage.ParsePacket("FORWARD TCP 10.9.9.9:5555 -> 192.168.12.7:443")
+	require.Nil(t, err)
+	v, err := netmanage.Evaluate(newPolicy, p)
+	require.Nil(t, err)
+	assert.Equal(t, 0, v.Rule)
+	v, err = netmanage.Evaluate(oldPolicy, p)
+	require.Nil(t, err)
+	assert.Equal(t, -1, v.Rule)
+}
@@ -0,0 +1,146 @@
+package netmanage
+
+/*
+The interfaces.go handles the network interfaces a rule matches packets
+coming in or going out through. A name ending with '+' matches every
+interface starting with what comes before it, like "eth+" for eth0 and eth1.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// maxIfaceName is the longest interface name of Linux
+const maxIfaceName = 15
+
+// HasInIface tells if the packets of the chain came in through an interface,
+// custom chains can be reached from any chain
+func (c Chain) HasInIface() bool {
+	return !c.Builtin() || c == ChainPrerouting || c == ChainInput || c == ChainForward
+}
+
+// HasOutIface tells if the packets of the chain go out through an
+// interface, custom chains can be reached from any chain
+func (c Chain) HasOutIface() bool {
+	return !c.Builtin() || c == ChainForward || c == ChainOutput || c == ChainPostrouting
+}
+
+// ParseIface reads a Match.InIface or OutIface value. Empty, ALL and "+"
+// match any interface and give "".
+func ParseIface(s string) (string, error) {
+	if s == "" || s == "+" || strings.EqualFold(s, Any) {
+		return "", nil
+	}
+	name := strings.TrimSuffix(s, "+")
+	switch {
+	case len(s) > maxIfaceName:
+		return "", fmt.Errorf("interface %q is longer than %d characters", s, maxIfaceName)
+	case strings.ContainsAny(name, "+ \t/\"'*"):
+		return "", fmt.Errorf("interface %q cannot contain spaces, quotes, '/' or '*', '+' is only allowed at the end", s)
+	case name == "." || name == "..":
+		return "", fmt.Errorf("invalid interface %q", s)
+	}
+	return s, nil
+}
+
+// typedIfaces parses the interfaces of the match and checks the chain of the
+// rule has them
+func (m *Match) typedIfaces(rule *TypedRule, fail func(string, error)) {
+	var err error
+	chain := rule.Match.Chain
+	if rule.Match.InIface, err = ParseIface(m.InIface); err != nil {
+		fail("InIface", err)
+	} else if rule.Match.InIface != "" && chain != "" && !chain.HasInIface() {
+		fail("InIface", fmt.Errorf("packets of %s have no input interface", chain))
+	}
+	if rule.Match.OutIface, err = ParseIface(m.OutIface); err != nil {
+		fail("OutIface", err)
+	} else if rule.Match.OutIface != "" && chain != "" && !chain.HasOutIface() {
+		fail("OutIface", fmt.Errorf("packets of %s have no output interface", chain))
+	}
+}
+
+// parseIfaces reads the "in=IFACE" and "out=IFACE" fields ending a
+// packet and returns the fields before them
+func (p *Packet) parseIfaces(fields []string) ([]string, error) {
+	for len(fields) > 0 {
+		last := fields[len(fields)-1]
+		var iface *string
+		switch {
+		case strings.HasPrefix(last, "in="):
+			iface, last = &p.InIface, last[3:]
+		case strings.HasPrefix(last, "out="):
+			iface, last = &p.OutIface, last[4:]
+		default:
+			return fields, nil
+		}
+		if *iface != "" {
+			return nil, errors.New("a packet has one interface each way")
+		}
+		name, err := ParseIface(last)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" || strings.HasSuffix(name, "+") {
+			return nil, fmt.Errorf("a packet goes through one interface, not %q", last)
+		}
+		*iface = name
+		fields = fields[:len(fields)-1]
+	}
+	return fields, nil
+}
+
+// ifaceMatches tells if the interface pattern of a rule matches the
+// interface of a packet, a packet without interface only matches a rule
+// without one
+func ifaceMatches(pattern, name string) bool {
+	if pattern == "" {
+		return true
+	}
+	if prefix := strings.TrimSuffix(pattern, "+"); prefix != pattern {
+		return name != "" && strings.HasPrefix(name, prefix)
+	}
+	return pattern == name
+}
+
+// ifaceCovers tells if the interface pattern a matches every interface b
+// does
+func ifaceCovers(a, b string) bool {
+	if a == "" {
+		return true
+	}
+	if b == "" {
+		return false
+	}
+	if prefix := strings.TrimSuffix(a, "+"); prefix != a {
+		return strings.HasPrefix(strings.TrimSuffix(b, "+"), prefix)
+	}
+	return a == b
+}
+
+// ifaceOverlaps tells if an interface can be matched by both patterns
+func ifaceOverlaps(a, b string) bool {
+	if a == "" || b == "" {
+		return true
+	}
+	pa, pb := strings.TrimSuffix(a, "+"), strings.TrimSuffix(b, "+")
+	switch {
+	case pa != a && pb != b:
+		return strings.HasPrefix(pa, pb) || strings.HasPrefix(pb, pa)
+	case pa != a:
+		return strings.HasPrefix(b, pa)
+	case pb != b:
+		return strings.HasPrefix(a, pb)
+	}
+	return a == b
+}
+
+// nftIface returns the nft expression of an interface pattern
+func nftIface(key, pattern string) []string {
+	if prefix := strings.TrimSuffix(pattern, "+"); prefix != pattern {
+		pattern = prefix + "*"
+	}
+	return []string{key, fmt.Sprintf("%q", pattern)}
+}
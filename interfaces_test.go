@@ -0,0 +1,128 @@
+package netmanage_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dedis/netmanage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetPolicyScanner_Interfaces(t *testing.T) {
+	policy, err := netmanage.NetPolicyScanner("testdata/interfaces.json")
+	require.Nil(t, err)
+	rules, err := policy.TypedRules()
+	require.Nil(t, err)
+	assert.Equal(t, "wan+", rules[0].Match.InIface)
+	assert.Equal(t, "", rules[0].Match.OutIface)
+	assert.Equal(t, "lan0", rules[1].Match.InIface)
+	assert.Equal(t, "wan0", rules[1].Match.OutIface)
+}
+
+func TestPolicy_ValidateInterfaces(t *testing.T) {
+	bad := []netmanage.Rule{
+		rule("INPUT", "ALL", "ALL", "ALL", "DROP"),
+		rule("OUTPUT", "ALL", "ALL", "ALL", "DROP"),
+		rule("FORWARD", "ALL", "ALL", "ALL", "DROP"),
+		rule("FORWARD", "ALL", "ALL", "ALL", "DROP"),
+		rule("FORWARD", "ALL", "ALL", "ALL", "DROP"),
+		rule("PREROUTING", "ALL", "ALL", "ALL", "ACCEPT"),
+		rule("INPUT", "ALL", "ALL", "ALL", "ACCEPT"),
+	}
+	bad[0].Match.OutIface = "eth0"
+	bad[1].Match.InIface = "eth0"
+	bad[2].Match.InIface = "eth+0"
+	bad[3].Match.OutIface = "a-very-long-interface"
+	bad[4].Match.InIface = "eth 0"
+	bad[5].Match.Table, bad[5].Match.OutIface = "nat", "wan0"
+	// ALL is any interface, like leaving it empty
+	bad[6].Match.InIface, bad[6].Match.OutIface = "ALL", "+"
+	policy := &netmanage.Policy{Num: len(bad), Rules: bad}
+	got := make(map[int][]string)
+	for _, e := range policy.Validate().(netmanage.ValidationError) {
+		got[e.Index] = append(got[e.Index], e.Field)
+	}
+	assert.Equal(t, map[int][]string{
+		0: {"OutIface"},
+		1: {"InIface"},
+		2: {"InIface"},
+		3: {"OutIface"},
+		4: {"InIface"},
+		5: {"OutIface"},
+	}, got)
+}
+
+func TestParseIptablesSave_Interfaces(t *testing.T) {
+	policy := testPolicy(t, "interfaces")
+	out, err := netmanage.RenderIptables(policy)
+	require.Nil(t, err)
+
+	imported, problems, err := netmanage.ParseIptablesSave(bytes.NewReader(out))
+	require.Nil(t, err)
+	assert.Empty(t, problems)
+	require.Equal(t, policy.Num, imported.Num)
+	for i := range policy.Rules {
+		assert.Equal(t, policy.Rules[i].Match.InIface, imported.Rules[i].Match.InIface)
+		assert.Equal(t, policy.Rules[i].Match.OutIface, imported.Rules[i].Match.OutIface)
+	}
+}
+
+func TestEvaluator_Interfaces(t *testing.T) {
+	policy, err := netmanage.NetPolicyScanner("testdata/interfaces.json")
+	require.Nil(t, err)
+	e, err := netmanage.NewEvaluator(policy)
+	require.Nil(t, err)
+	for _, c := range []struct {
+		packet string
+		action netmanage.Action
+		rule   int
+	}{
+		{"INPUT TCP 8.8.8.8:5555 -> 203.0.113.1:23 in=wan1", netmanage.ActionDrop, 0},
+		{"INPUT TCP 10.0.0.5:5555 -> 10.0.0.1:23 in=lan0", netmanage.ActionAccept, -1},
+		// no interface given, the rule needs one
+		{"INPUT TCP 10.0.0.5:5555 -> 10.0.0.1:23", netmanage.ActionAccept, -1},
+		{"FORWARD TCP 10.0.0.5:5555 -> 8.8.8.8:443 in=lan0 out=wan0", netmanage.ActionAccept, 1},
+		{"FORWARD TCP 10.0.0.5:5555 -> 8.8.8.8:443 in=lan0 out=wan1", netmanage.ActionDrop, -1},
+		{"FORWARD TCP 8.8.8.8:443 -> 10.0.0.5:5555 ESTABLISHED in=wan1 out=lan0", netmanage.ActionAccept, 2},
+	} {
+		p, err := netmanage.ParsePacket(c.packet)
+		require.Nil(t, err, c.packet)
+		assert.Equal(t, c.packet, p.String())
+		v := e.Evaluate(p)
+		assert.Equal(t, c.action, v.Action, c.packet)
+		assert.Equal(t, c.rule, v.Rule, c.packet)
+	}
+
+	for _, s := range []string{
+		"OUTPUT TCP 10.0.0.1:5555 -> 8.8.8.8:53 in=lan0",
+		"INPUT TCP 8.8.8.8:5555 -> 10.0.0.1:22 out=lan0",
+		"INPUT TCP 8.8.8.8:5555 -> 10.0.0.1:22 in=wan+",
+		"INPUT TCP 8.8.8.8:5555 -> 10.0.0.1:22 in=wan0 in=wan1",
+	} {
+		_, err := netmanage.ParsePacket(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestAnalyze_Interfaces(t *testing.T) {
+	policy, err := netmanage.NetPolicyScanner("testdata/interfaces.json")
+	require.Nil(t, err)
+	findings, err := netmanage.Analyze(policy)
+	require.Nil(t, err)
+	assert.Empty(t, findings)
+
+	// wan+ matches every packet of wan0, not of lan0
+	policy.Rules = append(policy.Rules,
+		rule("INPUT", "TCP", "ALL", "23", "ACCEPT"),
+		rule("INPUT", "TCP", "ALL", "23", "ACCEPT"))
+	policy.Rules[4].Match.InIface = "wan0"
+	policy.Rules[5].Match.InIface = "lan0"
+	policy.Num = len(policy.Rules)
+	findings, err = netmanage.Analyze(policy)
+	require.Nil(t, err)
+	require.Len(t, findings, 1)
+	assert.Equal(t, netmanage.FindingShadowed, findings[0].Kind)
+	assert.Equal(t, 4, findings[0].Rule)
+	assert.Equal(t, 0, findings[0].Other)
+}
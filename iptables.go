@@ -0,0 +1,164 @@
+package netmanage
+
+/*
+The iptables.go renders a Policy as a file that can be loaded with
+iptables-restore. The output only depends on the policy, so two routers
+rendering the same block get byte-identical files.
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// multiportMax is the number of ports a single multiport match can hold, a
+// range counts for two
+const multiportMax = 15
+
+// RenderIptables turns the IPv4 rules of the policy into an iptables-restore
+// ruleset for the filter table, and the nat table if the policy has nat rules
+func RenderIptables(policy *Policy) ([]byte, error) {
+	return renderIptables(policy, FamilyIPv4)
+}
+
+// RenderIp6tables turns the IPv6 rules of the policy into an
+// ip6tables-restore ruleset, like RenderIptables
+func RenderIp6tables(policy *Policy) ([]byte, error) {
+	return renderIptables(policy, FamilyIPv6)
+}
+
+// renderIptables renders the rules that apply to family, the rules of both
+// families go in both rulesets
+func renderIptables(policy *Policy, family Family) ([]byte, error) {
+	rules, chains, errs := policy.typedPolicy()
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	// the index of the rules in the policy, by table
+	tables := make(map[Table][]int)
+	for i, rule := range rules {
+		if rule.Match.Family.Includes(family) {
+			tables[rule.Match.Table] = append(tables[rule.Match.Table], i)
+		}
+	}
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "# firenet policy %q, %s rules\n", policy.Description, family)
+	for _, table := range []Table{TableFilter, TableNAT} {
+		// the nat table of the router is left alone by a policy without nat rules
+		if table != TableFilter && len(tables[table]) == 0 && !chains.declares(table) {
+			continue
+		}
+		fmt.Fprintf(buf, "*%s\n", table)
+		for _, chain := range table.Chains() {
+			fmt.Fprintf(buf, ":%s %s [0:0]\n", chain, chains.policy(table, chain))
+		}
+		for _, chain := range chains.customChains(table) {
+			fmt.Fprintf(buf, ":%s - [0:0]\n", chain)
+		}
+		for _, i := range tables[table] {
+			for _, line := range iptablesRule(i, rules[i], family) {
+				buf.WriteString(line)
+				buf.WriteByte('\n')
+			}
+		}
+		buf.WriteString("COMMIT\n")
+	}
+	return buf.Bytes(), nil
+}
+
+// iptablesRule returns the -A lines of rule index. A rule only needs several
+// lines when its port lists do not fit in one multiport match, its rate limit
+// is then shared by the lines.
+func iptablesRule(index int, rule *TypedRule, family Family) []string {
+	m := rule.Match
+	var head []string
+	head = append(head, "-A", m.Chain.String())
+	if m.Protocol != ProtocolAll {
+		head = append(head, "-p", iptablesProtocol(m.Protocol))
+	}
+	if m.Src != nil {
+		head = append(head, "-s", m.Src.String())
+	}
+	if m.Dest != nil {
+		head = append(head, "-d", m.Dest.String())
+	}
+	if m.InIface != "" {
+		head = append(head, "-i", m.InIface)
+	}
+	if m.OutIface != "" {
+		head = append(head, "-o", m.OutIface)
+	}
+	if m.State != 0 {
+		head = append(head, "-m", "conntrack", "--ctstate", m.State.String())
+	}
+	sportChunks, dportChunks := splitPorts(m.Sports), splitPorts(m.Dports)
+	var tail []string
+	if m.Limit != nil {
+		name := fmt.Sprintf("firenet%d", index)
+		tail = iptablesLimit(m.Limit, name, len(sportChunks)*len(dportChunks))
+	}
+	tail = append(tail, iptablesTarget(rule, family)...)
+
+	var lines []string
+	for _, sports := range sportChunks {
+		for _, dports := range dportChunks {
+			args := append([]string{}, head...)
+			args = append(args, portMatch(sports, dports)...)
+			args = append(args, tail...)
+			lines = append(lines, strings.Join(args, " "))
+		}
+	}
+	return lines
+}
+
+// iptablesProtocol returns the name iptables gives to the protocol
+func iptablesProtocol(p Protocol) string {
+	if p == ProtocolICMPv6 {
+		return "ipv6-icmp"
+	}
+	return strings.ToLower(p.String())
+}
+
+// portMatch returns the match arguments for one source and one destination
+// port list, each of them fits in a multiport match
+func portMatch(sports, dports PortList) []string {
+	var args []string
+	args = append(args, portArgs("--sport", sports)...)
+	args = append(args, portArgs("--dport", dports)...)
+	return args
+}
+
+func portArgs(option string, ports PortList) []string {
+	switch len(ports) {
+	case 0:
+		return nil
+	case 1:
+		return []string{option, ports.String()}
+	}
+	return []string{"-m", "multiport", option + "s", ports.String()}
+}
+
+// splitPorts cuts a port list in chunks that fit in a multiport match. A nil
+// list gives one nil chunk.
+func splitPorts(ports PortList) []PortList {
+	if ports == nil {
+		return []PortList{nil}
+	}
+	var chunks []PortList
+	var chunk PortList
+	size := 0
+	for _, r := range ports {
+		n := 1
+		if r.First != r.Last {
+			n = 2
+		}
+		if size+n > multiportMax {
+			chunks = append(chunks, chunk)
+			chunk, size = nil, 0
+		}
+		chunk = append(chunk, r)
+		size += n
+	}
+	return append(chunks, chunk)
+}
@@ -0,0 +1,334 @@
+package netmanage
+
+/*
+The iptables_save.go builds a Policy out of an iptables-save dump, so the
+firewalls already running on the routers can be used as the first policy
+of a chain. Only the filter and nat tables are imported, with their custom
+chains and default policies, every line that cannot be expressed as a Rule
+is reported with its line number.
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+// ImportProblem is a line of an iptables-save dump that was not imported
+type ImportProblem struct {
+	Line   int
+	Text   string
+	Reason string
+}
+
+func (p *ImportProblem) Error() string {
+	return fmt.Sprintf("line %d: %s: %s", p.Line, p.Reason, p.Text)
+}
+
+// IptablesSaveScanner reads an iptables-save dump from a file, see
+// ParseIptablesSave
+func IptablesSaveScanner(filename string) (*Policy, []*ImportProblem, error) {
+	log.Lvl3("Reading file", filename)
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	return ParseIptablesSave(file)
+}
+
+// ParseIptablesSave turns the filter and nat tables of an iptables-save dump
+// into a Policy. The returned problems list the lines that were skipped, the error
+// is only for a dump that cannot be read at all.
+func ParseIptablesSave(r io.Reader) (*Policy, []*ImportProblem, error) {
+	policy := &Policy{Description: "imported from iptables-save"}
+	var problems []*ImportProblem
+	table := ""
+	// custom chains declared in the current table
+	custom := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		text := strings.TrimSpace(scanner.Text())
+		skip := func(format string, a ...interface{}) {
+			problems = append(problems, &ImportProblem{lineNum, text, fmt.Sprintf(format, a...)})
+		}
+		switch {
+		case text == "" || strings.HasPrefix(text, "#"):
+		case strings.HasPrefix(text, "*"):
+			table = text[1:]
+			custom = make(map[string]bool)
+		case text == "COMMIT":
+			table = ""
+		case table != "filter" && table != "nat":
+			if strings.HasPrefix(text, "-A ") {
+				skip("table %q is not supported", table)
+			}
+		case strings.HasPrefix(text, ":"):
+			def, reason := importChain(table, text)
+			if reason != "" {
+				skip(reason)
+				continue
+			}
+			if def == nil {
+				continue
+			}
+			check := &Policy{Chains: append(policy.Chains, *def)}
+			if err := check.Validate(); err != nil {
+				skip("%s", err.(ValidationError)[0].Err)
+				continue
+			}
+			policy.Chains = append(policy.Chains, *def)
+			if def.Policy == "" {
+				custom[def.Name] = true
+			}
+		case strings.HasPrefix(text, "-A "):
+			rule, reason := importRule(table, text, custom)
+			if reason != "" {
+				skip(reason)
+				continue
+			}
+			check := &Policy{Num: 1, Rules: []Rule{*rule}, Chains: policy.Chains}
+			if err := check.Validate(); err != nil {
+				skip("%s", err.(ValidationError)[0].Err)
+				continue
+			}
+			policy.Rules = append(policy.Rules, *rule)
+		default:
+			skip("unknown command")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	policy.Num = len(policy.Rules)
+	return policy, problems, nil
+}
+
+// importChain turns a ":CHAIN POLICY [packets:bytes]" line into the
+// declaration of a custom chain or of a default policy. It returns no
+// declaration for a built-in chain with the ACCEPT policy.
+func importChain(table, text string) (*ChainDef, string) {
+	fields := strings.Fields(text[1:])
+	if len(fields) < 2 {
+		return nil, "malformed chain declaration"
+	}
+	def := &ChainDef{Name: fields[0]}
+	if table != "filter" {
+		def.Table = table
+	}
+	chain, err := ParseChain(fields[0])
+	if err != nil {
+		// custom chains have "-" as policy
+		return def, ""
+	}
+	if fields[1] == "ACCEPT" {
+		// also skips the INPUT chain of the nat table the policy does not use
+		return nil, ""
+	}
+	if t, _ := ParseTable(table); !containsChain(t.Chains(), chain) {
+		return nil, fmt.Sprintf("chain %s of the %s table is not supported", chain, table)
+	}
+	def.Policy = fields[1]
+	return def, ""
+}
+
+// importRule turns a "-A CHAIN ..." line of a table into a Rule, or gives
+// the reason why it cannot. custom holds the custom chains of the table a
+// rule can jump to.
+func importRule(table, text string, custom map[string]bool) (*Rule, string) {
+	args, err := splitArgs(text)
+	if err != nil {
+		return nil, err.Error()
+	}
+	m := &Match{Protocol: Any, Src: Any, Sports: Any, Dest: Any, Dports: Any}
+	if table != "filter" {
+		m.Table = table
+	}
+	rule := &Rule{Match: m}
+	for i := 0; i < len(args); i++ {
+		opt := args[i]
+		value := func() (string, bool) {
+			if i+1 >= len(args) || args[i+1] == "!" {
+				return "", false
+			}
+			i++
+			return args[i], true
+		}
+		var ok bool
+		switch opt {
+		case "-A", "--append":
+			m.Chain, ok = value()
+		case "-p", "--protocol":
+			m.Protocol, ok = value()
+			m.Protocol = importProtocol(m.Protocol)
+		case "-s", "--source":
+			m.Src, ok = value()
+		case "-d", "--destination":
+			m.Dest, ok = value()
+		case "-i", "--in-interface":
+			m.InIface, ok = value()
+		case "-o", "--out-interface":
+			m.OutIface, ok = value()
+		case "--sport", "--source-port", "--sports", "--source-ports":
+			m.Sports, ok = value()
+		case "--dport", "--destination-port", "--dports", "--destination-ports":
+			m.Dports, ok = value()
+		case "-m", "--match":
+			var module string
+			module, ok = value()
+			switch module {
+			case "tcp", "udp", "multiport", "comment", "conntrack", "state", "limit", "hashlimit":
+			default:
+				if ok {
+					return nil, fmt.Sprintf("match %q is not supported", module)
+				}
+			}
+		case "--ctstate", "--state":
+			m.State, ok = value()
+		case "--limit", "--hashlimit-upto", "--hashlimit":
+			m.Limit, ok = value()
+		case "--limit-burst", "--hashlimit-burst":
+			var burst string
+			if burst, ok = value(); ok {
+				if m.LimitBurst, err = strconv.Atoi(burst); err != nil {
+					return nil, fmt.Sprintf("invalid burst %q", burst)
+				}
+			}
+		case "--hashlimit-mode":
+			var mode string
+			if mode, ok = value(); ok {
+				if mode != "srcip" {
+					return nil, fmt.Sprintf("hashlimit mode %q is not supported", mode)
+				}
+				m.LimitPerSource = true
+			}
+		case "--hashlimit-name":
+			// the name only shares the limit between rules of the router
+			_, ok = value()
+		case "--reject-with":
+			var with string
+			if with, ok = value(); ok {
+				rule.RejectWith = with
+				if t, err := ParseRejectType(with); err == nil {
+					rule.RejectWith = t.String()
+				}
+			}
+		case "--log-prefix":
+			rule.LogPrefix, ok = value()
+		case "--log-level":
+			var level string
+			if level, ok = value(); ok {
+				rule.LogLevel = level
+				if l, err := ParseLogLevel(level); err == nil {
+					rule.LogLevel = l.String()
+				}
+			}
+		case "--comment":
+			// comments are not part of the policy, the rule is kept without it
+			_, ok = value()
+		case "-j", "--jump":
+			rule.Action, ok = value()
+		case "-g", "--goto":
+			if rule.Target, ok = value(); ok {
+				rule.Action = ActionGoto.String()
+			}
+		case "--to-source", "--to-destination":
+			var to string
+			if to, ok = value(); ok {
+				rule.ToAddress, rule.ToPorts = splitTranslation(to)
+			}
+		case "--to-ports":
+			if rule.ToPorts, ok = value(); ok {
+				rule.ToPorts = strings.Replace(rule.ToPorts, "-", ":", 1)
+			}
+		case "!":
+			return nil, "negated matches are not supported"
+		default:
+			return nil, fmt.Sprintf("option %q is not supported", opt)
+		}
+		if !ok {
+			if i+1 < len(args) && args[i+1] == "!" {
+				return nil, "negated matches are not supported"
+			}
+			return nil, fmt.Sprintf("option %q has no value", opt)
+		}
+	}
+	if rule.Action == "" {
+		return nil, "rule has no target"
+	}
+	action, err := ParseAction(rule.Action)
+	switch {
+	case rule.Target != "":
+		// -g already gave the chain
+	case err == nil && action != ActionJump && action != ActionGoto:
+	case custom[rule.Action]:
+		rule.Action, rule.Target = ActionJump.String(), rule.Action
+	default:
+		return nil, fmt.Sprintf("target %q is not supported", rule.Action)
+	}
+	return rule, ""
+}
+
+// splitTranslation cuts an "address[:first[-last]]" value of --to-source or
+// --to-destination in the ToAddress and ToPorts of a rule
+func splitTranslation(to string) (string, string) {
+	host, ports, err := net.SplitHostPort(to)
+	if err != nil {
+		// no port, the address may still be an IPv6 one between brackets
+		return strings.Trim(to, "[]"), ""
+	}
+	return host, strings.Replace(ports, "-", ":", 1)
+}
+
+// importProtocol gives the Match.Protocol of a "-p" value, ip6tables-save
+// names ICMPv6 after /etc/protocols
+func importProtocol(name string) string {
+	switch strings.ToLower(name) {
+	case "ipv6-icmp", "icmpv6":
+		return ProtocolICMPv6.String()
+	}
+	return strings.ToUpper(name)
+}
+
+// splitArgs cuts a line in words like a shell would, iptables-save quotes
+// the values that contain spaces
+func splitArgs(text string) ([]string, error) {
+	var args []string
+	var word []rune
+	inWord, quoted, escaped := false, false, false
+	for _, c := range text {
+		switch {
+		case escaped:
+			word = append(word, c)
+			escaped = false
+		case c == '\\':
+			escaped, inWord = true, true
+		case c == '"':
+			quoted, inWord = !quoted, true
+		case unicode.IsSpace(c) && !quoted:
+			if inWord {
+				args = append(args, string(word))
+				word, inWord = nil, false
+			}
+		default:
+			word = append(word, c)
+			inWord = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inWord {
+		args = append(args, string(word))
+	}
+	return args, nil
+}
@@ -0,0 +1,63 @@
+package netmanage_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dedis/netmanage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIptablesSaveScanner(t *testing.T) {
+	policy, problems, err := netmanage.IptablesSaveScanner("testdata/iptables-save.txt")
+	require.Nil(t, err)
+	require.Nil(t, policy.Validate())
+
+	assert.Equal(t, 15, policy.Num)
+	assert.Equal(t, []netmanage.ChainDef{{Name: "FORWARD", Policy: "DROP"}, {Name: "ssh-guard"}}, policy.Chains)
+	assert.Equal(t, netmanage.Rule{Match: &netmanage.Match{Table: "nat", Chain: "POSTROUTING", OutIface: "eth0", Protocol: "ALL",
+		Src: "ALL", Sports: "ALL", Dest: "ALL", Dports: "ALL"}, Action: "MASQUERADE"}, policy.Rules[0])
+	assert.Equal(t, netmanage.Rule{Match: &netmanage.Match{Table: "nat", Chain: "PREROUTING", Protocol: "TCP", Src: "ALL",
+		Sports: "ALL", Dest: "203.0.113.1/32", Dports: "80"}, Action: "DNAT", ToAddress: "192.168.1.10", ToPorts: "8080"},
+		policy.Rules[1])
+	assert.Equal(t, "RELATED,ESTABLISHED", policy.Rules[2].Match.State)
+	assert.Equal(t, netmanage.Rule{Match: &netmanage.Match{Chain: "INPUT", Protocol: "TCP", Src: "10.0.0.0/8",
+		Sports: "ALL", Dest: "ALL", Dports: "22"}, Action: "ACCEPT"}, policy.Rules[3])
+	assert.Equal(t, "999,1000", policy.Rules[4].Match.Dports)
+	assert.Equal(t, "wan0", policy.Rules[5].Match.InIface)
+	assert.Equal(t, netmanage.Rule{Match: &netmanage.Match{Chain: "FORWARD", Protocol: "ALL", Src: "172.16.0.0/12",
+		Sports: "ALL", Dest: "10.1.0.0/16", Dports: "ALL"}, Action: "ACCEPT"}, policy.Rules[10])
+	assert.Equal(t, "REJECT", policy.Rules[7].Action)
+	assert.Equal(t, "tcp-reset", policy.Rules[7].RejectWith)
+	assert.Equal(t, "JUMP", policy.Rules[8].Action)
+	assert.Equal(t, "ssh-guard", policy.Rules[8].Target)
+	assert.Equal(t, netmanage.Match{Chain: "ssh-guard", Protocol: "TCP", Src: "ALL", Sports: "ALL", Dest: "ALL",
+		Dports: "ALL", Limit: "3/min", LimitBurst: 3, LimitPerSource: true}, *policy.Rules[11].Match)
+	assert.Equal(t, "5/min", policy.Rules[12].Match.Limit)
+	assert.Equal(t, "ssh-guard: ", policy.Rules[12].LogPrefix)
+	assert.Equal(t, "warning", policy.Rules[12].LogLevel)
+	// ip6tables-save names ICMPv6 ipv6-icmp, ip6tables takes icmpv6 as well
+	assert.Equal(t, netmanage.Rule{Match: &netmanage.Match{Chain: "INPUT", Protocol: "ICMPv6", Src: "fe80::/10",
+		Sports: "ALL", Dest: "ALL", Dports: "ALL"}, Action: "ACCEPT"}, policy.Rules[13])
+	assert.Equal(t, "ICMPv6", policy.Rules[14].Match.Protocol)
+
+	var lines []int
+	for _, p := range problems {
+		lines = append(lines, p.Line)
+	}
+	// the negation
+	assert.Equal(t, []int{16}, lines)
+}
+
+func TestParseIptablesSave_RoundTrip(t *testing.T) {
+	policy, err := netmanage.NetPolicyScanner("netPolicy2.json")
+	require.Nil(t, err)
+	rendered, err := netmanage.RenderIptables(policy)
+	require.Nil(t, err)
+
+	imported, problems, err := netmanage.ParseIptablesSave(bytes.NewReader(rendered))
+	require.Nil(t, err)
+	assert.Empty(t, problems)
+	assert.Equal(t, policy.Rules, imported.Rules)
+}
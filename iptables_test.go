@@ -0,0 +1,107 @@
+package netmanage_test
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/dedis/netmanage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// checkGolden compares out with testdata/name, or rewrites it with -update
+func checkGolden(t *testing.T, name string, out []byte) {
+	golden := filepath.Join("testdata", name)
+	if *update {
+		require.Nil(t, ioutil.WriteFile(golden, out, 0660))
+	}
+	expected, err := ioutil.ReadFile(golden)
+	require.Nil(t, err)
+	assert.Equal(t, string(expected), string(out), golden)
+}
+
+func TestRenderIptables(t *testing.T) {
+	for _, name := range []string{"netPolicy1", "netPolicy2"} {
+		policy, err := netmanage.NetPolicyScanner(name + ".json")
+		require.Nil(t, err)
+		out, err := netmanage.RenderIptables(policy)
+		require.Nil(t, err)
+		checkGolden(t, name+".rules", out)
+
+		again, err := netmanage.RenderIptables(policy)
+		require.Nil(t, err)
+		assert.Equal(t, out, again)
+	}
+}
+
+// testPolicy reads the policy testdata/name.json
+func testPolicy(t *testing.T, name string) *netmanage.Policy {
+	policy, err := netmanage.NetPolicyScanner(filepath.Join("testdata", name+".json"))
+	require.Nil(t, err)
+	return policy
+}
+
+// renderers write the golden files of the policies, by extension
+var renderers = map[string]func(*netmanage.Policy) ([]byte, error){
+	".rules":  netmanage.RenderIptables,
+	".rules6": netmanage.RenderIp6tables,
+	".nft":    netmanage.RenderNftables,
+}
+
+func TestRenderPolicies(t *testing.T) {
+	for _, c := range []struct {
+		policy  string
+		goldens []string
+	}{
+		// IPv4, IPv6 and rules for both families
+		{"dualstack", []string{".rules", ".rules6", ".nft"}},
+		// letting in the replies to connections the host opened
+		{"stateful", []string{".rules", ".nft"}},
+		// a router publishing a web server and masquerading its LAN
+		{"nat", []string{".rules", ".rules6", ".nft"}},
+		// dropping by default and sorting the input in custom chains
+		{"chains", []string{".rules", ".nft"}},
+		// limiting ssh, logging and rejecting the rest of TCP
+		{"extensions", []string{".rules", ".rules6", ".nft"}},
+		{"interfaces", []string{".rules", ".nft"}},
+		// more ports than one multiport match takes
+		{"multiport", []string{".rules"}},
+		{"sets", []string{".nft"}},
+	} {
+		policy := testPolicy(t, c.policy)
+		require.Nil(t, policy.Validate(), c.policy)
+		for _, ext := range c.goldens {
+			out, err := renderers[ext](policy)
+			require.Nil(t, err, c.policy+ext)
+			checkGolden(t, c.policy+ext, out)
+		}
+	}
+}
+
+func TestRenderIptables_Protocol(t *testing.T) {
+	policy := testPolicy(t, "multiport")
+	policy.Rules[0].Match.Protocol = "TPC"
+	_, err := netmanage.RenderIptables(policy)
+	assert.NotNil(t, err)
+}
+
+func TestRenderIptables_State(t *testing.T) {
+	policy := testPolicy(t, "stateful")
+	policy.Rules[0].Match.State = "ESTABLISHED,UNTRACKED"
+	_, err := netmanage.RenderIptables(policy)
+	assert.NotNil(t, err)
+}
+
+func TestRenderIptables_NAT(t *testing.T) {
+	out, err := netmanage.RenderIp6tables(testPolicy(t, "nat"))
+	require.Nil(t, err)
+	imported, problems, err := netmanage.ParseIptablesSave(bytes.NewReader(out))
+	require.Nil(t, err)
+	assert.Empty(t, problems)
+	assert.Equal(t, "fd00::10", imported.Rules[0].ToAddress)
+}
@@ -0,0 +1,45 @@
+// Package netmanage in legacy/ freezes the layout of the structs the first
+// blocks of the chain were signed and cosigned over, with network.Marshal.
+//
+// network.Marshal writes the type of a message, identified by its name, and
+// the fields of the struct in their order, so the blocks of then only verify
+// over structs named like the ones of then, with the same fields. The package
+// is called netmanage for its types to have the names of the baseline ones,
+// like "netmanage.PolicyData"; its structs must never change.
+package netmanage
+
+// Policy is the policy of the blocks signed before the canonical encoding
+type Policy struct {
+	Description string
+	Num         int
+	Rules       []Rule
+}
+
+// Rule is a rule of a legacy Policy
+type Rule struct {
+	Match  *Match
+	Action string
+}
+
+// Match is the match of a legacy Rule
+type Match struct {
+	Chain    string
+	Protocol string
+	Src      string
+	Sports   string
+	Dest     string
+	Dports   string
+}
+
+// Conf is the conf of a legacy PolicyData
+type Conf struct {
+	Threshold int
+	PubKeys   []string
+}
+
+// PolicyData is what the roster cosigned for the blocks signed before the
+// canonical encoding
+type PolicyData struct {
+	Policy *Policy
+	Conf   *Conf
+}
@@ -0,0 +1,209 @@
+package netmanage
+
+/*
+The nat.go checks and renders the rules of the nat table. A nat rule matches
+packets like a filter rule, its action rewrites their source (SNAT,
+MASQUERADE) or destination (DNAT) instead of deciding their fate, or leaves
+them untouched (ACCEPT).
+*/
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// typedTarget parses the Target, ToAddress and ToPorts of the rule and
+// checks they go with its table, chain and action
+func (r *Rule) typedTarget(rule *TypedRule, chains *chainSet, fail func(string, error)) {
+	var err error
+	if _, err = ParseTable(r.Match.Table); err != nil {
+		// already reported, the table of the rule is unknown
+		return
+	}
+	table, chain, action := rule.Match.Table, rule.Match.Chain, rule.Action
+	if !containsAction(table.Actions(), action) {
+		fail("Action", fmt.Errorf("action %s is not allowed in the %s table", action, table))
+	} else if allowed := action.Chains(); allowed != nil && chain.Builtin() && !containsChain(allowed, chain) {
+		// a custom chain can be reached from any built-in chain of the table
+		fail("Chain", fmt.Errorf("%s is only allowed in %s", action, chainList(allowed)))
+	}
+
+	switch {
+	case action == ActionJump || action == ActionGoto:
+		if r.Target == "" {
+			fail("Target", fmt.Errorf("%s needs a target chain", action))
+		} else if rule.Target, err = chains.resolveTarget(table, r.Target); err != nil {
+			fail("Target", err)
+		}
+	case r.Target != "":
+		fail("Target", fmt.Errorf("%s has no target chain", action))
+	}
+
+	switch {
+	case action == ActionSNAT || action == ActionDNAT:
+		if r.ToAddress == "" {
+			fail("ToAddress", fmt.Errorf("%s needs an address to translate to", action))
+			break
+		}
+		if rule.ToAddress, err = parseToAddress(r.ToAddress); err != nil {
+			fail("ToAddress", err)
+			break
+		}
+		family := IPFamily(rule.ToAddress)
+		if rule.Match.Family == FamilyAll {
+			rule.Match.Family = family
+		}
+		if !rule.Match.Family.Includes(family) {
+			fail("ToAddress", fmt.Errorf("%s address in a %s rule", family, rule.Match.Family))
+		}
+	case r.ToAddress != "":
+		fail("ToAddress", fmt.Errorf("%s does not translate addresses", action))
+	}
+
+	if r.ToPorts == "" {
+		return
+	}
+	if action != ActionSNAT && action != ActionDNAT && action != ActionMasquerade {
+		fail("ToPorts", fmt.Errorf("%s does not translate ports", action))
+		return
+	}
+	if rule.ToPorts, err = ParsePorts(r.ToPorts); err != nil {
+		fail("ToPorts", err)
+		return
+	}
+	switch {
+	case len(rule.ToPorts) != 1:
+		fail("ToPorts", errors.New("ports translate to a single port or range"))
+	case !rule.Match.Protocol.HasPorts():
+		fail("ToPorts", fmt.Errorf("ports need TCP or UDP, not %s", rule.Match.Protocol))
+	}
+}
+
+// parseToAddress reads a Rule.ToAddress value, a single address
+func parseToAddress(s string) (net.IP, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, nil
+	}
+	return ip, nil
+}
+
+func containsChain(chains []Chain, c Chain) bool {
+	for _, chain := range chains {
+		if chain == c {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAction(actions []Action, a Action) bool {
+	for _, action := range actions {
+		if action == a {
+			return true
+		}
+	}
+	return false
+}
+
+func chainList(chains []Chain) string {
+	s := make([]string, len(chains))
+	for i, c := range chains {
+		s[i] = c.String()
+	}
+	return strings.Join(s, " and ")
+}
+
+// sameTarget tells if both rules do the same thing to the packets they
+// match, translating to the same address and ports, replying and logging
+// the same way
+func (r *TypedRule) sameTarget(o *TypedRule) bool {
+	return r.Action == o.Action && r.Target == o.Target && r.ToAddress.Equal(o.ToAddress) &&
+		r.ToPorts.String() == o.ToPorts.String() && r.RejectWith == o.RejectWith &&
+		r.LogPrefix == o.LogPrefix && r.LogLevel == o.LogLevel
+}
+
+// translation returns the address and ports of the rule written as
+// address:first-last, the address being between brackets for IPv6
+func (r *TypedRule) translation() string {
+	address := ""
+	if r.ToAddress != nil {
+		address = r.ToAddress.String()
+	}
+	if r.ToPorts == nil {
+		return address
+	}
+	ports := strconv.Itoa(int(r.ToPorts[0].First))
+	if r.ToPorts[0].Last != r.ToPorts[0].First {
+		ports += "-" + strconv.Itoa(int(r.ToPorts[0].Last))
+	}
+	if r.ToAddress != nil && IPFamily(r.ToAddress) == FamilyIPv6 {
+		address = "[" + address + "]"
+	}
+	return address + ":" + ports
+}
+
+// iptablesTarget returns the -j or -g arguments of the rule for the family
+// of the iptables or ip6tables command
+func iptablesTarget(rule *TypedRule, family Family) []string {
+	args := []string{"-j", rule.Action.String()}
+	switch rule.Action {
+	case ActionJump:
+		args = []string{"-j", rule.Target.String()}
+	case ActionGoto:
+		args = []string{"-g", rule.Target.String()}
+	case ActionSNAT:
+		args = append(args, "--to-source", rule.translation())
+	case ActionDNAT:
+		args = append(args, "--to-destination", rule.translation())
+	case ActionMasquerade:
+		if rule.ToPorts != nil {
+			args = append(args, "--to-ports", strings.TrimPrefix(rule.translation(), ":"))
+		}
+	case ActionReject:
+		names := rejectIptables
+		if family == FamilyIPv6 {
+			names = rejectIp6tables
+		}
+		args = append(args, "--reject-with", names[rule.RejectWith])
+	case ActionLog:
+		if rule.LogPrefix != "" {
+			args = append(args, "--log-prefix", strconv.Quote(rule.LogPrefix))
+		}
+		args = append(args, "--log-level", rule.LogLevel.String())
+	}
+	return args
+}
+
+// nftTarget returns the statement ending the nft rule
+func nftTarget(rule *TypedRule) string {
+	switch rule.Action {
+	case ActionJump, ActionGoto:
+		return fmt.Sprintf("%s %s", strings.ToLower(rule.Action.String()), nftChain(rule.Match.Table, rule.Target))
+	case ActionSNAT, ActionDNAT:
+		family := "ip"
+		if IPFamily(rule.ToAddress) == FamilyIPv6 {
+			family = "ip6"
+		}
+		return fmt.Sprintf("%s %s to %s", strings.ToLower(rule.Action.String()), family, rule.translation())
+	case ActionMasquerade:
+		if rule.ToPorts != nil {
+			return "masquerade to " + rule.translation()
+		}
+	case ActionReject:
+		return "reject with " + rejectNft[rule.RejectWith]
+	case ActionLog:
+		log := "log"
+		if rule.LogPrefix != "" {
+			log += fmt.Sprintf(" prefix %q", rule.LogPrefix)
+		}
+		return log + " level " + logLevelNft[rule.LogLevel]
+	}
+	return strings.ToLower(rule.Action.String())
+}
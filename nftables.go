@@ -0,0 +1,185 @@
+package netmanage
+
+/*
+The nftables.go renders a Policy as a script for nft -f. Every rule goes in
+one inet table, so IPv4 and IPv6 rules live side by side, port and address
+lists are turned into named sets. Like the iptables output, the script only
+depends on the policy.
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// NftablesTable is the name of the inet table holding the rendered policy
+const NftablesTable = "firenet"
+
+// RenderNftables turns the policy into an nft script replacing the firenet
+// table with the input/output/forward base chains of the policy, and the
+// nat_prerouting/nat_output/nat_postrouting chains if it has nat rules.
+// Custom chains are regular chains of the firenet table.
+func RenderNftables(policy *Policy) ([]byte, error) {
+	rules, chains, errs := policy.typedPolicy()
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	sets := new(bytes.Buffer)
+	lines := map[Table]map[Chain][]string{TableFilter: {}, TableNAT: {}}
+	for i, rule := range rules {
+		chain := lines[rule.Match.Table]
+		chain[rule.Match.Chain] = append(chain[rule.Match.Chain], nftRule(sets, i, rule)...)
+	}
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "# firenet policy %q\n", policy.Description)
+	// declaring the table first lets the delete succeed on a fresh router
+	fmt.Fprintf(buf, "table inet %s\ndelete table inet %s\n\n", NftablesTable, NftablesTable)
+	fmt.Fprintf(buf, "table inet %s {\n", NftablesTable)
+	buf.Write(sets.Bytes())
+	for _, table := range []Table{TableFilter, TableNAT} {
+		if table != TableFilter && len(lines[table]) == 0 && !chains.declares(table) {
+			continue
+		}
+		for _, chain := range append(table.Chains(), chains.customChains(table)...) {
+			fmt.Fprintf(buf, "\tchain %s {\n", nftChain(table, chain))
+			if chain.Builtin() {
+				priority := 0
+				if table == TableNAT {
+					priority = -100
+					if chain == ChainPostrouting {
+						priority = 100
+					}
+				}
+				fmt.Fprintf(buf, "\t\ttype %s hook %s priority %d; policy %s;\n", table,
+					strings.ToLower(chain.String()), priority, strings.ToLower(chains.policy(table, chain).String()))
+			}
+			for _, line := range lines[table][chain] {
+				fmt.Fprintf(buf, "\t\t%s\n", line)
+			}
+			buf.WriteString("\t}\n")
+		}
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes(), nil
+}
+
+// nftChain returns the name of a chain in the firenet table, the chains of
+// the nat table get a prefix as both tables share the firenet table
+func nftChain(table Table, chain Chain) string {
+	name := chain.String()
+	if chain.Builtin() {
+		name = strings.ToLower(name)
+	}
+	if table == TableNAT {
+		return "nat_" + name
+	}
+	return name
+}
+
+// nftRule returns the statements of the index-th rule, the sets it uses are
+// written into sets. A rule has one statement, but for a limit per source in
+// a rule of both families which needs a meter for each family.
+func nftRule(sets *bytes.Buffer, index int, rule *TypedRule) []string {
+	m := rule.Match
+	var args []string
+	if m.Family != FamilyAll && m.Src == nil && m.Dest == nil {
+		args = append(args, "meta", "nfproto", strings.ToLower(m.Family.String()))
+	}
+	if m.InIface != "" {
+		args = append(args, nftIface("iifname", m.InIface)...)
+	}
+	if m.OutIface != "" {
+		args = append(args, nftIface("oifname", m.OutIface)...)
+	}
+	if m.Src != nil {
+		args = append(args, nftFamily(m.Src), "saddr", nftAddresses(sets, fmt.Sprintf("rule%d_src", index), m.Src))
+	}
+	if m.Dest != nil {
+		args = append(args, nftFamily(m.Dest), "daddr", nftAddresses(sets, fmt.Sprintf("rule%d_dest", index), m.Dest))
+	}
+	if m.State != 0 {
+		args = append(args, "ct", "state", strings.ToLower(m.State.String()))
+	}
+	proto := iptablesProtocol(m.Protocol)
+	switch {
+	case m.Sports != nil || m.Dports != nil:
+		if m.Sports != nil {
+			args = append(args, proto, "sport", nftPorts(sets, fmt.Sprintf("rule%d_sports", index), m.Sports))
+		}
+		if m.Dports != nil {
+			args = append(args, proto, "dport", nftPorts(sets, fmt.Sprintf("rule%d_dports", index), m.Dports))
+		}
+	case m.Protocol != ProtocolAll:
+		args = append(args, "meta", "l4proto", proto)
+	}
+	target := nftTarget(rule)
+	if m.Limit == nil {
+		return []string{strings.Join(append(args, target), " ")}
+	}
+	name := fmt.Sprintf("rule%d_limit", index)
+	if !m.Limit.PerSource || m.Family != FamilyAll {
+		return []string{strings.Join(append(args, nftLimit(m.Limit, name, m.Family), target), " ")}
+	}
+	var statements []string
+	for _, family := range []Family{FamilyIPv4, FamilyIPv6} {
+		head := []string{"meta", "nfproto", strings.ToLower(family.String())}
+		head = append(head, args...)
+		meter := fmt.Sprintf("%s_%s", name, strings.ToLower(family.String()))
+		statements = append(statements, strings.Join(append(head, nftLimit(m.Limit, meter, family), target), " "))
+	}
+	return statements
+}
+
+// nftPorts returns the port expression, a named set when there is more than
+// one port or range
+func nftPorts(sets *bytes.Buffer, name string, ports PortList) string {
+	elements := make([]string, len(ports))
+	for i, r := range ports {
+		if r.First == r.Last {
+			elements[i] = fmt.Sprintf("%d", r.First)
+		} else {
+			elements[i] = fmt.Sprintf("%d-%d", r.First, r.Last)
+		}
+	}
+	if len(elements) == 1 {
+		return elements[0]
+	}
+	writeSet(sets, name, "inet_service", elements)
+	return "@" + name
+}
+
+// nftAddresses returns the address expression, a named set when there is
+// more than one prefix
+func nftAddresses(sets *bytes.Buffer, name string, addresses AddressList) string {
+	elements := make([]string, len(addresses))
+	for i, prefix := range addresses {
+		elements[i] = prefix.String()
+	}
+	if len(elements) == 1 {
+		return elements[0]
+	}
+	if addresses.Family() == FamilyIPv6 {
+		writeSet(sets, name, "ipv6_addr", elements)
+	} else {
+		writeSet(sets, name, "ipv4_addr", elements)
+	}
+	return "@" + name
+}
+
+// nftFamily returns the payload protocol of the addresses, ip or ip6
+func nftFamily(addresses AddressList) string {
+	if addresses.Family() == FamilyIPv6 {
+		return "ip6"
+	}
+	return "ip"
+}
+
+func writeSet(sets *bytes.Buffer, name, typ string, elements []string) {
+	fmt.Fprintf(sets, "\tset %s {\n", name)
+	fmt.Fprintf(sets, "\t\ttype %s\n", typ)
+	sets.WriteString("\t\tflags interval\n")
+	fmt.Fprintf(sets, "\t\telements = { %s }\n", strings.Join(elements, ", "))
+	sets.WriteString("\t}\n\n")
+}
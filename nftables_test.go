@@ -0,0 +1,52 @@
+package netmanage_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dedis/netmanage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderNftables(t *testing.T) {
+	for _, name := range []string{"netPolicy1", "netPolicy2"} {
+		policy, err := netmanage.NetPolicyScanner(name + ".json")
+		require.Nil(t, err)
+		out, err := netmanage.RenderNftables(policy)
+		require.Nil(t, err)
+		checkGolden(t, name+".nft", out)
+	}
+
+}
+
+func TestWritePolicyFile(t *testing.T) {
+	policy, err := netmanage.NetPolicyScanner("netPolicy1.json")
+	require.Nil(t, err)
+	cosiPolicy := &netmanage.CosiPolicy{PolicyData: &netmanage.PolicyData{Policy: policy}}
+
+	dir, err := ioutil.TempDir("", "firenet")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	for format, golden := range map[netmanage.PolicyFormat]string{
+		netmanage.FormatIptables: "netPolicy1.rules",
+		netmanage.FormatNftables: "netPolicy1.nft",
+	} {
+		file := filepath.Join(dir, golden)
+		require.Nil(t, netmanage.WritePolicyFile(cosiPolicy, file, format))
+		written, err := ioutil.ReadFile(file)
+		require.Nil(t, err)
+		expected, err := ioutil.ReadFile(filepath.Join("testdata", golden))
+		require.Nil(t, err)
+		assert.Equal(t, string(expected), string(written))
+	}
+
+	file := filepath.Join(dir, "policy.json")
+	require.Nil(t, netmanage.WritePolicyFile(cosiPolicy, file, netmanage.FormatJSON))
+	read, err := netmanage.NetPolicyScanner(file)
+	require.Nil(t, err)
+	assert.Equal(t, policy, read)
+}
@@ -2,9 +2,10 @@ package netmanage
 
 import (
 	"bufio"
+	"errors"
+	"fmt"
 	"os"
 	"strings"
-	//"fmt"
 
 	"github.com/BurntSushi/toml"
 	"gopkg.in/dedis/onet.v1/log"
@@ -15,43 +16,85 @@ import (
 	"encoding/hex"
 )
 
-// Scanner for a file containing signatures, return sig array
+// Scanner for a file containing signatures, return sig array. The file lists armored OpenPGP and SSH
+// signatures and one-line Ed25519 signatures, in any order, see verifier.go
 func SigScanner(filename string) ([]string, error) {
 	var blocks []string
-	head := "-----BEGIN PGP SIGNATURE-----"
 	log.Lvl2("Reading file", filename)
 
 	file, err := os.Open(filename)
-	defer file.Close()
 	if err != nil {
 		log.Errorf("Couldn't open file", file, err)
 		return nil, err
 	}
+	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
 	var block []string
+	flush := func() {
+		if sig := strings.Join(block, "\n"); strings.TrimSpace(sig) != "" {
+			blocks = append(blocks, sig)
+		}
+		block = make([]string, 0)
+	}
+	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		text := scanner.Text()
 		log.Lvl4("Decoding", text)
-		// end of the first part
-		if text == head {
+		// a header starts the next signature, an Ed25519 signature is a single line
+		switch {
+		case text == pgpSignatureHead || text == sshSignatureHead:
 			log.Lvl4("Found header")
-			if len(block) > 0 {
-				blocks = append(blocks, strings.Join(block, "\n"))
-				block = make([]string, 0)
-			}
+			flush()
+			block = append(block, text)
+		case strings.HasPrefix(text, ed25519SigType+" "):
+			flush()
+			block = append(block, text)
+			flush()
+		default:
+			block = append(block, text)
 		}
-		block = append(block, text)
 	}
-	blocks = append(blocks, strings.Join(block, "\n"))
-	return blocks, nil
+	flush()
+	return blocks, scanner.Err()
 }
 
-// Scanner for a configuration file containing threshold and public keys
+// Scanner for a configuration file containing threshold and public keys, and optionally
+// weighted admins with roles, the approval rules of the roles, the approval scopes and the
+// threshold to revoke an admin key:
+//
+//	threshold = 3
+//	revocationThreshold = 2
+//	publicKeys = [...]
+//
+//	[[admins]]
+//	publicKey = """..."""
+//	weight = 2
+//	roles = ["security"]
+//
+//	[[rules]]
+//	role = "security"
+//	threshold = 2
+//
+//	[[scopes]]
+//	name = "dns"
+//	chain = "OUTPUT"
+//	protocol = "UDP"
+//	dports = "53"
+//	role = "network"
+//	threshold = 1
 func ConfScanner(filename string) (*Conf, error) {
+	type adminToml struct {
+		PublicKey string
+		Weight    int
+		Roles     []string
+	}
 	type confToml struct {
 		Threshold  int
 		PublicKeys []string
+		Admins     []adminToml
+		Rules      []ApprovalRule
+		Scopes     []ApprovalScope
+		RevocationThreshold int
 	}
 	var c confToml
 	//fmt.Printf("ConfScanner@@@@@@@@@@@@\n")
@@ -63,7 +106,10 @@ func ConfScanner(filename string) (*Conf, error) {
 	
 	log.Lvlf4("Fields of the configuration are %+v", meta.Keys())
 	
-	conf := &Conf{Threshold: c.Threshold, PubKeys:c.PublicKeys}
+	conf := &Conf{Threshold: c.Threshold, PubKeys:c.PublicKeys, Rules: c.Rules, Scopes: c.Scopes, RevocationThreshold: c.RevocationThreshold}
+	for _, admin := range c.Admins {
+		conf.Admins = append(conf.Admins, Admin{PubKey: admin.PublicKey, Weight: admin.Weight, Roles: admin.Roles})
+	}
 	//fmt.Printf("ConfScanner conf threshold = %d\n",conf.Threshold)
 	//fmt.Printf("ConfScanner conf pub0 = %s\n",conf.PubKeys[0])
 	return conf, err
@@ -87,6 +133,10 @@ func NetPolicyScanner(filename string) (*Policy, error) {
 	}
 	//fmt.Printf(policy.Rules[0].Match.Dports+"\n")
 	//fmt.Printf(policy.Rules[2].Match.Sports+"\n")
+	//rules reference the address and service groups by name, they must all exist
+	if err = policy.CheckGroups(); err != nil {
+		return nil, err
+	}
 	return &policy, err
 }
 
@@ -108,4 +158,51 @@ func HashScanner(filename string) (skipchain.SkipBlockID, error) {
 		return nil, err
 	}
 	return parentID, nil
-}
\ No newline at end of file
+}
+
+//read the ID of the chain written next to the block ID by WriteHashFile
+func ChainIDScanner(filename string) (skipchain.SkipBlockID, error) {
+	type hashToml struct {
+		ChainID string
+	}
+	var hash hashToml
+
+	log.Lvl3("Reading file", filename)
+	if _, err := toml.DecodeFile(filename, &hash); err != nil {
+		return nil, err
+	}
+	if hash.ChainID == "" {
+		return nil, errors.New(filename + " has no chainID")
+	}
+	return hex.DecodeString(hash.ChainID)
+}
+
+//write the ID of a block and of its chain, for HashScanner and ChainIDScanner
+func WriteHashFile(filename string, blockID, chainID skipchain.SkipBlockID) error {
+	text := fmt.Sprintf("blockID = %q\nchainID = %q\n", hex.EncodeToString(blockID), hex.EncodeToString(chainID))
+	return ioutil.WriteFile(filename, []byte(text), 0660)
+}
+
+//build the policy data admins sign from a policy file and a conf file. A new policy also
+//needs the file with the IDs of its parent block, the genesis policy has none ("")
+func PolicyDataFromFiles(policyFile, configFile, parentHashFile string) (*PolicyData, error) {
+	policy, err := NetPolicyScanner(policyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf, err := ConfScanner(configFile)
+	if err != nil {
+		return nil, err
+	}
+	data := &PolicyData{Policy: policy, Conf: conf, Encoding: EncodingCanonicalV1}
+	if parentHashFile == "" {
+		return data, nil
+	}
+	if data.ParentID, err = HashScanner(parentHashFile); err != nil {
+		return nil, err
+	}
+	if data.ChainID, err = ChainIDScanner(parentHashFile); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,98 @@
+package netmanage
+
+/*
+The revocation.go removes a compromised admin key without waiting for a new
+policy. The admins of the latest block sign a Revocation naming the key, and
+once enough of them did, the service appends a block with the same policy and
+the conf without the key, recording the Revocation.
+
+A revocation is approved by the admins who keep their keys, with the reduced
+RevocationThreshold of the conf and none of its rules or scopes: the admins
+reachable on short notice remove the key, the thresholds of the conf still
+apply to anything else. The signature of the revoked key does not count.
+*/
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dedis/cothority/skipchain"
+)
+
+// Revocation is what the admins sign to remove a key from the conf of the
+// parent block
+type Revocation struct {
+	ChainID  skipchain.SkipBlockID
+	ParentID skipchain.SkipBlockID
+	// KeyID of the revoked key, as in the SignatureReport of its signatures
+	KeyID  string
+	Reason string
+	// chosen by whoever asks for the revocation, tells apart two revocations
+	// of the same key
+	Nonce string
+}
+
+// SigningBytes returns the exact bytes the admins sign to approve the
+// revocation, they only exist in the canonical encoding
+func (r *Revocation) SigningBytes() ([]byte, error) {
+	return canonicalEnvelope("Revocation", r)
+}
+
+// RevocationQuorum returns the total weight of the admins needed to revoke a
+// key, RevocationThreshold or else half of Threshold, rounded up
+func (c *Conf) RevocationQuorum() int {
+	if c.RevocationThreshold > 0 {
+		return c.RevocationThreshold
+	}
+	return (c.Threshold + 1) / 2
+}
+
+// Revoke returns the conf without the keys whose KeyID is keyID, which
+// approves the revocation with the RevocationQuorum. The remaining admins
+// must still be able to reach every threshold of the conf.
+func (c *Conf) Revoke(keyID string) (revoked *Conf, approving *Conf, err error) {
+	n := &Conf{Threshold: c.Threshold, RevocationThreshold: c.RevocationThreshold, Rules: c.Rules, Scopes: c.Scopes}
+	found := false
+	for _, key := range c.PubKeys {
+		if hasKeyID(key, keyID) {
+			found = true
+			continue
+		}
+		n.PubKeys = append(n.PubKeys, key)
+	}
+	for _, admin := range c.Admins {
+		if hasKeyID(admin.PubKey, keyID) {
+			found = true
+			continue
+		}
+		n.Admins = append(n.Admins, admin)
+	}
+	if !found {
+		return nil, nil, fmt.Errorf("the key %s is not one of the admins", keyID)
+	}
+	if err := n.Validate(); err != nil {
+		return nil, nil, errors.New("the conf without the key is invalid: " + err.Error())
+	}
+	all := make([]int, len(n.Members()))
+	for i := range all {
+		all[i] = i
+	}
+	scopes := make([]int, len(n.Scopes))
+	for i := range scopes {
+		scopes[i] = i
+	}
+	if d := n.DecideChange(all, scopes); !d.Approved {
+		return nil, nil, errors.New("the admins without the key could not approve anymore: " + d.Err().Error())
+	}
+	approving = &Conf{Threshold: c.RevocationQuorum(), PubKeys: n.PubKeys}
+	for _, admin := range n.Admins {
+		approving.Admins = append(approving.Admins, Admin{PubKey: admin.PubKey, Weight: admin.Weight})
+	}
+	return n, approving, nil
+}
+
+// hasKeyID tells if pubKey is the key keyID, a key that cannot be read is none
+func hasKeyID(pubKey, keyID string) bool {
+	verifier, err := NewVerifier(pubKey)
+	return err == nil && verifier.KeyID() == keyID
+}
@@ -0,0 +1,71 @@
+package netmanage_test
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/dedis/netmanage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+// the public keys and key IDs of n Ed25519 admins
+func revocationAdmins(t *testing.T, n int) (keys, ids []string) {
+	for i := 0; i < n; i++ {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		require.Nil(t, err)
+		pub, err := netmanage.NewEd25519Signer(key, "").PublicKey()
+		require.Nil(t, err)
+		verifier, err := netmanage.NewVerifier(pub)
+		require.Nil(t, err)
+		keys, ids = append(keys, pub), append(ids, verifier.KeyID())
+	}
+	return keys, ids
+}
+
+func TestConf_RevocationQuorum(t *testing.T) {
+	for threshold, quorum := range map[int]int{1: 1, 2: 1, 3: 2, 4: 2, 5: 3} {
+		assert.Equal(t, quorum, (&netmanage.Conf{Threshold: threshold}).RevocationQuorum())
+	}
+	assert.Equal(t, 3, (&netmanage.Conf{Threshold: 3, RevocationThreshold: 3}).RevocationQuorum())
+}
+
+func TestConf_Revoke(t *testing.T) {
+	keys, ids := revocationAdmins(t, 4)
+	conf := &netmanage.Conf{Threshold: 3, PubKeys: keys[:2], Admins: []netmanage.Admin{
+		{PubKey: keys[2], Weight: 2, Roles: []string{"security"}},
+		{PubKey: keys[3], Roles: []string{"security"}},
+	}, Rules: []netmanage.ApprovalRule{{Role: "security", Threshold: 1}}}
+
+	revoked, approving, err := conf.Revoke(ids[1])
+	require.Nil(t, err)
+	assert.Equal(t, []string{keys[0]}, revoked.PubKeys)
+	assert.Equal(t, conf.Admins, revoked.Admins)
+	assert.Equal(t, conf.Rules, revoked.Rules)
+	// the remaining admins approve with their weights and without the rules
+	assert.Equal(t, 2, approving.Threshold)
+	assert.Equal(t, []string{keys[0]}, approving.PubKeys)
+	assert.Equal(t, []netmanage.Admin{{PubKey: keys[2], Weight: 2}, {PubKey: keys[3]}}, approving.Admins)
+	assert.Nil(t, approving.Rules)
+
+	revoked, _, err = conf.Revoke(ids[2])
+	require.Nil(t, err)
+	assert.Len(t, revoked.Admins, 1)
+
+	_, _, err = conf.Revoke("SHA256:unknown")
+	assert.NotNil(t, err)
+	// the last security admin cannot be revoked, no rule could pass anymore
+	_, _, err = revoked.Revoke(ids[3])
+	assert.NotNil(t, err)
+	// nor the admins the threshold needs
+	_, _, err = (&netmanage.Conf{Threshold: 2, PubKeys: keys[:2]}).Revoke(ids[0])
+	assert.NotNil(t, err)
+}
+
+func TestRevocation_SigningBytes(t *testing.T) {
+	rev := &netmanage.Revocation{ChainID: []byte{1}, ParentID: []byte{3}, KeyID: "SHA256:abc", Reason: "stolen laptop"}
+	buf, err := rev.SigningBytes()
+	require.Nil(t, err)
+	assert.Equal(t, `{"Revocation":{"ChainID":"01","KeyID":"SHA256:abc","ParentID":"03","Reason":"stolen laptop"},"Type":"Revocation","Version":1}`, string(buf))
+}
@@ -0,0 +1,713 @@
+package netmanage
+
+/*
+The rule.go gives a typed view of the free-form strings stored in Policy,
+Rule and Match. The strings are still what gets signed and stored on the
+skipchain, the typed layer is only used to check them and to reason about
+them (rendering, evaluation, ...).
+*/
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Any is the keyword a Match field takes to match everything
+const Any = "ALL"
+
+// Protocol is the layer 4 protocol a rule matches
+type Protocol int
+
+const (
+	ProtocolAll Protocol = iota
+	ProtocolTCP
+	ProtocolUDP
+	ProtocolICMP
+	ProtocolICMPv6
+)
+
+var protocolNames = []string{Any, "TCP", "UDP", "ICMP", "ICMPv6"}
+
+func (p Protocol) String() string {
+	return protocolNames[p]
+}
+
+// HasPorts tells if the protocol can be matched on source/destination ports
+func (p Protocol) HasPorts() bool {
+	return p == ProtocolTCP || p == ProtocolUDP
+}
+
+// ParseProtocol reads a Match.Protocol value, case insensitive
+func ParseProtocol(s string) (Protocol, error) {
+	for i, name := range protocolNames {
+		if strings.EqualFold(s, name) {
+			return Protocol(i), nil
+		}
+	}
+	return ProtocolAll, fmt.Errorf("unknown protocol %q", s)
+}
+
+// Family is the address family a rule applies to
+type Family int
+
+const (
+	FamilyAll Family = iota
+	FamilyIPv4
+	FamilyIPv6
+)
+
+var familyNames = []string{Any, "IPv4", "IPv6"}
+
+func (f Family) String() string {
+	return familyNames[f]
+}
+
+// Includes tells if a rule of family f applies to packets of family o
+func (f Family) Includes(o Family) bool {
+	return f == FamilyAll || f == o
+}
+
+// ParseFamily reads a Match.Family value, case insensitive
+func ParseFamily(s string) (Family, error) {
+	for i, name := range familyNames {
+		if strings.EqualFold(s, name) {
+			return Family(i), nil
+		}
+	}
+	return FamilyAll, fmt.Errorf("unknown address family %q", s)
+}
+
+// IPFamily returns the family of an address
+func IPFamily(ip net.IP) Family {
+	if ip.To4() != nil {
+		return FamilyIPv4
+	}
+	return FamilyIPv6
+}
+
+// Table is the netfilter table a rule goes in
+type Table int
+
+const (
+	TableFilter Table = iota
+	TableNAT
+)
+
+var tableNames = []string{"filter", "nat"}
+
+func (t Table) String() string {
+	return tableNames[t]
+}
+
+// Chains returns the built-in chains of the table, in rendering order
+func (t Table) Chains() []Chain {
+	if t == TableNAT {
+		return []Chain{ChainPrerouting, ChainOutput, ChainPostrouting}
+	}
+	return []Chain{ChainInput, ChainForward, ChainOutput}
+}
+
+// Actions returns the actions a rule of the table can take
+func (t Table) Actions() []Action {
+	if t == TableNAT {
+		return []Action{ActionAccept, ActionSNAT, ActionDNAT, ActionMasquerade, ActionJump, ActionGoto, ActionReturn, ActionLog}
+	}
+	return []Action{ActionAccept, ActionDrop, ActionReject, ActionJump, ActionGoto, ActionReturn, ActionLog}
+}
+
+// ParseTable reads a Match.Table value, case insensitive, empty is the
+// filter table
+func ParseTable(s string) (Table, error) {
+	if s == "" {
+		return TableFilter, nil
+	}
+	for i, name := range tableNames {
+		if strings.EqualFold(s, name) {
+			return Table(i), nil
+		}
+	}
+	return TableFilter, fmt.Errorf("unknown table %q", s)
+}
+
+// Chain is the chain a rule is appended to, one of the built-in chains or
+// a custom chain declared in Policy.Chains
+type Chain string
+
+const (
+	ChainInput       Chain = "INPUT"
+	ChainOutput      Chain = "OUTPUT"
+	ChainForward     Chain = "FORWARD"
+	ChainPrerouting  Chain = "PREROUTING"
+	ChainPostrouting Chain = "POSTROUTING"
+)
+
+var builtinChains = []Chain{ChainInput, ChainOutput, ChainForward, ChainPrerouting, ChainPostrouting}
+
+func (c Chain) String() string {
+	return string(c)
+}
+
+// Builtin tells if c is one of the chains netfilter hooks packets into
+func (c Chain) Builtin() bool {
+	return containsChain(builtinChains, c)
+}
+
+// ParseChain reads the name of a built-in chain, case insensitive. Custom
+// chains are only known to the policy declaring them.
+func ParseChain(s string) (Chain, error) {
+	for _, chain := range builtinChains {
+		if strings.EqualFold(s, string(chain)) {
+			return chain, nil
+		}
+	}
+	return ChainInput, fmt.Errorf("unknown chain %q", s)
+}
+
+// Action is what happens to a packet matched by a rule
+type Action int
+
+const (
+	ActionAccept Action = iota
+	ActionDrop
+	ActionSNAT
+	ActionDNAT
+	ActionMasquerade
+	// ActionJump continues in Rule.Target and comes back after it
+	ActionJump
+	// ActionGoto continues in Rule.Target and does not come back
+	ActionGoto
+	// ActionReturn goes back to the chain that jumped to the current one,
+	// or applies the default policy in a built-in chain
+	ActionReturn
+	// ActionReject drops the packet and replies with Rule.RejectWith
+	ActionReject
+	// ActionLog logs the packet and goes on with the next rule
+	ActionLog
+)
+
+var actionNames = []string{"ACCEPT", "DROP", "SNAT", "DNAT", "MASQUERADE", "JUMP", "GOTO", "RETURN", "REJECT", "LOG"}
+
+func (a Action) String() string {
+	return actionNames[a]
+}
+
+// Flow tells if the action moves between chains rather than deciding what
+// happens to the packet
+func (a Action) Flow() bool {
+	return a == ActionJump || a == ActionGoto || a == ActionReturn
+}
+
+// Decides tells if the action ends the walk of the packet through the
+// chains, LOG and the flow actions let the next rules decide
+func (a Action) Decides() bool {
+	return !a.Flow() && a != ActionLog
+}
+
+// Chains returns the chains of the nat table the address translation can
+// happen in, nil for the actions that are not a translation
+func (a Action) Chains() []Chain {
+	switch a {
+	case ActionSNAT, ActionMasquerade:
+		return []Chain{ChainPostrouting}
+	case ActionDNAT:
+		return []Chain{ChainPrerouting, ChainOutput}
+	}
+	return nil
+}
+
+// ParseAction reads a Rule.Action value, case insensitive
+func ParseAction(s string) (Action, error) {
+	for i, name := range actionNames {
+		if strings.EqualFold(s, name) {
+			return Action(i), nil
+		}
+	}
+	return ActionAccept, fmt.Errorf("unknown action %q", s)
+}
+
+// State is a set of conntrack states, the zero State matches packets in any
+// state
+type State uint8
+
+const (
+	StateNew State = 1 << iota
+	StateEstablished
+	StateRelated
+	StateInvalid
+)
+
+var stateNames = []string{"NEW", "ESTABLISHED", "RELATED", "INVALID"}
+
+// Contains tells if a packet in state o is matched, o being a single state
+func (s State) Contains(o State) bool {
+	return s == 0 || s&o != 0
+}
+
+// Names returns the names of the states of the set, in a fixed order
+func (s State) Names() []string {
+	var names []string
+	for i, name := range stateNames {
+		if s&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (s State) String() string {
+	if s == 0 {
+		return Any
+	}
+	return strings.Join(s.Names(), ",")
+}
+
+// ParseState reads a Match.State value: empty or ALL for any state, or a
+// comma separated list of NEW, ESTABLISHED, RELATED and INVALID
+func ParseState(s string) (State, error) {
+	if s == "" || strings.EqualFold(s, Any) {
+		return 0, nil
+	}
+	var state State
+	for _, item := range strings.Split(s, ",") {
+		found := false
+		for i, name := range stateNames {
+			if strings.EqualFold(strings.TrimSpace(item), name) {
+				state |= 1 << uint(i)
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown connection state %q", item)
+		}
+	}
+	return state, nil
+}
+
+// PortRange is an inclusive range of ports, First == Last for a single port
+type PortRange struct {
+	First uint16
+	Last  uint16
+}
+
+// Contains tells if port is in the range
+func (r PortRange) Contains(port int) bool {
+	return port >= int(r.First) && port <= int(r.Last)
+}
+
+// String returns the range in iptables notation, "443" or "1000:2000"
+func (r PortRange) String() string {
+	if r.First == r.Last {
+		return strconv.Itoa(int(r.First))
+	}
+	return fmt.Sprintf("%d:%d", r.First, r.Last)
+}
+
+// PortList is the parsed form of Match.Sports/Dports, nil matches any port
+type PortList []PortRange
+
+// Contains tells if port is matched by the list
+func (l PortList) Contains(port int) bool {
+	if l == nil {
+		return true
+	}
+	for _, r := range l {
+		if r.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l PortList) String() string {
+	if l == nil {
+		return Any
+	}
+	s := make([]string, len(l))
+	for i, r := range l {
+		s[i] = r.String()
+	}
+	return strings.Join(s, ",")
+}
+
+// ParsePorts reads a Match.Sports/Dports value: ALL, or a comma separated
+// list of ports and first:last ranges, like "22,80,1000:2000"
+func ParsePorts(s string) (PortList, error) {
+	if strings.EqualFold(s, Any) {
+		return nil, nil
+	}
+	if s == "" {
+		return nil, errors.New("empty port list")
+	}
+	var list PortList
+	for _, item := range strings.Split(s, ",") {
+		bounds := strings.SplitN(item, ":", 2)
+		first, err := parsePort(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = parsePort(bounds[1]); err != nil {
+				return nil, err
+			}
+			if last < first {
+				return nil, fmt.Errorf("port range %q is reversed", item)
+			}
+		}
+		list = append(list, PortRange{First: first, Last: last})
+	}
+	return list, nil
+}
+
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port %d out of range", port)
+	}
+	return uint16(port), nil
+}
+
+// AddressList is the parsed form of Match.Src/Dest, nil matches any address
+type AddressList []*net.IPNet
+
+// Contains tells if ip is in one of the prefixes of the list
+func (l AddressList) Contains(ip net.IP) bool {
+	if l == nil {
+		return true
+	}
+	for _, prefix := range l {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l AddressList) String() string {
+	if l == nil {
+		return Any
+	}
+	s := make([]string, len(l))
+	for i, prefix := range l {
+		s[i] = prefix.String()
+	}
+	return strings.Join(s, ",")
+}
+
+// Family returns the family of the addresses of the list, FamilyAll for a
+// nil list. All the prefixes of a parsed list have the same family.
+func (l AddressList) Family() Family {
+	if l == nil {
+		return FamilyAll
+	}
+	return IPFamily(l[0].IP)
+}
+
+// ParseAddresses reads a Match.Src/Dest value: ALL, or a comma separated
+// list of addresses and CIDR prefixes of one family, like
+// "10.0.0.0/8,192.168.1.1" or "2001:db8::/32"
+func ParseAddresses(s string) (AddressList, error) {
+	if strings.EqualFold(s, Any) {
+		return nil, nil
+	}
+	if s == "" {
+		return nil, errors.New("empty address list")
+	}
+	var list AddressList
+	for _, item := range strings.Split(s, ",") {
+		prefix, err := parsePrefix(strings.TrimSpace(item))
+		if err != nil {
+			return nil, err
+		}
+		if list != nil && IPFamily(prefix.IP) != list.Family() {
+			return nil, fmt.Errorf("address %q is not %s like the first one", item, list.Family())
+		}
+		list = append(list, prefix)
+	}
+	return list, nil
+}
+
+func parsePrefix(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		if strings.Contains(s, ":") {
+			s += "/128"
+		} else {
+			s += "/32"
+		}
+	}
+	ip, prefix, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	if !ip.Equal(prefix.IP) {
+		return nil, fmt.Errorf("address %q has host bits set", s)
+	}
+	return prefix, nil
+}
+
+// String gives a one line description of the rule, as written in the policy
+func (r *Rule) String() string {
+	m := r.Match
+	if m == nil {
+		return fmt.Sprintf("(no match) -> %s", r.Action)
+	}
+	family := ""
+	if m.Family != "" {
+		family = m.Family + " "
+	}
+	if m.InIface != "" {
+		family += "in=" + m.InIface + " "
+	}
+	if m.OutIface != "" {
+		family += "out=" + m.OutIface + " "
+	}
+	state := ""
+	if m.State != "" {
+		state = " state=" + m.State
+	}
+	chain := m.Chain
+	if m.Table != "" {
+		chain = m.Table + " " + m.Chain
+	}
+	target := r.Action
+	if r.Target != "" {
+		target += " " + r.Target
+	}
+	if r.ToAddress != "" {
+		target += " to=" + r.ToAddress
+	}
+	if r.ToPorts != "" {
+		target += " toports=" + r.ToPorts
+	}
+	if r.RejectWith != "" {
+		target += " with=" + r.RejectWith
+	}
+	if r.LogPrefix != "" {
+		target += fmt.Sprintf(" prefix=%q", r.LogPrefix)
+	}
+	if r.LogLevel != "" {
+		target += " level=" + r.LogLevel
+	}
+	if r.NotBefore != "" {
+		target += " from=" + r.NotBefore
+	}
+	if r.NotAfter != "" {
+		target += " until=" + r.NotAfter
+	}
+	if m.Limit != "" {
+		state += " limit=" + m.Limit
+		if m.LimitBurst != 0 {
+			state += fmt.Sprintf(" burst=%d", m.LimitBurst)
+		}
+		if m.LimitPerSource {
+			state += " per-source"
+		}
+	}
+	if m.Service != "" {
+		return fmt.Sprintf("%s %sservice=%s src=%s sports=%s dest=%s%s -> %s",
+			chain, family, m.Service, m.Src, m.Sports, m.Dest, state, target)
+	}
+	return fmt.Sprintf("%s %s%s src=%s sports=%s dest=%s dports=%s%s -> %s",
+		chain, family, m.Protocol, m.Src, m.Sports, m.Dest, m.Dports, state, target)
+}
+
+// TypedMatch is the parsed form of a Match
+type TypedMatch struct {
+	Table Table
+	Chain Chain
+	// Family is the one of the addresses, or of ICMP/ICMPv6, when the rule
+	// is for both families but can only match one
+	Family Family
+	// InIface and OutIface are "" for any interface
+	InIface  string
+	OutIface string
+	Protocol Protocol
+	Src      AddressList
+	Sports   PortList
+	Dest     AddressList
+	Dports   PortList
+	State    State
+	// Limit is nil when the rule has no rate limit
+	Limit *RateLimit
+}
+
+// TypedRule is the parsed form of a Rule. ToAddress is nil and ToPorts is
+// nil when the action does not change them, Target is only set for JUMP and
+// GOTO, the LogPrefix and LogLevel for LOG. NotBefore and NotAfter are zero
+// when the rule is not bounded in time.
+type TypedRule struct {
+	Match      TypedMatch
+	Action     Action
+	Target     Chain
+	ToAddress  net.IP
+	ToPorts    PortList
+	RejectWith RejectType
+	LogPrefix  string
+	LogLevel   LogLevel
+	NotBefore  time.Time
+	NotAfter   time.Time
+}
+
+// RuleError is one problem found in a policy. Index is the position of the
+// rule in Policy.Rules, or -1 if the problem is about the policy itself.
+type RuleError struct {
+	Index int
+	Field string
+	Err   error
+}
+
+func (e *RuleError) Error() string {
+	if e.Index < 0 {
+		return fmt.Sprintf("policy: %s: %s", e.Field, e.Err)
+	}
+	return fmt.Sprintf("rule %d: %s: %s", e.Index, e.Field, e.Err)
+}
+
+// ValidationError holds every problem found by Policy.Validate
+type ValidationError []*RuleError
+
+func (v ValidationError) Error() string {
+	s := make([]string, len(v))
+	for i, e := range v {
+		s[i] = e.Error()
+	}
+	return strings.Join(s, "; ")
+}
+
+// Validate checks every rule of the policy and returns a ValidationError
+// listing all the problems, or nil if the policy is well formed
+func (p *Policy) Validate() error {
+	_, errs := p.typedRules()
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// TypedRules returns the parsed rules of the policy, or a ValidationError
+func (p *Policy) TypedRules() ([]*TypedRule, error) {
+	rules, errs := p.typedRules()
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return rules, nil
+}
+
+func (p *Policy) typedRules() ([]*TypedRule, ValidationError) {
+	rules, _, errs := p.typedPolicy()
+	return rules, errs
+}
+
+// typedPolicy parses the chains and the rules of the policy
+func (p *Policy) typedPolicy() ([]*TypedRule, *chainSet, ValidationError) {
+	var errs ValidationError
+	if p.Num != len(p.Rules) {
+		errs = append(errs, &RuleError{-1, "Num", fmt.Errorf("policy announces %d rules but has %d", p.Num, len(p.Rules))})
+	}
+	chains, chainErrs := p.chains()
+	errs = append(errs, chainErrs...)
+	groups, groupErrs := p.groups()
+	errs = append(errs, groupErrs...)
+	rules := make([]*TypedRule, len(p.Rules))
+	for i := range p.Rules {
+		rule, ruleErrs := p.Rules[i].typed(i, chains, groups)
+		rules[i] = rule
+		errs = append(errs, ruleErrs...)
+	}
+	errs = append(errs, checkLoops(rules)...)
+	return rules, chains, errs
+}
+
+// typed resolves the chains and groups the rule references and parses every
+// field of the rule, collecting all the errors
+func (r *Rule) typed(index int, chains *chainSet, groups *groupSet) (*TypedRule, ValidationError) {
+	var errs ValidationError
+	fail := func(field string, err error) {
+		errs = append(errs, &RuleError{index, field, err})
+	}
+	rule := &TypedRule{}
+	var err error
+	if rule.Action, err = ParseAction(r.Action); err != nil {
+		fail("Action", err)
+	}
+	m := r.Match
+	if m == nil {
+		fail("Match", errors.New("rule has no match"))
+		return rule, errs
+	}
+	m, groupErrs := groups.resolve(index, m)
+	errs = append(errs, groupErrs...)
+	if rule.Match.Table, err = ParseTable(m.Table); err != nil {
+		fail("Table", err)
+	} else if rule.Match.Chain, err = chains.resolve(rule.Match.Table, m.Chain); err != nil {
+		fail("Chain", err)
+	}
+	if rule.Match.Protocol, err = ParseProtocol(m.Protocol); err != nil {
+		fail("Protocol", err)
+	}
+	if rule.Match.Src, err = ParseAddresses(m.Src); err != nil {
+		fail("Src", err)
+	}
+	if rule.Match.Dest, err = ParseAddresses(m.Dest); err != nil {
+		fail("Dest", err)
+	}
+	if rule.Match.Sports, err = ParsePorts(m.Sports); err != nil {
+		fail("Sports", err)
+	}
+	if rule.Match.Dports, err = ParsePorts(m.Dports); err != nil {
+		fail("Dports", err)
+	}
+	if rule.Match.State, err = ParseState(m.State); err != nil {
+		fail("State", err)
+	}
+	rule.Match.Family = FamilyAll
+	switch {
+	case m.Family != "":
+		if rule.Match.Family, err = ParseFamily(m.Family); err != nil {
+			fail("Family", err)
+		}
+	case rule.Match.Protocol == ProtocolICMP:
+		rule.Match.Family = FamilyIPv4
+	case rule.Match.Protocol == ProtocolICMPv6:
+		rule.Match.Family = FamilyIPv6
+	}
+	for _, addresses := range []AddressList{rule.Match.Src, rule.Match.Dest} {
+		if addresses == nil {
+			continue
+		}
+		// addresses narrow a rule of both families down to theirs
+		if rule.Match.Family == FamilyAll {
+			rule.Match.Family = addresses.Family()
+		}
+		if !rule.Match.Family.Includes(addresses.Family()) {
+			fail("Family", fmt.Errorf("%s addresses in a %s rule", addresses.Family(), rule.Match.Family))
+			break
+		}
+	}
+	m.typedIfaces(rule, fail)
+	r.typedTarget(rule, chains, fail)
+	r.typedExtensions(rule, fail)
+	r.typedTimes(rule, fail)
+	switch {
+	case rule.Match.Protocol == ProtocolICMP && rule.Match.Family != FamilyIPv4:
+		fail("Protocol", fmt.Errorf("ICMP needs an IPv4 rule, not %s", rule.Match.Family))
+	case rule.Match.Protocol == ProtocolICMPv6 && rule.Match.Family != FamilyIPv6:
+		fail("Protocol", fmt.Errorf("ICMPv6 needs an IPv6 rule, not %s", rule.Match.Family))
+	}
+	if !rule.Match.Protocol.HasPorts() {
+		if rule.Match.Sports != nil {
+			fail("Sports", fmt.Errorf("ports need TCP or UDP, not %s", rule.Match.Protocol))
+		}
+		if rule.Match.Dports != nil {
+			fail("Dports", fmt.Errorf("ports need TCP or UDP, not %s", rule.Match.Protocol))
+		}
+	}
+	return rule, errs
+}
@@ -0,0 +1,128 @@
+package netmanage_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/dedis/netmanage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy_Validate(t *testing.T) {
+	for _, file := range []string{"netPolicy1.json", "netPolicy2.json"} {
+		policy, err := netmanage.NetPolicyScanner(file)
+		require.Nil(t, err)
+		assert.Nil(t, policy.Validate(), file)
+	}
+
+	policy := &netmanage.Policy{Description: "typos", Num: 3, Rules: []netmanage.Rule{
+		{Match: &netmanage.Match{Chain: "INPUT", Protocol: "TPC", Src: "ALL", Sports: "ALL", Dest: "ALL", Dports: "99999"}, Action: "DROP"},
+		{Match: &netmanage.Match{Chain: "OUTPUT", Protocol: "ICMP", Src: "10.0.0.0/8", Sports: "ALL", Dest: "10.0.0.1/8", Dports: "ALL"}, Action: "ACCEPT"},
+		{Match: &netmanage.Match{Chain: "FORWARD", Protocol: "UDP", Src: "ALL", Sports: "2000:1000", Dest: "ALL", Dports: "53"}, Action: "REJECTED"},
+	}}
+	err := policy.Validate()
+	require.NotNil(t, err)
+	verrs, ok := err.(netmanage.ValidationError)
+	require.True(t, ok)
+	got := make(map[int][]string)
+	for _, e := range verrs {
+		got[e.Index] = append(got[e.Index], e.Field)
+	}
+	assert.Equal(t, map[int][]string{
+		0: {"Protocol", "Dports"},
+		1: {"Dest"},
+		2: {"Action", "Sports"},
+	}, got)
+
+	policy.Num = 4
+	policy.Rules = policy.Rules[:1]
+	verrs = policy.Validate().(netmanage.ValidationError)
+	assert.Equal(t, -1, verrs[0].Index)
+}
+
+func TestPolicy_ValidateFamily(t *testing.T) {
+	match := func(family, protocol, src, dest string) netmanage.Rule {
+		return netmanage.Rule{Match: &netmanage.Match{Chain: "INPUT", Family: family, Protocol: protocol, Src: src,
+			Sports: "ALL", Dest: dest, Dports: "ALL"}, Action: "ACCEPT"}
+	}
+	good := []netmanage.Rule{
+		match("", "ALL", "2001:db8::/32", "fd00::1"),
+		match("IPv6", "ICMPv6", "ALL", "ALL"),
+		match("", "ICMP", "ALL", "ALL"),
+		match("ALL", "TCP", "10.0.0.1", "ALL"),
+	}
+	policy := &netmanage.Policy{Num: len(good), Rules: good}
+	assert.Nil(t, policy.Validate())
+
+	bad := []netmanage.Rule{
+		match("", "ALL", "10.0.0.0/8", "2001:db8::1"),
+		match("IPv4", "ALL", "2001:db8::/32", "ALL"),
+		match("", "ALL", "10.0.0.0/8,2001:db8::/32", "ALL"),
+		match("IPv6", "ICMP", "ALL", "ALL"),
+		match("", "ICMPv6", "10.0.0.1", "ALL"),
+		match("IPv5", "ALL", "ALL", "ALL"),
+	}
+	policy = &netmanage.Policy{Num: len(bad), Rules: bad}
+	verrs := policy.Validate().(netmanage.ValidationError)
+	var fields []string
+	for _, e := range verrs {
+		fields = append(fields, fmt.Sprintf("%d %s", e.Index, e.Field))
+	}
+	assert.Equal(t, []string{"0 Family", "1 Family", "2 Src", "3 Protocol", "4 Family", "5 Family"}, fields)
+}
+
+func TestParsePorts(t *testing.T) {
+	ports, err := netmanage.ParsePorts("22,80,1000:2000")
+	require.Nil(t, err)
+	assert.Equal(t, "22,80,1000:2000", ports.String())
+	assert.True(t, ports.Contains(1500))
+	assert.False(t, ports.Contains(443))
+
+	ports, err = netmanage.ParsePorts("ALL")
+	require.Nil(t, err)
+	assert.True(t, ports.Contains(443))
+
+	for _, bad := range []string{"", "0", "65536", "http", "80,", "3:2"} {
+		_, err = netmanage.ParsePorts(bad)
+		assert.NotNil(t, err, bad)
+	}
+}
+
+func TestPolicy_ValidateNAT(t *testing.T) {
+	assert.Nil(t, testPolicy(t, "nat").Validate())
+
+	nat := func(chain, protocol, action, to, toPorts string) netmanage.Rule {
+		return netmanage.Rule{Match: &netmanage.Match{Table: "nat", Chain: chain, Protocol: protocol, Src: "ALL",
+			Sports: "ALL", Dest: "10.0.0.0/8", Dports: "ALL"}, Action: action, ToAddress: to, ToPorts: toPorts}
+	}
+	bad := []netmanage.Rule{
+		nat("INPUT", "ALL", "ACCEPT", "", ""),
+		nat("PREROUTING", "ALL", "DROP", "", ""),
+		nat("POSTROUTING", "ALL", "DNAT", "10.0.0.1", ""),
+		nat("PREROUTING", "TCP", "DNAT", "", ""),
+		nat("PREROUTING", "TCP", "DNAT", "2001:db8::1", ""),
+		nat("POSTROUTING", "ALL", "MASQUERADE", "10.0.0.1", "1024:2048"),
+		nat("PREROUTING", "TCP", "DNAT", "10.0.0.1", "80,443"),
+		{Match: &netmanage.Match{Chain: "INPUT", Protocol: "ALL", Src: "ALL", Sports: "ALL", Dest: "ALL", Dports: "ALL"},
+			Action: "SNAT", ToAddress: "10.0.0.1"},
+		{Match: &netmanage.Match{Table: "mangle", Chain: "INPUT", Protocol: "ALL", Src: "ALL", Sports: "ALL", Dest: "ALL",
+			Dports: "ALL"}, Action: "ACCEPT"},
+	}
+	policy := &netmanage.Policy{Num: len(bad), Rules: bad}
+	got := make(map[int][]string)
+	for _, e := range policy.Validate().(netmanage.ValidationError) {
+		got[e.Index] = append(got[e.Index], e.Field)
+	}
+	assert.Equal(t, map[int][]string{
+		0: {"Chain"},
+		1: {"Action"},
+		2: {"Chain"},
+		3: {"ToAddress"},
+		4: {"ToAddress"},
+		5: {"ToAddress", "ToPorts"},
+		6: {"ToPorts"},
+		7: {"Action"},
+		8: {"Table"},
+	}, got)
+}
@@ -0,0 +1,115 @@
+package netmanage
+
+/*
+The schedule.go handles the time a rule is in effect, between its NotBefore
+and NotAfter, and the expiry of a whole policy. Routers apply the rules in
+effect at the time they fetch the policy, so temporary access goes away with
+the next fetch after it ends.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// parseTime reads an RFC3339 time of a rule or a policy, empty is the zero
+// time which stands for no bound
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("time %q is not RFC3339, like 2018-01-08T10:00:00Z", s)
+	}
+	return t, nil
+}
+
+// typedTimes parses NotBefore and NotAfter and checks the rule is in effect
+// for some time
+func (r *Rule) typedTimes(rule *TypedRule, fail func(string, error)) {
+	var err error
+	if rule.NotBefore, err = parseTime(r.NotBefore); err != nil {
+		fail("NotBefore", err)
+	}
+	if rule.NotAfter, err = parseTime(r.NotAfter); err != nil {
+		fail("NotAfter", err)
+	}
+	if !rule.NotBefore.IsZero() && !rule.NotAfter.IsZero() && !rule.NotAfter.After(rule.NotBefore) {
+		fail("NotAfter", errors.New("the rule ends before it starts"))
+	}
+}
+
+// ActiveAt tells if the rule is in effect at t, NotAfter being the first
+// time it is not anymore
+func (r *TypedRule) ActiveAt(t time.Time) bool {
+	return (r.NotBefore.IsZero() || !t.Before(r.NotBefore)) && (r.NotAfter.IsZero() || t.Before(r.NotAfter))
+}
+
+// activeCovers tells if r is in effect whenever o is
+func (r *TypedRule) activeCovers(o *TypedRule) bool {
+	return (r.NotBefore.IsZero() || !o.NotBefore.IsZero() && !o.NotBefore.Before(r.NotBefore)) &&
+		(r.NotAfter.IsZero() || !o.NotAfter.IsZero() && !o.NotAfter.After(r.NotAfter))
+}
+
+// activeOverlaps tells if r and o are in effect together at some time
+func (r *TypedRule) activeOverlaps(o *TypedRule) bool {
+	return (r.NotAfter.IsZero() || o.NotBefore.IsZero() || o.NotBefore.Before(r.NotAfter)) &&
+		(o.NotAfter.IsZero() || r.NotBefore.IsZero() || r.NotBefore.Before(o.NotAfter))
+}
+
+// ActiveAt returns a copy of the policy holding only the rules in effect at
+// t, or a ValidationError
+func (p *Policy) ActiveAt(t time.Time) (*Policy, error) {
+	rules, err := p.TypedRules()
+	if err != nil {
+		return nil, err
+	}
+	active := *p
+	active.Rules = nil
+	for i, rule := range rules {
+		if rule.ActiveAt(t) {
+			active.Rules = append(active.Rules, p.Rules[i])
+		}
+	}
+	active.Num = len(active.Rules)
+	return &active, nil
+}
+
+// ExpiringRules returns the rules in effect at from that end before until,
+// the first ending first
+func (p *Policy) ExpiringRules(from, until time.Time) ([]ExpiringRule, error) {
+	rules, err := p.TypedRules()
+	if err != nil {
+		return nil, err
+	}
+	var expiring []ExpiringRule
+	for i, rule := range rules {
+		if rule.ActiveAt(from) && !rule.NotAfter.IsZero() && !rule.NotAfter.After(until) {
+			expiring = append(expiring, ExpiringRule{Index: i, Rule: p.Rules[i], NotAfter: p.Rules[i].NotAfter})
+		}
+	}
+	sort.SliceStable(expiring, func(i, j int) bool {
+		return rules[expiring[i].Index].NotAfter.Before(rules[expiring[j].Index].NotAfter)
+	})
+	return expiring, nil
+}
+
+// ExpiryTime returns the parsed Expiry of the policy data, the zero time if
+// it never expires
+func (d *PolicyData) ExpiryTime() (time.Time, error) {
+	t, err := parseTime(d.Expiry)
+	if err != nil {
+		return t, fmt.Errorf("expiry: %s", err)
+	}
+	return t, nil
+}
+
+// ExpiredAt tells if the policy must not be applied anymore at t. An Expiry
+// that does not parse counts as expired.
+func (d *PolicyData) ExpiredAt(t time.Time) bool {
+	expiry, err := d.ExpiryTime()
+	return err != nil || !expiry.IsZero() && !t.Before(expiry)
+}
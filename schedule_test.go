@@ -0,0 +1,92 @@
+package netmanage_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dedis/netmanage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy_ValidateTimes(t *testing.T) {
+	assert.Nil(t, testPolicy(t, "schedule").Validate())
+
+	policy := testPolicy(t, "schedule")
+	policy.Rules[1].NotBefore = "2018-01-08"
+	policy.Rules[2].NotBefore = "2018-01-09T10:00:00Z"
+	verrs := policy.Validate().(netmanage.ValidationError)
+	require.Len(t, verrs, 2)
+	assert.Equal(t, 1, verrs[0].Index)
+	assert.Equal(t, "NotBefore", verrs[0].Field)
+	assert.Equal(t, 2, verrs[1].Index)
+	assert.Equal(t, "NotAfter", verrs[1].Field)
+}
+
+func TestPolicy_ActiveAt(t *testing.T) {
+	for _, c := range []struct {
+		at    string
+		rules []int
+	}{
+		{"2018-01-01T00:00:00Z", []int{1, 2}},
+		{"2018-01-08T10:00:00Z", []int{0, 1, 2}},
+		// rule 2 ends at 09:00 UTC
+		{"2018-01-09T09:00:00Z", []int{0, 1}},
+		{"2018-01-10T10:00:00Z", []int{1}},
+	} {
+		at, err := time.Parse(time.RFC3339, c.at)
+		require.Nil(t, err)
+		active, err := testPolicy(t, "schedule").ActiveAt(at)
+		require.Nil(t, err)
+		assert.Nil(t, active.Validate(), c.at)
+		var expected []netmanage.Rule
+		for _, i := range c.rules {
+			expected = append(expected, testPolicy(t, "schedule").Rules[i])
+		}
+		assert.Equal(t, expected, active.Rules, c.at)
+	}
+}
+
+func TestPolicy_ExpiringRules(t *testing.T) {
+	from := time.Date(2018, 1, 8, 12, 0, 0, 0, time.UTC)
+	expiring, err := testPolicy(t, "schedule").ExpiringRules(from, from.Add(48*time.Hour))
+	require.Nil(t, err)
+	require.Len(t, expiring, 2)
+	assert.Equal(t, 2, expiring[0].Index)
+	assert.Equal(t, 0, expiring[1].Index)
+	assert.Equal(t, "2018-01-10T10:00:00Z", expiring[1].NotAfter)
+
+	expiring, err = testPolicy(t, "schedule").ExpiringRules(from, from.Add(time.Hour))
+	require.Nil(t, err)
+	assert.Empty(t, expiring)
+}
+
+func TestPolicyData_ExpiredAt(t *testing.T) {
+	data := &netmanage.PolicyData{Policy: testPolicy(t, "schedule")}
+	now := time.Now()
+	assert.False(t, data.ExpiredAt(now))
+	data.Expiry = now.Add(time.Hour).Format(time.RFC3339)
+	assert.False(t, data.ExpiredAt(now))
+	assert.True(t, data.ExpiredAt(now.Add(2*time.Hour)))
+	data.Expiry = "tomorrow"
+	assert.True(t, data.ExpiredAt(now))
+}
+
+func TestAnalyze_Times(t *testing.T) {
+	// a temporary DROP does not shadow the rules after it, it only
+	// contradicts them while it is in effect
+	policy := &netmanage.Policy{Num: 2, Rules: []netmanage.Rule{
+		rule("INPUT", "ALL", "ALL", "ALL", "DROP"),
+		rule("INPUT", "TCP", "10.0.0.0/8", "22", "ACCEPT"),
+	}}
+	policy.Rules[0].NotAfter = "2018-01-10T10:00:00Z"
+	findings, err := netmanage.Analyze(policy)
+	require.Nil(t, err)
+	require.Len(t, findings, 1)
+	assert.Equal(t, netmanage.FindingContradiction, findings[0].Kind)
+
+	policy.Rules[1].NotBefore = "2018-01-10T10:00:00Z"
+	findings, err = netmanage.Analyze(policy)
+	require.Nil(t, err)
+	assert.Empty(t, findings)
+}
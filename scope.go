@@ -0,0 +1,268 @@
+package netmanage
+
+/*
+The scope.go works out which approval scopes of a Conf a new policy touches.
+The rules of a built-in chain are taken along with the rules of the custom
+chains it jumps or goes to, in the order a packet goes through them, and a
+scope on a custom chain takes the rules of that chain. A rule
+added, removed, modified or moved, or a rule whose group changed, touches a
+scope when it acts on some of the traffic of the scope, in the old or in the
+new policy, and may change its verdict:
+
+  - it gives the verdict of the scope, or the scope is for any action
+  - it is a JUMP, GOTO or RETURN, sending the traffic to other rules
+  - it gives another verdict ahead of a rule giving the one of the scope, or
+    in a chain whose default policy is the one of the scope, like a DROP
+    removed in front of an ACCEPT
+
+A scope is also touched when the default policy of its chain changes, since
+a default policy applies to all the traffic of the chain.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// typedScope is the parsed form of an ApprovalScope, anyTable, a "" chain
+// and anyAction match everything
+type typedScope struct {
+	anyTable  bool
+	anyAction bool
+	match     TypedMatch
+	action    Action
+}
+
+func (s *ApprovalScope) typed() (*typedScope, error) {
+	t := &typedScope{anyTable: isAny(s.Table), anyAction: isAny(s.Action)}
+	var err error
+	if !t.anyTable {
+		if t.match.Table, err = ParseTable(s.Table); err != nil {
+			return nil, err
+		}
+	}
+	if !isAny(s.Chain) {
+		t.match.Chain = Chain(s.Chain)
+		if chain, err := ParseChain(s.Chain); err == nil {
+			t.match.Chain = chain
+		}
+	}
+	if !t.anyAction {
+		if t.action, err = ParseAction(s.Action); err != nil {
+			return nil, err
+		}
+	}
+	if !isAny(s.Protocol) {
+		if t.match.Protocol, err = ParseProtocol(s.Protocol); err != nil {
+			return nil, err
+		}
+	}
+	if !isAny(s.Src) {
+		if t.match.Src, err = ParseAddresses(s.Src); err != nil {
+			return nil, fmt.Errorf("src: %s", err)
+		}
+	}
+	if !isAny(s.Dest) {
+		if t.match.Dest, err = ParseAddresses(s.Dest); err != nil {
+			return nil, fmt.Errorf("dest: %s", err)
+		}
+	}
+	if !isAny(s.Dports) {
+		if t.match.Dports, err = ParsePorts(s.Dports); err != nil {
+			return nil, fmt.Errorf("dports: %s", err)
+		}
+	}
+	return t, nil
+}
+
+func isAny(s string) bool {
+	return s == "" || strings.EqualFold(s, Any)
+}
+
+// matchesChain tells if the scope covers a chain of a table
+func (t *typedScope) matchesChain(table Table, chain Chain) bool {
+	return (t.anyTable || t.match.Table == table) && (t.match.Chain == "" || t.match.Chain == chain)
+}
+
+// overlaps tells if the rule matches some of the traffic of the scope
+func (t *typedScope) overlaps(r *TypedRule) bool {
+	m := t.match
+	m.Family = r.Match.Family
+	m.InIface, m.OutIface, m.State = r.Match.InIface, r.Match.OutIface, r.Match.State
+	return m.overlaps(&r.Match)
+}
+
+// validateScopes checks the scopes parse, have a unique name and approvers
+// holding their role
+func (c *Conf) validateScopes(roles map[string]bool) error {
+	names := make(map[string]bool)
+	for _, scope := range c.Scopes {
+		if scope.Name == "" {
+			return errors.New("an approval scope has no name")
+		}
+		if names[scope.Name] {
+			return fmt.Errorf("approval scope %q is declared twice", scope.Name)
+		}
+		names[scope.Name] = true
+		if _, err := scope.typed(); err != nil {
+			return fmt.Errorf("approval scope %q: %s", scope.Name, err)
+		}
+		if !roles[scope.Role] {
+			return fmt.Errorf("no admin holds the role %q of approval scope %q", scope.Role, scope.Name)
+		}
+		if scope.Threshold < 1 {
+			return fmt.Errorf("approval scope %q needs a threshold of at least 1", scope.Name)
+		}
+	}
+	return nil
+}
+
+// ValidateChains checks the chain of every scope is a built-in chain or a
+// custom chain the policy declares, in the table of the scope. The scopes of
+// a conf are checked against the policy they come with, since a scope on a
+// chain the policy does not have would never be touched.
+func (c *Conf) ValidateChains(policy *Policy) error {
+	chains, _ := policy.chains()
+	for _, scope := range c.Scopes {
+		t, err := scope.typed()
+		if err != nil {
+			return fmt.Errorf("approval scope %q: %s", scope.Name, err)
+		}
+		if t.match.Chain != "" && !t.hasChain(chains) {
+			return fmt.Errorf("approval scope %q: the policy has no chain %q", scope.Name, scope.Chain)
+		}
+	}
+	return nil
+}
+
+// hasChain tells if the chain of the scope is built-in or declared in the
+// table of the scope, in any table for a scope on any table
+func (t *typedScope) hasChain(chains *chainSet) bool {
+	for _, table := range []Table{TableFilter, TableNAT} {
+		if !t.anyTable && t.match.Table != table {
+			continue
+		}
+		if containsChain(table.Chains(), t.match.Chain) || chains.custom[chainKey{table, t.match.Chain}] {
+			return true
+		}
+	}
+	return false
+}
+
+// TouchedScopes returns the indexes in Scopes of the scopes the change from
+// oldPolicy to newPolicy touches
+func (c *Conf) TouchedScopes(oldPolicy, newPolicy *Policy) ([]int, error) {
+	if len(c.Scopes) == 0 {
+		return nil, nil
+	}
+	oldEval, err := NewEvaluator(oldPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("old policy: %s", err)
+	}
+	newEval, err := NewEvaluator(newPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("new policy: %s", err)
+	}
+
+	d := DiffPolicies(oldPolicy, newPolicy)
+	oldChanged, newChanged := make(map[int]bool), make(map[int]bool)
+	for _, changes := range [][]*RuleChange{d.Added, d.Removed, d.Modified, d.Reordered} {
+		for _, change := range changes {
+			if change.OldIndex >= 0 {
+				oldChanged[change.OldIndex] = true
+			}
+			if change.NewIndex >= 0 {
+				newChanged[change.NewIndex] = true
+			}
+		}
+	}
+	for _, group := range d.Groups {
+		changed := newChanged
+		if group.Kind == RuleRemoved {
+			changed = oldChanged
+		}
+		for _, i := range group.Rules {
+			changed[i] = true
+		}
+	}
+
+	var touched []int
+	for i, scope := range c.Scopes {
+		t, err := scope.typed()
+		if err != nil {
+			return nil, fmt.Errorf("approval scope %q: %s", scope.Name, err)
+		}
+		if t.touchedIn(oldEval, oldChanged) || t.touchedIn(newEval, newChanged) || t.touchedByChains(d.Chains) {
+			touched = append(touched, i)
+		}
+	}
+	return touched, nil
+}
+
+// touchedIn tells if one of the changed rules of the policy of e may change
+// the verdict of the traffic of the scope
+func (t *typedScope) touchedIn(e *Evaluator, changed map[int]bool) bool {
+	if len(changed) == 0 {
+		return false
+	}
+	for _, table := range []Table{TableFilter, TableNAT} {
+		chains := table.Chains()
+		// a scope on a custom chain covers the rules of that chain, under
+		// its own name
+		if t.match.Chain != "" && e.chains.custom[chainKey{table, t.match.Chain}] {
+			chains = []Chain{t.match.Chain}
+		}
+		for _, chain := range chains {
+			if !t.matchesChain(table, chain) {
+				continue
+			}
+			order := e.flatten(table, chain)
+			for k, i := range order {
+				if changed[i] && t.overlaps(e.rules[i]) && t.affects(e, table, chain, e.rules[i], order[k+1:]) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// affects tells if the rule, followed by the rules after, may change the
+// verdict of the traffic of the scope in the chain
+func (t *typedScope) affects(e *Evaluator, table Table, chain Chain, r *TypedRule, after []int) bool {
+	switch {
+	case t.anyAction || r.Action == t.action:
+		return true
+	case r.Action == ActionLog:
+		return false
+	case r.Action == ActionJump || r.Action == ActionGoto || r.Action == ActionReturn:
+		return true
+	case e.chains.custom[chainKey{table, chain}]:
+		// the traffic left over by a custom chain goes back to the chains
+		// calling it, where any verdict may follow
+		return true
+	}
+	if e.chains.policy(table, chain) == t.action {
+		return true
+	}
+	for _, i := range after {
+		if e.rules[i].Action == t.action && t.overlaps(e.rules[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *typedScope) touchedByChains(chains []*ChainChange) bool {
+	for _, change := range chains {
+		table, _ := ParseTable(change.Table)
+		if !t.matchesChain(table, Chain(change.Name)) {
+			continue
+		}
+		if t.anyAction || change.OldPolicy == t.action.String() || change.NewPolicy == t.action.String() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+package netmanage_test
+
+import (
+	"testing"
+
+	"github.com/dedis/netmanage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConf_TouchedScopes(t *testing.T) {
+	current, err := netmanage.NetPolicyScanner("netPolicy1.json")
+	require.Nil(t, err)
+
+	for _, c := range []struct {
+		name    string
+		change  func(*netmanage.Policy)
+		touched []int
+	}{
+		{"unchanged", func(p *netmanage.Policy) {}, nil},
+		{"dns", func(p *netmanage.Policy) {
+			p.Rules = append([]netmanage.Rule{rule("OUTPUT", "UDP", "ALL", "53", "ACCEPT")}, p.Rules...)
+		}, []int{0}},
+		{"other output port", func(p *netmanage.Policy) {
+			p.Rules = append([]netmanage.Rule{rule("OUTPUT", "UDP", "ALL", "123", "ACCEPT")}, p.Rules...)
+		}, nil},
+		// narrowing or removing a DROP in front of an ACCEPT opens ports
+		{"input drop", func(p *netmanage.Policy) {
+			p.Rules[0].Match.Dports = "443"
+		}, []int{1}},
+		{"input drop removed", func(p *netmanage.Policy) {
+			p.Rules = p.Rules[1:]
+		}, []int{1}},
+		{"input log", func(p *netmanage.Policy) {
+			p.Rules = append([]netmanage.Rule{rule("INPUT", "TCP", "ALL", "22", "LOG")}, p.Rules...)
+		}, nil},
+		{"output drop", func(p *netmanage.Policy) {
+			p.Rules = append([]netmanage.Rule{rule("OUTPUT", "TCP", "ALL", "443", "DROP")}, p.Rules...)
+		}, nil},
+		// the ACCEPT of a custom chain INPUT jumps to is an INPUT ACCEPT
+		{"input jump", func(p *netmanage.Policy) {
+			p.Chains = []netmanage.ChainDef{{Name: "ssh-in"}}
+			jump := rule("INPUT", "TCP", "ALL", "22", "JUMP")
+			jump.Target = "ssh-in"
+			p.Rules = append([]netmanage.Rule{jump, rule("ssh-in", "TCP", "ALL", "22", "ACCEPT")}, p.Rules...)
+		}, []int{1}},
+		{"input accept", func(p *netmanage.Policy) {
+			p.Rules = append(p.Rules, rule("INPUT", "TCP", "10.0.0.0/8", "22", "ACCEPT"))
+		}, []int{1}},
+		{"input removed", func(p *netmanage.Policy) {
+			p.Rules = append(p.Rules[:1], p.Rules[2:]...)
+		}, []int{1}},
+		{"output default", func(p *netmanage.Policy) {
+			p.Chains = []netmanage.ChainDef{{Name: "OUTPUT", Policy: "DROP"}}
+		}, []int{0}},
+		// the default ACCEPT of INPUT is an input-open change too
+		{"input default", func(p *netmanage.Policy) {
+			p.Chains = []netmanage.ChainDef{{Name: "INPUT", Policy: "DROP"}}
+		}, []int{1}},
+	} {
+		proposed, err := netmanage.NetPolicyScanner("netPolicy1.json")
+		require.Nil(t, err)
+		c.change(proposed)
+		proposed.Num = len(proposed.Rules)
+		touched, err := rolesConf().TouchedScopes(current, proposed)
+		require.Nil(t, err, c.name)
+		assert.Equal(t, c.touched, touched, c.name)
+	}
+}
+
+func TestConf_TouchedScopesCustomChains(t *testing.T) {
+	// INPUT drops everything but what the ssh-in chain accepts
+	base := func() *netmanage.Policy {
+		jump := rule("INPUT", "TCP", "ALL", "22", "JUMP")
+		jump.Target = "ssh-in"
+		p := &netmanage.Policy{Chains: []netmanage.ChainDef{{Name: "INPUT", Policy: "DROP"}, {Name: "ssh-in"}},
+			Rules: []netmanage.Rule{jump, rule("ssh-in", "TCP", "10.0.0.0/8", "22", "ACCEPT")}}
+		p.Num = len(p.Rules)
+		return p
+	}
+	for _, c := range []struct {
+		name    string
+		change  func(*netmanage.Policy)
+		touched []int
+	}{
+		{"unchanged", func(p *netmanage.Policy) {}, nil},
+		{"wider accept", func(p *netmanage.Policy) {
+			p.Rules[1].Match.Src = "ALL"
+		}, []int{1}},
+		{"drop in front", func(p *netmanage.Policy) {
+			p.Rules = append(p.Rules, p.Rules[1])
+			p.Rules[1] = rule("ssh-in", "TCP", "10.0.0.1", "22", "DROP")
+		}, []int{1}},
+		// nothing after accepts it, INPUT drops it anyway
+		{"drop after", func(p *netmanage.Policy) {
+			p.Rules = append(p.Rules, rule("ssh-in", "TCP", "10.0.0.1", "22", "DROP"))
+		}, nil},
+		{"jump removed", func(p *netmanage.Policy) {
+			p.Rules[0].Match.Dports = "2222"
+		}, []int{1}},
+	} {
+		proposed := base()
+		c.change(proposed)
+		proposed.Num = len(proposed.Rules)
+		touched, err := rolesConf().TouchedScopes(base(), proposed)
+		require.Nil(t, err, c.name)
+		assert.Equal(t, c.touched, touched, c.name)
+	}
+}
+
+func TestConf_TouchedScopesOnCustomChain(t *testing.T) {
+	jump := rule("INPUT", "TCP", "ALL", "22", "JUMP")
+	jump.Target = "ssh-in"
+	base := func() *netmanage.Policy {
+		p := &netmanage.Policy{Chains: []netmanage.ChainDef{{Name: "INPUT", Policy: "DROP"}, {Name: "ssh-in"}},
+			Rules: []netmanage.Rule{jump, rule("ssh-in", "TCP", "10.0.0.0/8", "22", "ACCEPT")}}
+		p.Num = len(p.Rules)
+		return p
+	}
+	conf := rolesConf()
+	conf.Scopes = []netmanage.ApprovalScope{
+		{Name: "ssh", Chain: "ssh-in", Action: "ACCEPT", Role: "security", Threshold: 2},
+		{Name: "ssh-any", Chain: "ssh-in", Role: "network", Threshold: 1},
+	}
+	require.Nil(t, conf.ValidateChains(base()))
+	for _, c := range []struct {
+		name    string
+		change  func(*netmanage.Policy)
+		touched []int
+	}{
+		{"unchanged", func(p *netmanage.Policy) {}, nil},
+		{"wider accept", func(p *netmanage.Policy) {
+			p.Rules[1].Match.Src = "ALL"
+		}, []int{0, 1}},
+		// the traffic the chain does not drop goes back to INPUT
+		{"drop after", func(p *netmanage.Policy) {
+			p.Rules = append(p.Rules, rule("ssh-in", "TCP", "10.0.0.1", "22", "DROP"))
+		}, []int{0, 1}},
+		{"other port", func(p *netmanage.Policy) {
+			p.Rules = append(p.Rules, rule("ssh-in", "TCP", "ALL", "443", "ACCEPT"))
+		}, []int{0, 1}},
+		// the rules of INPUT are not the ones of the chain
+		{"input accept", func(p *netmanage.Policy) {
+			p.Rules = append(p.Rules, rule("INPUT", "TCP", "ALL", "22", "ACCEPT"))
+		}, nil},
+	} {
+		proposed := base()
+		c.change(proposed)
+		proposed.Num = len(proposed.Rules)
+		touched, err := conf.TouchedScopes(base(), proposed)
+		require.Nil(t, err, c.name)
+		assert.Equal(t, c.touched, touched, c.name)
+	}
+}
+
+func TestConf_ValidateChains(t *testing.T) {
+	policy := &netmanage.Policy{Chains: []netmanage.ChainDef{{Name: "ssh-in"}, {Table: "nat", Name: "redirect"}}}
+	for _, c := range []struct {
+		scope netmanage.ApprovalScope
+		valid bool
+	}{
+		{netmanage.ApprovalScope{Chain: "INPUT"}, true},
+		{netmanage.ApprovalScope{Chain: "ssh-in"}, true},
+		{netmanage.ApprovalScope{Table: "filter", Chain: "ssh-in"}, true},
+		{netmanage.ApprovalScope{Chain: "redirect"}, true},
+		{netmanage.ApprovalScope{Table: "nat", Chain: "PREROUTING"}, true},
+		{netmanage.ApprovalScope{Chain: "http-in"}, false},
+		{netmanage.ApprovalScope{Table: "nat", Chain: "ssh-in"}, false},
+		{netmanage.ApprovalScope{Table: "nat", Chain: "INPUT"}, false},
+	} {
+		c.scope.Name, c.scope.Role, c.scope.Threshold = "scope", "security", 1
+		conf := rolesConf()
+		conf.Scopes = []netmanage.ApprovalScope{c.scope}
+		require.Nil(t, conf.Validate(), c.scope.Chain)
+		assert.Equal(t, c.valid, conf.ValidateChains(policy) == nil, c.scope.Table+" "+c.scope.Chain)
+	}
+	assert.Nil(t, rolesConf().ValidateChains(&netmanage.Policy{}))
+}
+
+func TestConf_DecideChange(t *testing.T) {
+	// ops, alice, bob and carol are members 0 to 3, bob and carol have
+	// the network role and only bob weighs 2 for the security role
+	d := rolesConf().DecideChange([]int{0, 1, 3}, []int{0, 1})
+	assert.False(t, d.Approved)
+	assert.Equal(t, "overall: 3 of 3, passed; role security: 1 of 2, failed; "+
+		"scope dns: 1 of 1, passed; scope input-open: 1 of 2, failed", d.String())
+
+	d = rolesConf().DecideChange([]int{2, 3}, []int{0, 1})
+	assert.True(t, d.Approved, d.String())
+	assert.Nil(t, d.Err())
+
+	d = rolesConf().DecideChange([]int{0, 1, 2}, []int{0})
+	assert.True(t, d.Approved, d.String())
+	d = rolesConf().DecideChange([]int{0, 1}, []int{0})
+	assert.Equal(t, "not approved, overall: 2 of 3, failed; role security: 1 of 2, failed; scope dns: 0 of 1, failed", d.Err().Error())
+}
@@ -1,9 +1,7 @@
 package service
 
 import (
-	"bufio"
 	"os"
-	"strings"
 	"fmt"
 
 	"github.com/BurntSushi/toml"
@@ -16,58 +14,14 @@ import (
 	"encoding/hex"
 )
 
-// Scanner for a file containing signatures, return sig array
+// Scanner for a file containing signatures of any scheme, see netmanage.SigScanner
 func SigScanner(filename string) ([]string, error) {
-	var blocks []string
-	head := "-----BEGIN PGP SIGNATURE-----"
-	log.Lvl2("Reading file", filename)
-
-	file, err := os.Open(filename)
-	defer file.Close()
-	if err != nil {
-		log.Errorf("Couldn't open file", file, err)
-		return nil, err
-	}
-
-	scanner := bufio.NewScanner(file)
-	var block []string
-	for scanner.Scan() {
-		text := scanner.Text()
-		log.Lvl4("Decoding", text)
-		// end of the first part
-		if text == head {
-			log.Lvl4("Found header")
-			if len(block) > 0 {
-				blocks = append(blocks, strings.Join(block, "\n"))
-				block = make([]string, 0)
-			}
-		}
-		block = append(block, text)
-	}
-	blocks = append(blocks, strings.Join(block, "\n"))
-	return blocks, nil
+	return netmanage.SigScanner(filename)
 }
 
-// Scanner for a configuration file containing threshold and public keys
+// Scanner for a configuration file containing threshold and public keys, see netmanage.ConfScanner
 func ConfScanner(filename string) (*netmanage.Conf, error) {
-	type confToml struct {
-		Threshold  int
-		PublicKeys []string
-	}
-	var c confToml
-	//fmt.Printf("ConfScanner@@@@@@@@@@@@\n")
-	log.Lvl3("Reading file", filename)
-	meta, err := toml.DecodeFile(filename, &c)
-	if err != nil {
-		log.Fatal(err)
-	}
-	
-	log.Lvlf4("Fields of the configuration are %+v", meta.Keys())
-	
-	conf := &netmanage.Conf{Threshold: c.Threshold, PubKeys:c.PublicKeys}
-	//fmt.Printf("ConfScanner conf threshold = %d\n",conf.Threshold)
-	//fmt.Printf("ConfScanner conf pub0 = %s\n",conf.PubKeys[0])
-	return conf, err
+	return netmanage.ConfScanner(filename)
 }
 
 // Scanner for a file containing a network policy (the policy file is made manually)
@@ -87,6 +41,10 @@ func NetPolicyScanner(filename string) (*netmanage.Policy, error) {
 	}
 	//fmt.Printf(policy.Rules[0].Match.Dports+"\n")
 	//fmt.Printf(policy.Rules[2].Match.Sports+"\n")
+	//rules reference the address and service groups by name, they must all exist
+	if err = policy.CheckGroups(); err != nil {
+		return nil, err
+	}
 	return &policy, err
 }
 
@@ -0,0 +1,280 @@
+package service
+
+/*
+The proposal.go keeps the new policies waiting for the signatures of the
+admins, so that they do not have to be gathered out of band into one
+signatures file. A policy signed on top of the latest block is submitted, the
+admins add their signatures one by one, and the proposal is cosigned and
+appended as soon as they approve it.
+
+Proposals are saved with the Storage. They are dropped when they expire, and
+when another block is appended after their parent, since their signatures
+cannot be used on top of another block.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/dedis/netmanage"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+//how long a proposal waits for the signatures of the admins unless the service sets its ProposalTTL
+const defaultProposalTTL = 7 * 24 * time.Hour
+
+//keep a new policy until the admins approve it, submitting the same policy data twice returns the pending proposal
+func (s *Service) SubmitProposalRequest(req *netmanage.SubmitProposalRequest) (*netmanage.SubmitProposalResponse, onet.ClientError) {
+	if req.Roster == nil {
+		return nil, onet.NewClientErrorCode(ErrorProposal, "The proposal has no roster")
+	}
+	if cerr := checkPolicyData(req.PolicyData); cerr != nil {
+		return nil, cerr
+	}
+	if len(req.PolicyData.ParentID) == 0 {
+		return nil, onet.NewClientErrorCode(ErrorProposal, "The proposal has no parent block, a genesis policy cannot be proposed")
+	}
+	//refuse a proposal that could never be appended before the admins spend time signing it
+	if err := s.checkBinding(req.PolicyData); err != nil {
+		return nil, onet.NewClientErrorCode(ErrorProposal, "The proposal cannot be approved: "+err.Error())
+	}
+	if s.AnalyzePolicies {
+		if cerr := analyzePolicy(req.PolicyData.Policy); cerr != nil {
+			return nil, cerr
+		}
+	}
+	buf, err := req.PolicyData.SigningBytes()
+	if err != nil {
+		return nil, onet.NewClientErrorCode(ErrorProposal, err.Error())
+	}
+	hash := sha256.Sum256(buf)
+	id := hex.EncodeToString(hash[:])
+
+	now := time.Now()
+	s.Storage.proposalsMutex.Lock()
+	defer s.Storage.proposalsMutex.Unlock()
+	s.pruneProposals(now)
+	proposal := s.proposal(id)
+	if proposal == nil {
+		proposal = &netmanage.Proposal{ID: id, Roster: req.Roster, PolicyData: req.PolicyData,
+			Submitted: now.Format(time.RFC3339), Expires: now.Add(s.proposalTTL()).Format(time.RFC3339)}
+		s.Storage.Proposals = append(s.Storage.Proposals, proposal)
+		s.save()
+		log.Lvl2("New proposal", id, "expiring at", proposal.Expires)
+	}
+	return &netmanage.SubmitProposalResponse{Status: s.proposalStatus(proposal)}, nil
+}
+
+//add the signature of one admin to a proposal, and append the proposal once the signatures approve it.
+//A signature that is invalid, or of an admin who already signed, is refused, as is any signature once the proposal
+//is approved. The signatures are saved before the append, an approved proposal whose append failed is appended
+//again with AppendProposalRequest.
+func (s *Service) AddSignatureRequest(req *netmanage.AddSignatureRequest) (*netmanage.AddSignatureResponse, onet.ClientError) {
+	s.Storage.proposalsMutex.Lock()
+	s.pruneProposals(time.Now())
+	proposal := s.proposal(req.ID)
+	if proposal == nil {
+		s.Storage.proposalsMutex.Unlock()
+		return nil, onet.NewClientErrorCode(ErrorProposal, "There is no pending proposal "+req.ID)
+	}
+	if s.Storage.appending[proposal.ID] {
+		s.Storage.proposalsMutex.Unlock()
+		return nil, onet.NewClientErrorCode(ErrorProposal, "The proposal "+req.ID+" is being appended")
+	}
+
+	before := s.proposalStatus(proposal)
+	if approved(before) {
+		s.Storage.proposalsMutex.Unlock()
+		return nil, onet.NewClientErrorCode(ErrorProposal, "The proposal "+req.ID+" is already approved, append it with AppendProposalRequest")
+	}
+	signatures := &proposal.Signatures
+	if req.ConfChange {
+		signatures = &proposal.ConfSignatures
+	}
+	*signatures = append(*signatures, req.Signature)
+	status := s.proposalStatus(proposal)
+	if status.Error != "" {
+		*signatures = (*signatures)[:len(*signatures)-1]
+		s.Storage.proposalsMutex.Unlock()
+		return nil, onet.NewClientErrorCode(ErrorProposal, "The proposal cannot be approved: "+status.Error)
+	}
+	added := approvedWeight(status.Decision) > approvedWeight(before.Decision)
+	if req.ConfChange {
+		added = approvedWeight(status.ConfDecision) > approvedWeight(before.ConfDecision)
+	}
+	if !added {
+		*signatures = (*signatures)[:len(*signatures)-1]
+		s.Storage.proposalsMutex.Unlock()
+		return nil, onet.NewClientErrorCode(ErrorProposal, "The signature is invalid or its admin already signed")
+	}
+	s.save()
+	log.Lvl2("Proposal", proposal.ID, "signed:", status.Decision)
+	if !approved(status) {
+		s.Storage.proposalsMutex.Unlock()
+		return &netmanage.AddSignatureResponse{Status: status}, nil
+	}
+
+	s.markAppending(proposal.ID)
+	s.Storage.proposalsMutex.Unlock()
+	if cerr := s.appendApproved(proposal, status); cerr != nil {
+		return nil, cerr
+	}
+	return &netmanage.AddSignatureResponse{Status: status}, nil
+}
+
+//append again an approved proposal whose append failed, the signatures already collected are used
+func (s *Service) AppendProposalRequest(req *netmanage.AppendProposalRequest) (*netmanage.AppendProposalResponse, onet.ClientError) {
+	s.Storage.proposalsMutex.Lock()
+	s.pruneProposals(time.Now())
+	proposal := s.proposal(req.ID)
+	if proposal == nil {
+		s.Storage.proposalsMutex.Unlock()
+		return nil, onet.NewClientErrorCode(ErrorProposal, "There is no pending proposal "+req.ID)
+	}
+	if s.Storage.appending[proposal.ID] {
+		s.Storage.proposalsMutex.Unlock()
+		return nil, onet.NewClientErrorCode(ErrorProposal, "The proposal "+req.ID+" is being appended")
+	}
+	status := s.proposalStatus(proposal)
+	if !approved(status) {
+		s.Storage.proposalsMutex.Unlock()
+		return nil, onet.NewClientErrorCode(ErrorProposal, "The proposal "+req.ID+" is not approved yet")
+	}
+	s.markAppending(proposal.ID)
+	s.Storage.proposalsMutex.Unlock()
+	if cerr := s.appendApproved(proposal, status); cerr != nil {
+		return nil, cerr
+	}
+	return &netmanage.AppendProposalResponse{Status: status}, nil
+}
+
+//list the pending proposals with their signatures against the thresholds
+func (s *Service) ListProposalsRequest(req *netmanage.ListProposalsRequest) (*netmanage.ListProposalsResponse, onet.ClientError) {
+	s.Storage.proposalsMutex.Lock()
+	defer s.Storage.proposalsMutex.Unlock()
+	s.pruneProposals(time.Now())
+	resp := &netmanage.ListProposalsResponse{}
+	for _, proposal := range s.Storage.Proposals {
+		resp.Proposals = append(resp.Proposals, s.proposalStatus(proposal))
+	}
+	return resp, nil
+}
+
+//get one pending proposal with its signatures against the thresholds
+func (s *Service) GetProposalRequest(req *netmanage.GetProposalRequest) (*netmanage.GetProposalResponse, onet.ClientError) {
+	s.Storage.proposalsMutex.Lock()
+	defer s.Storage.proposalsMutex.Unlock()
+	s.pruneProposals(time.Now())
+	proposal := s.proposal(req.ID)
+	if proposal == nil {
+		return nil, onet.NewClientErrorCode(ErrorProposal, "There is no pending proposal "+req.ID)
+	}
+	return &netmanage.GetProposalResponse{Status: s.proposalStatus(proposal)}, nil
+}
+
+//the pending proposal with the id, nil if there is none. The caller holds the proposalsMutex, like in the functions below
+func (s *Service) proposal(id string) *netmanage.Proposal {
+	for _, proposal := range s.Storage.Proposals {
+		if proposal.ID == id {
+			return proposal
+		}
+	}
+	return nil
+}
+
+//check the signatures collected for the proposal
+func (s *Service) proposalStatus(proposal *netmanage.Proposal) *netmanage.ProposalStatus {
+	status := &netmanage.ProposalStatus{Proposal: proposal}
+	var err error
+	//a decision comes with an error when it does not approve, only a missing one means the signatures could not be checked
+	if status.Decision, err = s.ApprovalCheck(proposal.PolicyData, proposal.Signatures); status.Decision == nil {
+		status.Error = err.Error()
+		return status
+	}
+	if status.ConfDecision, err = s.ConfChangeCheck(proposal.PolicyData, proposal.ConfSignatures); status.ConfDecision == nil {
+		status.Error = err.Error()
+	}
+	return status
+}
+
+//drop the proposals that expired and the ones whose parent is not the latest block anymore
+func (s *Service) pruneProposals(now time.Time) {
+	_, latest := s.chainIDs()
+	var pending []*netmanage.Proposal
+	for _, proposal := range s.Storage.Proposals {
+		expires, err := time.Parse(time.RFC3339, proposal.Expires)
+		switch {
+		case err != nil || !now.Before(expires):
+			log.Lvl2("The proposal", proposal.ID, "expired at", proposal.Expires)
+		case !bytes.Equal(proposal.PolicyData.ParentID, latest):
+			log.Lvl2("The proposal", proposal.ID, "is not on top of the latest block anymore")
+		default:
+			pending = append(pending, proposal)
+		}
+	}
+	if len(pending) != len(s.Storage.Proposals) {
+		s.Storage.Proposals = pending
+		s.save()
+	}
+}
+
+//the signatures of the proposal approve both its policy and its conf
+func approved(status *netmanage.ProposalStatus) bool {
+	return status.Decision != nil && status.Decision.Approved && status.ConfDecision != nil && status.ConfDecision.Approved
+}
+
+//the total weight of the admins approving in the decision
+func approvedWeight(decision *netmanage.ApprovalDecision) int {
+	if decision == nil || len(decision.Rules) == 0 {
+		return 0
+	}
+	return decision.Rules[0].Weight
+}
+
+//the ProposalTTL of the service, a service made without newService, like the ones of the tests, has the default
+func (s *Service) proposalTTL() time.Duration {
+	if s.ProposalTTL > 0 {
+		return s.ProposalTTL
+	}
+	return defaultProposalTTL
+}
+
+//append the approved proposal, through newPolicy when the tests set it
+func (s *Service) appendProposal(proposal *netmanage.Proposal) (*netmanage.NewPolicyResponse, onet.ClientError) {
+	req := &netmanage.NewPolicyRequest{Roster: proposal.Roster, PolicyData: proposal.PolicyData,
+		Signatures: proposal.Signatures, ConfSignatures: proposal.ConfSignatures, ParentBlockID: proposal.PolicyData.ParentID}
+	if s.newPolicy != nil {
+		return s.newPolicy(req)
+	}
+	return s.NewPolicyRequest(req)
+}
+
+//mark the proposal as being appended, so that it is neither signed nor appended twice while the proposalsMutex is
+//released for the append. The caller holds the proposalsMutex
+func (s *Service) markAppending(id string) {
+	if s.Storage.appending == nil {
+		s.Storage.appending = make(map[string]bool)
+	}
+	s.Storage.appending[id] = true
+}
+
+//append the proposal marked with markAppending without holding the proposalsMutex, the append cosigns the block
+//over the network. The mark is removed whatever the outcome, a failed append is kept for AppendProposalRequest
+func (s *Service) appendApproved(proposal *netmanage.Proposal, status *netmanage.ProposalStatus) onet.ClientError {
+	resp, cerr := s.appendProposal(proposal)
+	s.Storage.proposalsMutex.Lock()
+	defer s.Storage.proposalsMutex.Unlock()
+	delete(s.Storage.appending, proposal.ID)
+	if cerr != nil {
+		log.Error("Couldn't append the approved proposal", proposal.ID, ":", cerr)
+		return cerr
+	}
+	status.BlockID = resp.BlockID
+	log.Lvl2("Proposal", proposal.ID, "appended as block", hex.EncodeToString(resp.BlockID))
+	//this proposal and the other ones on the same parent cannot be appended anymore
+	s.pruneProposals(time.Now())
+	return nil
+}
@@ -0,0 +1,81 @@
+package service
+
+/*
+The revocation.go appends the block of a key revocation, see
+netmanage.Revocation. It keeps the policy of the latest block and replaces
+its conf by the one without the revoked key, so the key approves nothing from
+then on, without the admins signing a new policy.
+*/
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/dedis/netmanage"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+//remove a key from the conf of the latest block once the other admins reach the revocation quorum, and cosign and
+//append the block recording the revocation
+func (s *Service) RevokeKeyRequest(req *netmanage.RevokeKeyRequest) (*netmanage.RevokeKeyResponse, onet.ClientError) {
+	if req.Roster == nil {
+		return nil, onet.NewClientErrorCode(ErrorRevocation, "The revocation request has no roster")
+	}
+	data, decision, cerr := s.RevocationCheck(req.Revocation, req.Signatures)
+	if cerr != nil {
+		return nil, cerr
+	}
+	log.Lvl1("Revoking the key", req.Revocation.KeyID, "approved by", decision.Approvers())
+
+	cosiPolicy, cerr := s.SignPolicyData(req.Roster, data, decision.Approvers(), nil)
+	if cerr != nil {
+		return nil, cerr
+	}
+	latest, err := s.appendPolicy(req.Roster, data.ParentID, cosiPolicy)
+	if err != nil {
+		return nil, onet.NewClientError(err)
+	}
+	return &netmanage.RevokeKeyResponse{BlockID: latest.Hash, LatestBlock: latest, Approval: decision}, nil
+}
+
+//check that the revocation is for the latest block and that the admins keeping their keys approve it with the
+//revocation quorum, and return the policy data of its block along with the decision over the signatures
+func (s *Service) RevocationCheck(rev *netmanage.Revocation, signatures []string) (*netmanage.PolicyData, *netmanage.ApprovalDecision, onet.ClientError) {
+	if rev == nil || rev.KeyID == "" {
+		return nil, nil, onet.NewClientErrorCode(ErrorRevocation, "The revocation names no key")
+	}
+	genesis, latestID := s.chainIDs()
+	if !bytes.Equal(rev.ChainID, genesis) {
+		return nil, nil, onet.NewClientErrorCode(ErrorRevocation, fmt.Sprintf("The revocation was signed for chain %x, not %x", []byte(rev.ChainID), []byte(genesis)))
+	}
+	if !bytes.Equal(rev.ParentID, latestID) {
+		return nil, nil, onet.NewClientErrorCode(ErrorRevocation, fmt.Sprintf("The revocation was signed on top of block %x, the latest is %x", []byte(rev.ParentID), []byte(latestID)))
+	}
+	latest, cerr := s.latestPolicy()
+	if cerr != nil {
+		return nil, nil, cerr
+	}
+	current := latest.PolicyData
+	if current == nil || current.Policy == nil || current.Conf == nil {
+		return nil, nil, onet.NewClientErrorCode(ErrorRevocation, "The latest block has no policy or no conf")
+	}
+	conf, approving, err := current.Conf.Revoke(rev.KeyID)
+	if err != nil {
+		return nil, nil, onet.NewClientErrorCode(ErrorRevocation, "The key cannot be revoked: "+err.Error())
+	}
+
+	signedBuf, err := rev.SigningBytes()
+	if err != nil {
+		return nil, nil, onet.NewClientErrorCode(ErrorRevocation, err.Error())
+	}
+	decision, err := s.approve(approving, signedBuf, signatures, nil)
+	if err != nil {
+		return nil, decision, onet.NewClientErrorCode(ErrorApproval, "The revocation is not approved: "+err.Error())
+	}
+
+	data := &netmanage.PolicyData{Policy: current.Policy, Conf: conf, Expiry: current.Expiry,
+		Encoding: netmanage.EncodingCanonicalV1, ParentID: rev.ParentID, ChainID: rev.ChainID, Nonce: rev.Nonce,
+		Revocation: rev}
+	return data, decision, nil
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/dedis/netmanage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_RevocationCheck(t *testing.T) {
+	admins, conf := testAdmins(4, 3)
+	policy, err := NetPolicyScanner("../netPolicy1.json")
+	require.Nil(t, err)
+	genesis := &netmanage.PolicyData{Policy: policy, Conf: conf, Encoding: netmanage.EncodingCanonicalV1,
+		Expiry: "2100-01-01T00:00:00Z"}
+	s := testChain(genesis, genesis)
+	stolen := admins[3].PrimaryKey.KeyIdString()
+	rev := &netmanage.Revocation{ChainID: []byte{1}, ParentID: []byte{3}, KeyID: stolen, Reason: "stolen laptop"}
+	text, err := rev.SigningBytes()
+	require.Nil(t, err)
+
+	// the quorum is 2 of the 3 other admins, the revoked key does not count
+	_, decision, cerr := s.RevocationCheck(rev, testSign(text, admins[0], admins[3]))
+	require.NotNil(t, cerr)
+	assert.Equal(t, ErrorApproval, cerr.ErrorCode())
+	assert.Equal(t, "overall: 1 of 2, failed", decision.String())
+	assert.Equal(t, "the key is not one of the admins", decision.Signatures[1].Reason)
+
+	data, decision, cerr := s.RevocationCheck(rev, testSign(text, admins[0], admins[2]))
+	require.Nil(t, cerr)
+	assert.Equal(t, []string{admins[0].PrimaryKey.KeyIdString(), admins[2].PrimaryKey.KeyIdString()}, decision.Approvers())
+	assert.Equal(t, rev, data.Revocation)
+	assert.Equal(t, policy, data.Policy)
+	assert.Equal(t, genesis.Expiry, data.Expiry)
+	assert.Equal(t, conf.PubKeys[:3], data.Conf.PubKeys)
+	assert.Equal(t, 3, data.Conf.Threshold)
+	// once appended, the revoked key approves nothing
+	s = testChain(genesis, data)
+	next := &netmanage.PolicyData{Policy: policy, Conf: data.Conf, Encoding: netmanage.EncodingCanonicalV1,
+		ParentID: []byte{3}, ChainID: []byte{1}}
+	nextText, err := next.SigningBytes()
+	require.Nil(t, err)
+	decision, err = s.ApprovalCheck(next, testSign(nextText, admins[1], admins[2], admins[3]))
+	assert.NotNil(t, err)
+	assert.Equal(t, "overall: 2 of 3, failed", decision.String())
+
+	// a revocation for another block, of an unknown key or leaving too few admins is refused before the signatures
+	s = testChain(genesis, genesis)
+	for _, change := range []func(*netmanage.Revocation){
+		func(r *netmanage.Revocation) { r.ParentID = []byte{2} },
+		func(r *netmanage.Revocation) { r.ChainID = []byte{2} },
+		func(r *netmanage.Revocation) { r.KeyID = "0000000000000000" },
+		func(r *netmanage.Revocation) { r.KeyID = "" },
+	} {
+		wrong := *rev
+		change(&wrong)
+		_, _, cerr = s.RevocationCheck(&wrong, testSign(text, admins[:3]...))
+		require.NotNil(t, cerr)
+		assert.Equal(t, ErrorRevocation, cerr.ErrorCode())
+	}
+	strict := &netmanage.PolicyData{Policy: policy, Conf: &netmanage.Conf{Threshold: 4, PubKeys: conf.PubKeys},
+		Encoding: netmanage.EncodingCanonicalV1}
+	s = testChain(strict, strict)
+	_, _, cerr = s.RevocationCheck(rev, testSign(text, admins[:3]...))
+	require.NotNil(t, cerr)
+	assert.Equal(t, ErrorRevocation, cerr.ErrorCode())
+
+	// only the service writes the revocation of a block
+	assert.Equal(t, ErrorInvalidPolicy, checkPolicyData(data).ErrorCode())
+}
+
+func TestService_ApprovalRevokedKeys(t *testing.T) {
+	// gpg keys whose signatures over ../testdata/ssh/message were made while they were valid
+	var conf netmanage.Conf
+	var signatures []string
+	for _, name := range []string{"revoked", "expired"} {
+		key, err := ioutil.ReadFile("../testdata/pgp/" + name + ".asc")
+		require.Nil(t, err)
+		sig, err := ioutil.ReadFile("../testdata/pgp/" + name + ".sig")
+		require.Nil(t, err)
+		conf.PubKeys, signatures = append(conf.PubKeys, string(key)), append(signatures, string(sig))
+	}
+	conf.Threshold = 1
+	message, err := ioutil.ReadFile("../testdata/ssh/message")
+	require.Nil(t, err)
+
+	s := &Service{Storage: &Storage{}}
+	decision, err := s.approve(&conf, message, signatures, nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, "overall: 0 of 1, failed", decision.String())
+	assert.Equal(t, "revoked <revoked@lab>", decision.Signatures[0].Identity)
+	assert.Equal(t, "the key was revoked", decision.Signatures[0].Reason)
+	assert.Equal(t, "the key expired on 2020-02-01T12:00:00Z", decision.Signatures[1].Reason)
+}
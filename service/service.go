@@ -14,11 +14,10 @@ import (
 	"gopkg.in/dedis/onet.v1/network"
 	"strings"
 	"sync"
+	"time"
 
 	//for test
 
-	"encoding/hex"
-	"encoding/json"
 	"golang.org/x/crypto/openpgp/armor"
 	"gopkg.in/dedis/onet.v1/simul/monitor"
 	"io/ioutil"
@@ -36,6 +35,16 @@ const (
 	ErrorGetPolicy
 
 	ErrorVerifyPolicy
+
+	ErrorInvalidPolicy
+
+	ErrorPolicyAnalysis
+
+	ErrorApproval
+
+	ErrorProposal
+
+	ErrorRevocation
 )
 
 //ServiceName is used for registration on the onet.
@@ -58,6 +67,16 @@ type Service struct {
 	//just for using the skipchain api functions
 	skipchainClient *skipchain.Client
 	cosiClient      *cosisign.Client
+
+	//if set, NewPolicyRequest refuses policies for which netmanage.Analyze reports errors (e.g. shadowed rules)
+	AnalyzePolicies bool
+	//how long a proposal waits for the signatures of the admins before it is dropped, a week by default
+	ProposalTTL time.Duration
+	//appends the approved proposals instead of NewPolicyRequest, for the tests
+	newPolicy func(*netmanage.NewPolicyRequest) (*netmanage.NewPolicyResponse, onet.ClientError)
+
+	//the parsed keys of the admins of the latest confs
+	keys keyCache
 }
 
 //this is where to store the policy chain
@@ -68,8 +87,14 @@ type Storage struct {
 	// the latest block of policy chain
 	LatestPolicy *skipchain.SkipBlock
 
-	genesisMutex sync.Mutex
-	latestMutex  sync.Mutex
+	// the new policies waiting for the signatures of the admins
+	Proposals []*netmanage.Proposal
+
+	genesisMutex   sync.Mutex
+	latestMutex    sync.Mutex
+	proposalsMutex sync.Mutex
+	// the proposals being appended, they are not saved
+	appending map[string]bool
 }
 
 // storageID reflects the data we're storing - we could store more
@@ -95,20 +120,32 @@ func (s *Service) GenesisPolicyRequest(req *netmanage.GenesisPolicyRequest) (*ne
 		return nil, onet.NewClientErrorCode(ErrorGenesisPolicy, "The Genesis policy request has no max height")
 	}
 
+	//a second genesis would replace the chain and its admins with whoever signed it
+	if genesisID, _ := s.chainIDs(); len(genesisID) != 0 {
+		return nil, onet.NewClientErrorCode(ErrorGenesisPolicy, "The policy chain already has a genesis block")
+	}
+
+	if cerr := checkPolicyData(req.PolicyData); cerr != nil {
+		return nil, cerr
+	}
+	if len(req.PolicyData.ParentID) != 0 {
+		return nil, onet.NewClientErrorCode(ErrorGenesisPolicy, "The Genesis policy was signed with a parent block")
+	}
+
 	//fmt.Printf("GenesisPolicyRequest00000000000\n")
 	//check if the admins' signatures have reached the threshold. If no enough approvers, return nil and error directly
 
 	genesisApprovalCheck := monitor.NewTimeMeasure("genesisApprovalCheck")
-	isApproved, err := s.ApprovalCheck(req.PolicyData, req.Signatures)
+	decision, err := s.ApprovalCheck(req.PolicyData, req.Signatures)
 	genesisApprovalCheck.Record()
 
-	if isApproved != true {
-		return nil, onet.NewClientError(err)
+	if err != nil {
+		return nil, onet.NewClientErrorCode(ErrorApproval, "The genesis policy is not approved: "+err.Error())
 	}
-	//cosign the PolicyData into CosiPolicy as the data part of the policy block
+	//cosign the PolicyData and its approvers into CosiPolicy as the data part of the policy block
 
 	genesisCoSign := monitor.NewTimeMeasure("genesisCoSign")
-	cosiPolicy, err := s.SignPolicyData(el, req.PolicyData)
+	cosiPolicy, err := s.SignPolicyData(el, req.PolicyData, decision.Approvers(), nil)
 	genesisCoSign.Record()
 	if err != nil {
 		log.Error(err)
@@ -130,14 +167,10 @@ func (s *Service) GenesisPolicyRequest(req *netmanage.GenesisPolicyRequest) (*ne
 	s.Storage.latestMutex.Unlock()
 
 	//fmt.Printf("!!!!!service GenesisPolicyRequest data is %s\n",string(s.Storage.LatestPolicy.SkipBlockFix.Data))
-	resp := &netmanage.GenesisPolicyResponse{BlockID: genesis.Hash, GenesisBlock: genesis}
+	resp := &netmanage.GenesisPolicyResponse{BlockID: genesis.Hash, GenesisBlock: genesis, Approval: decision}
 	//fmt.Printf("GenesisPolicyRequest genesis hash hex = %s\n", hex.EncodeToString(genesis.Hash))
 	//fmt.Printf("GenesisPolicyRequest genesis hash = %s\n",string(genesis.Hash[:]))
 
-	if s.Storage.LatestPolicy == nil {
-		fmt.Printf("service GenesisPolicyRequest 11111 s.Storage.LatestPolicy is nil\n\n")
-	}
-
 	return resp, nil
 }
 
@@ -151,7 +184,7 @@ func (s *Service) NewPolicyRequest(req *netmanage.NewPolicyRequest) (*netmanage.
 	}
 
 	latestID := req.ParentBlockID
-	if latestID == nil {
+	if len(latestID) == 0 {
 		return nil, onet.NewClientErrorCode(ErrorNewPolicy, "The new policy request has no parent block hash")
 	}
 
@@ -160,25 +193,57 @@ func (s *Service) NewPolicyRequest(req *netmanage.NewPolicyRequest) (*netmanage.
 		return nil, onet.NewClientErrorCode(ErrorNewPolicy, "The new policy request has no roster")
 	}
 
+	if cerr := checkPolicyData(req.PolicyData); cerr != nil {
+		return nil, cerr
+	}
+	if !bytes.Equal(latestID, req.PolicyData.ParentID) {
+		return nil, onet.NewClientErrorCode(ErrorNewPolicy, "The new policy was signed with another parent block than the request's")
+	}
+	if s.AnalyzePolicies {
+		if cerr := analyzePolicy(req.PolicyData.Policy); cerr != nil {
+			return nil, cerr
+		}
+	}
+
 	//check if the admins' signatures have reached the threshold. If no enough approvers, return nil and error directly
 	newApprovalCheck := monitor.NewTimeMeasure("newApprovalCheck")
-	isApproved, err := s.ApprovalCheck(req.PolicyData, req.Signatures)
+	decision, err := s.ApprovalCheck(req.PolicyData, req.Signatures)
 	newApprovalCheck.Record()
-	if isApproved != true {
-		return nil, onet.NewClientError(err)
+	if err != nil {
+		return nil, onet.NewClientErrorCode(ErrorApproval, "The new policy is not approved: "+err.Error())
+	}
+	confDecision, err := s.ConfChangeCheck(req.PolicyData, req.ConfSignatures)
+	if err != nil {
+		return nil, onet.NewClientErrorCode(ErrorApproval, "The change of the admins is not approved: "+err.Error())
 	}
 
-	//cosign the PolicyData into CosiPolicy as the data part of the policy block
+	//cosign the PolicyData and its approvers into CosiPolicy as the data part of the policy block
 	newCoSign := monitor.NewTimeMeasure("newCoSign")
-	cosiPolicy, err := s.SignPolicyData(el, req.PolicyData)
+	cosiPolicy, err := s.SignPolicyData(el, req.PolicyData, decision.Approvers(), confDecision.Approvers())
 	newCoSign.Record()
 
 	if err != nil {
 		log.Error(err)
 		return nil, onet.NewClientError(err)
 	}
-	//create a newBlock with cosiPolicy as the data part
+	latest, err := s.appendPolicy(el, latestID, cosiPolicy)
+	if err != nil {
+		return nil, onet.NewClientError(err)
+	}
+
+	//fmt.Printf("!!!!!service NewPolicyRequest data is %s\n",string(s.Storage.LatestPolicy.Data))
+	resp := &netmanage.NewPolicyResponse{BlockID: latest.Hash, LatestBlock: latest, Approval: decision,
+		ConfApproval: confDecision}
+
+	if s.Storage.LatestPolicy == nil {
+		fmt.Printf("service NewPolicyRequest 11111 s.Storage.LatestPolicy is nil\n\n")
+	}
 
+	return resp, nil
+}
+
+//create a newBlock with cosiPolicy as the data part, append it after latestID and make it the latest policy
+func (s *Service) appendPolicy(el *onet.Roster, latestID skipchain.SkipBlockID, cosiPolicy *netmanage.CosiPolicy) (*skipchain.SkipBlock, error) {
 	newCreateBlock := monitor.NewTimeMeasure("newCreateBlock")
 	newBlock := skipchain.NewSkipBlock()
 	newCreateBlock.Record()
@@ -186,9 +251,8 @@ func (s *Service) NewPolicyRequest(req *netmanage.NewPolicyRequest) (*netmanage.
 	buf, err := network.Marshal(cosiPolicy)
 	if err != nil {
 		log.Error(err)
-		return nil, onet.NewClientError(err)
+		return nil, err
 	}
-	//fmt.Printf("NewPolicyRequest buf = %s\n", string(buf[:]))
 
 	newBlock.SkipBlockFix.Data = buf
 	newBlock.SkipBlockFix.Roster = el
@@ -198,72 +262,201 @@ func (s *Service) NewPolicyRequest(req *netmanage.NewPolicyRequest) (*netmanage.
 	newStoreSkipBlock.Record()
 
 	if err != nil {
-		return nil, onet.NewClientError(err)
+		return nil, err
 	}
 
 	s.Storage.latestMutex.Lock()
 	s.Storage.LatestPolicy = skiprep.Latest
 	s.Storage.latestMutex.Unlock()
+	return skiprep.Latest, nil
+}
 
-	//fmt.Printf("!!!!!service NewPolicyRequest data is %s\n",string(s.Storage.LatestPolicy.Data))
-	resp := &netmanage.NewPolicyResponse{BlockID: skiprep.Latest.Hash, LatestBlock: skiprep.Latest}
-
-	if s.Storage.LatestPolicy == nil {
-		fmt.Printf("service NewPolicyRequest 11111 s.Storage.LatestPolicy is nil\n\n")
+//refuse policy data that is missing, whose rules do not parse or that has already expired, before spending time on the signatures
+func checkPolicyData(policyData *netmanage.PolicyData) onet.ClientError {
+	if policyData == nil || policyData.Policy == nil || policyData.Conf == nil {
+		return onet.NewClientErrorCode(ErrorInvalidPolicy, "The policy request has no policy or no conf")
 	}
-
-	return resp, nil
+	if err := policyData.Conf.Validate(); err != nil {
+		return onet.NewClientErrorCode(ErrorInvalidPolicy, "The conf is invalid: "+err.Error())
+	}
+	if err := policyData.Policy.Validate(); err != nil {
+		return onet.NewClientErrorCode(ErrorInvalidPolicy, "The policy is invalid: "+err.Error())
+	}
+	if err := policyData.Conf.ValidateChains(policyData.Policy); err != nil {
+		return onet.NewClientErrorCode(ErrorInvalidPolicy, "The conf is invalid: "+err.Error())
+	}
+	if _, err := policyData.ExpiryTime(); err != nil {
+		return onet.NewClientErrorCode(ErrorInvalidPolicy, "The policy is invalid: "+err.Error())
+	}
+	if policyData.Encoding != netmanage.EncodingLegacy && policyData.Encoding != netmanage.EncodingCanonicalV1 {
+		return onet.NewClientErrorCode(ErrorInvalidPolicy, "The policy has an unknown encoding "+policyData.Encoding.String())
+	}
+	if policyData.ExpiredAt(time.Now()) {
+		return onet.NewClientErrorCode(ErrorInvalidPolicy, "The policy has already expired at "+policyData.Expiry)
+	}
+	//only the service builds the policy data of a revocation, from the signed Revocation
+	if policyData.Revocation != nil {
+		return onet.NewClientErrorCode(ErrorInvalidPolicy, "The policy data carries a revocation, revoke keys with a RevokeKeyRequest")
+	}
+	return nil
 }
 
-//check if enough admins ÃÂ¯ÃÂ¼ÃÂ>= threshold) have signed on the Policy
-func (s *Service) ApprovalCheck(policyData *netmanage.PolicyData, signatures []string) (bool, error) {
-	var (
-		admins    openpgp.EntityList         // List of all admins whose public keys are in the conf in the new policy Request
-		approvers map[string]*openpgp.Entity // Map of admins who provided a valid signature. Indexed by public key id (openpgp.PrimaryKey.KeyIdString)
-		err       error
-	)
-
-	approvers = make(map[string]*openpgp.Entity)
-
-	// Creating openpgp entitylist from list of public keys in the conf
-	admins = make(openpgp.EntityList, 0)
-	for _, pubkey := range policyData.Conf.PubKeys {
-		keybuf, err := openpgp.ReadArmoredKeyRing(strings.NewReader(pubkey))
-		if err != nil {
-			log.Error("Could not decode armored public key", err)
-		}
-		for _, entity := range keybuf {
-			admins = append(admins, entity)
+//refuse a policy with error-level findings, like a rule shadowed by an earlier one
+func analyzePolicy(policy *netmanage.Policy) onet.ClientError {
+	findings, err := netmanage.Analyze(policy)
+	if err != nil {
+		return onet.NewClientErrorCode(ErrorInvalidPolicy, "The policy is invalid: "+err.Error())
+	}
+	var errs []string
+	for _, f := range findings {
+		log.Lvl2("Policy analysis:", f)
+		if f.Severity == netmanage.SeverityError {
+			errs = append(errs, f.String())
 		}
 	}
+	if len(errs) > 0 {
+		return onet.NewClientErrorCode(ErrorPolicyAnalysis, "The policy analysis failed: "+strings.Join(errs, "; "))
+	}
+	return nil
+}
 
-	// Verifying every signature in the list and counting valid ones
+//check if the admins who signed the Policy reach the thresholds of the conf, the decision tells which rule passed
+//or failed and the error is set when it is not approved. The admins of a new policy are the ones of the conf in the
+//latest block, whatever conf the policy data carries, and they must also reach the thresholds of the scopes the
+//change from the latest policy touches. A genesis policy is approved by its own admins.
+func (s *Service) ApprovalCheck(policyData *netmanage.PolicyData, signatures []string) (*netmanage.ApprovalDecision, error) {
+	if err := s.checkBinding(policyData); err != nil {
+		log.Lvl2("The signatures are refused:", err)
+		return nil, err
+	}
+	current, err := s.currentData(policyData)
+	if err != nil {
+		return nil, err
+	}
+	var scopes []int
+	if current != policyData {
+		if scopes, err = current.Conf.TouchedScopes(current.Policy, policyData.Policy); err != nil {
+			return nil, err
+		}
+		log.Lvl3("The policy touches the scopes", scopes)
+	}
 
-	//transform policy into bytes
-	//fmt.Printf("approveCheck1111111111111111\n")
-	signedBuf, err := network.Marshal(policyData.Policy)
+	//the bytes the admins signed, as selected by the encoding of the policy data
+	signedBuf, err := policyData.SigningBytes()
 	if err != nil {
 		log.Error(err)
-		return false, err
+		return nil, err
 	}
+	return s.approve(current.Conf, signedBuf, signatures, scopes)
+}
 
-	for _, signature := range signatures {
-		result, err := openpgp.CheckArmoredDetachedSignature(admins, bytes.NewReader(signedBuf), strings.NewReader(signature))
-		if err != nil {
-			log.Lvl1("The signature is invalid or cannot be verified due to", err)
-		} else {
-			if approvers[result.PrimaryKey.KeyIdString()] == nil { // We need to check that this is a unique signature
-				approvers[result.PrimaryKey.KeyIdString()] = result
-				log.Lvl4("Approver: %+v", result.Identities)
+//check that the current admins approved the conf of a new policy, when it changes the admin set or the threshold.
+//Their signatures of the policy are not enough, the change needs its own signatures over its ConfChangeBytes.
+func (s *Service) ConfChangeCheck(policyData *netmanage.PolicyData, signatures []string) (*netmanage.ApprovalDecision, error) {
+	currentData, err := s.currentData(policyData)
+	if err != nil {
+		return nil, err
+	}
+	current := currentData.Conf
+	if policyData.Conf.Equal(current) {
+		return &netmanage.ApprovalDecision{Approved: true}, nil
+	}
+	log.Lvl2("The policy changes the admins or the thresholds")
+	signedBuf, err := policyData.ConfChangeBytes(current)
+	if err != nil {
+		return nil, err
+	}
+	return s.approve(current, signedBuf, signatures, nil)
+}
+
+//the policy data whose conf approves policyData: the one of the latest block once the chain has a genesis block,
+//itself for the genesis policy of a new chain. A policy without parent cannot bring its own conf to an existing chain
+func (s *Service) currentData(policyData *netmanage.PolicyData) (*netmanage.PolicyData, error) {
+	if genesis, _ := s.chainIDs(); len(genesis) == 0 && len(policyData.ParentID) == 0 {
+		return policyData, nil
+	}
+	latest, cerr := s.latestPolicy()
+	if cerr != nil {
+		return nil, cerr
+	}
+	if latest.PolicyData == nil || latest.PolicyData.Policy == nil || latest.PolicyData.Conf == nil {
+		return nil, errors.New("the latest block has no policy or no conf")
+	}
+	return latest.PolicyData, nil
+}
+
+//check which admins of conf have a valid signature over signedBuf, and if they reach its thresholds and the ones of the scopes.
+//The admins may sign with any scheme netmanage.NewVerifier reads, but not with a revoked or expired key, and the
+//decision reports on every signature, the invalid ones included. The signatures are verified in parallel, see verify.go.
+func (s *Service) approve(conf *netmanage.Conf, signedBuf []byte, signatures []string, scopes []int) (*netmanage.ApprovalDecision, error) {
+	keys, err := s.keys.keys(conf)
+	if err != nil {
+		return nil, err
+	}
+	reports := make([]netmanage.SignatureReport, len(signatures))
+	now := time.Now()
+	parallel(len(signatures), func(i int) {
+		reports[i] = keys.check(signedBuf, signatures[i], now)
+	})
+
+	// Counting the valid signatures in their order, once per admin
+	approvers := make(map[string]int) // Index of the first valid signature of each admin, by key id
+	var approved []int
+	for i := range reports {
+		if reports[i].Valid {
+			if first, ok := approvers[reports[i].KeyID]; ok { // We need to check that this is a unique signature
+				reports[i].Valid = false
+				reports[i].Reason = fmt.Sprintf("the admin already signed in signature %d", first)
+			} else {
+				approvers[reports[i].KeyID] = i
+				approved = append(approved, keys.members[reports[i].KeyID])
 			}
 		}
+		log.Lvl2("Signature", i, reports[i])
 	}
 
-	log.Lvl3("Is release approved? ", len(approvers) >= policyData.Conf.Threshold)
+	decision := conf.DecideChange(approved, scopes)
+	decision.Signatures = reports
+	log.Lvl3("Is release approved? ", decision)
+	return decision, decision.Err()
+}
 
-	//fmt.Printf("approvers = %d threshold = %d approval is %t\n",len(approvers),policyData.Conf.Threshold, (len(approvers) >= policyData.Conf.Threshold))
+//the canonical signatures cover the parent block and the chain of the policy data: refuse the policy data
+//of a genesis that claims a chain, and the one signed for another chain or on top of another block than
+//the latest, like old signatures replayed to roll the chain back. Legacy signatures cover none of them.
+func (s *Service) checkBinding(policyData *netmanage.PolicyData) error {
+	if policyData.Encoding == netmanage.EncodingLegacy {
+		return errors.New("legacy signatures do not cover the parent block, sign the canonical encoding")
+	}
+	if len(policyData.ParentID) == 0 {
+		if len(policyData.ChainID) != 0 {
+			return errors.New("a policy signed for a chain has no parent block")
+		}
+		return nil
+	}
+	genesis, latest := s.chainIDs()
+	if !bytes.Equal(policyData.ChainID, genesis) {
+		return fmt.Errorf("the policy was signed for chain %x, not %x", []byte(policyData.ChainID), []byte(genesis))
+	}
+	if !bytes.Equal(policyData.ParentID, latest) {
+		return fmt.Errorf("the policy was signed on top of block %x, the latest is %x", []byte(policyData.ParentID), []byte(latest))
+	}
+	return nil
+}
 
-	return len(approvers) >= policyData.Conf.Threshold, err
+//the IDs of the genesis and of the latest block of the policy chain
+func (s *Service) chainIDs() (genesis, latest skipchain.SkipBlockID) {
+	s.Storage.genesisMutex.Lock()
+	if s.Storage.GenesisPolicy != nil {
+		genesis = s.Storage.GenesisPolicy.Hash
+	}
+	s.Storage.genesisMutex.Unlock()
+	s.Storage.latestMutex.Lock()
+	if s.Storage.LatestPolicy != nil {
+		latest = s.Storage.LatestPolicy.Hash
+	}
+	s.Storage.latestMutex.Unlock()
+	return genesis, latest
 }
 
 func (s *Service) cosiSign(r *onet.Roster, msg []byte) (*cosisign.SignatureResponse, error) {
@@ -284,12 +477,13 @@ func (s *Service) cosiVerify(r *onet.Roster, msg []byte, cosiSig *cosisign.Signa
 
 //Cosi PolicyData, return CosiPolicy
 //TO DO: first verify the threshold ...................
-//marshal PolicyData struct into byte, then cosi the buf, and save the sig into one CosiPolicy with the PolicyData
-func (s *Service) SignPolicyData(r *onet.Roster, policyData *netmanage.PolicyData) (*netmanage.CosiPolicy, onet.ClientError) {
+//cosi the PolicyData with the key IDs of the admins who approved it and its conf, and save the sig into one CosiPolicy
+func (s *Service) SignPolicyData(r *onet.Roster, policyData *netmanage.PolicyData, approvers, confApprovers []string) (*netmanage.CosiPolicy, onet.ClientError) {
 	//validate the policyData, check all if the signatures reach the threshold
 
 	//sign this policyData to cosiPolicy
-	buf, err := network.Marshal(policyData)
+	cosiPolicy := &netmanage.CosiPolicy{PolicyData: policyData, Approvers: approvers, ConfApprovers: confApprovers}
+	buf, err := cosiPolicy.CosiBytes()
 	if err != nil {
 		log.Error(err)
 		return nil, onet.NewClientErrorCode(ErrorSignPolicy, err.Error())
@@ -300,29 +494,98 @@ func (s *Service) SignPolicyData(r *onet.Roster, policyData *netmanage.PolicyDat
 		log.Error(err)
 		return nil, onet.NewClientErrorCode(ErrorSignPolicy, err.Error())
 	}
-	cosiPolicy := &netmanage.CosiPolicy{PolicyData: policyData, CoSignature: coSignature}
+	cosiPolicy.CoSignature = coSignature
 	return cosiPolicy, nil
 }
 
-//given the latest known blockID, return data in the latest Policy block
+//given the latest known blockID, return data in the latest Policy block, with the rules in effect at req.At
 func (s *Service) GetPolicyRequest(req *netmanage.GetPolicyRequest) (*netmanage.GetPolicyResponse, onet.ClientError) {
-	if s.Storage.LatestPolicy == nil {
-		fmt.Printf("service GetPolicyRequest 00000 s.Storage.LatestPolicy is nil\n")
+	at, cerr := requestTime(req.At)
+	if cerr != nil {
+		return nil, cerr
 	}
+	data, cerr := s.latestPolicy()
+	if cerr != nil {
+		return nil, cerr
+	}
+	resp := &netmanage.GetPolicyResponse{CosiPolicy: data, Expired: data.PolicyData.ExpiredAt(at)}
+	if resp.Expired {
+		log.Lvl2("The latest policy has expired at", data.PolicyData.Expiry)
+		return resp, nil
+	}
+	active, err := data.PolicyData.Policy.ActiveAt(at)
+	if err != nil {
+		return nil, onet.NewClientErrorCode(ErrorGetPolicy, err.Error())
+	}
+	resp.Active = active
+	return resp, nil
+}
 
-	_, msg, merr := network.Unmarshal(s.Storage.LatestPolicy.Data)
-	if merr != nil {
-		log.ErrFatal(merr)
-		return nil, onet.NewClientErrorCode(ErrorGetPolicy, merr.Error())
+//list the rules of the latest policy ending within req.Within, so that admins can prepare the next policy in time
+func (s *Service) ExpiringRulesRequest(req *netmanage.ExpiringRulesRequest) (*netmanage.ExpiringRulesResponse, onet.ClientError) {
+	within := defaultExpiringWithin
+	if req.Within != "" {
+		var err error
+		if within, err = time.ParseDuration(req.Within); err != nil || within < 0 {
+			return nil, onet.NewClientErrorCode(ErrorGetPolicy, fmt.Sprintf("invalid duration %q", req.Within))
+		}
+	}
+	data, cerr := s.latestPolicy()
+	if cerr != nil {
+		return nil, cerr
+	}
+	now := time.Now()
+	rules, err := data.PolicyData.Policy.ExpiringRules(now, now.Add(within))
+	if err != nil {
+		return nil, onet.NewClientErrorCode(ErrorGetPolicy, err.Error())
+	}
+	s.Storage.latestMutex.Lock()
+	resp := &netmanage.ExpiringRulesResponse{BlockID: s.Storage.LatestPolicy.Hash, Rules: rules}
+	s.Storage.latestMutex.Unlock()
+	if expiry, err := data.PolicyData.ExpiryTime(); err == nil && !expiry.IsZero() && !expiry.After(now.Add(within)) {
+		resp.Expiry = data.PolicyData.Expiry
 	}
-	data := msg.(*netmanage.CosiPolicy)
-	return &netmanage.GetPolicyResponse{data}, nil
+	return resp, nil
+}
+
+//how far ahead ExpiringRulesRequest looks by default
+const defaultExpiringWithin = 24 * time.Hour
+
+//read an RFC3339 time of a request, empty is now
+func requestTime(s string) (time.Time, onet.ClientError) {
+	if s == "" {
+		return time.Now(), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, onet.NewClientErrorCode(ErrorGetPolicy, fmt.Sprintf("invalid time %q, use RFC3339", s))
+	}
+	return t, nil
+}
+
+//the policy stored in the latest block of the chain
+func (s *Service) latestPolicy() (*netmanage.CosiPolicy, onet.ClientError) {
+	s.Storage.latestMutex.Lock()
+	defer s.Storage.latestMutex.Unlock()
+	if s.Storage.LatestPolicy == nil || len(s.Storage.LatestPolicy.Data) == 0 {
+		return nil, onet.NewClientErrorCode(ErrorGetPolicy, "There is no policy chain yet")
+	}
+	_, msg, err := network.Unmarshal(s.Storage.LatestPolicy.Data)
+	if err != nil {
+		return nil, onet.NewClientErrorCode(ErrorGetPolicy, err.Error())
+	}
+	data, ok := msg.(*netmanage.CosiPolicy)
+	if !ok {
+		return nil, onet.NewClientErrorCode(ErrorGetPolicy, "The latest block does not hold a policy")
+	}
+	return data, nil
 }
 
 //Verify CosiPolicy
 //given a CosiPolicy struct, verify if the cosig in it is the correct one for its PolicyData
 func (s *Service) VerifyPolicyRequest(req *netmanage.VerifyPolicyRequest) (*netmanage.VerifyPolicyResponse, onet.ClientError) {
-	buf, err := network.Marshal(req.Policy.PolicyData)
+	//blocks signed before the canonical encoding are still verified over their legacy bytes
+	buf, err := req.Policy.CosiBytes()
 	if err != nil {
 		log.Error(err)
 		return &netmanage.VerifyPolicyResponse{false}, onet.NewClientErrorCode(ErrorVerifyPolicy, err.Error())
@@ -343,12 +606,15 @@ func newService(c *onet.Context) onet.Service {
 		ServiceProcessor: onet.NewServiceProcessor(c),
 		skipchainClient:  skipchain.NewClient(),
 		cosiClient:       cosisign.NewClient(),
+		ProposalTTL:      defaultProposalTTL,
 		Storage: &Storage{
 			GenesisPolicy: skipchain.NewSkipBlock(),
 			LatestPolicy:  skipchain.NewSkipBlock(),
 		},
 	}
-	if err := s.RegisterHandlers(s.GenesisPolicyRequest, s.NewPolicyRequest, s.GetPolicyRequest, s.VerifyPolicyRequest); err != nil {
+	if err := s.RegisterHandlers(s.GenesisPolicyRequest, s.NewPolicyRequest, s.GetPolicyRequest, s.VerifyPolicyRequest,
+		s.ExpiringRulesRequest, s.SubmitProposalRequest, s.AddSignatureRequest, s.ListProposalsRequest,
+		s.GetProposalRequest, s.AppendProposalRequest, s.RevokeKeyRequest); err != nil {
 		log.ErrFatal(err, "Couldn't register messages")
 	}
 	if err := s.tryLoad(); err != nil {
@@ -377,62 +643,41 @@ func (s *Service) tryLoad() error {
 	return nil
 }
 
-//==========================================================just for service test=================================
-
-//for test, write the policy into a file
-func (s *Service) WritePolicyFile(policy *netmanage.CosiPolicy, pullPolicyFile string) error {
-	//transform policy into JSON and write into file pullPolicyFile
-	buf, err := json.Marshal(policy.PolicyData.Policy)
-	if err != nil {
-		fmt.Println("error:", err)
-		return err
+//save the storage with the pending proposals, a service without a context like the ones of the tests keeps it in memory
+func (s *Service) save() {
+	if s.ServiceProcessor == nil {
+		return
 	}
-	pubwr := new(bytes.Buffer)
-	_, err = pubwr.Write(buf)
-	if err := ioutil.WriteFile(pullPolicyFile, pubwr.Bytes(), 0660); err != nil {
-		return err
+	if err := s.Save(storageID, s.Storage); err != nil {
+		log.Error("Couldn't save the storage:", err)
 	}
-	pubwr.Reset()
+}
 
-	return nil
+//==========================================================just for service test=================================
+
+//for test, write the policy into a file
+func (s *Service) WritePolicyFile(policy *netmanage.CosiPolicy, pullPolicyFile string, format netmanage.PolicyFormat) error {
+	return netmanage.WritePolicyFile(policy, pullPolicyFile, format)
 }
 
 func (s *Service) WriteLatestID(hashFile string) error {
-	//write the BlockID into a file for further test
-	pubwr := new(bytes.Buffer)
-	_, err := pubwr.WriteString("blockID = ")
-	_, err = pubwr.WriteString("\"")
-	hash := s.Storage.LatestPolicy.Hash
-	//_, err = pubwr.Write(s.Storage.LatestPolicy.Hash)
-	_, err = pubwr.WriteString(hex.EncodeToString(hash))
-	_, err = pubwr.WriteString("\"")
-	//fmt.Printf("WriteLatestID s.Storage.LatestPolicy.Hash = %s\n",string(s.Storage.LatestPolicy.Hash[:]))
-	//fmt.Printf("WriteLatestID hex hash = %s\n",hex.EncodeToString(hash))
-	if err := ioutil.WriteFile(hashFile, pubwr.Bytes(), 0660); err != nil {
+	//write the BlockID and the ID of its chain into a file for further test
+	genesis, latest := s.chainIDs()
+	err := netmanage.WriteHashFile(hashFile, latest, genesis)
+	if err != nil {
 		log.Errorf("Could not write BlockID to the file:", err)
 	}
-	pubwr.Reset()
 	return err
 }
 
 func GenerateAmdinFiles(policyFile, signaturesFile, configFile, privFile string, adminNum int) error {
-	//read the Policy json file, get a policy struct and turn it into bytes using network.Marshal, then we get the buf to be signed
-	policy, err := NetPolicyScanner(policyFile)
-	if err != nil {
+	//read the Policy json file first, so that a broken policy fails before generating the keys
+	if _, err := NetPolicyScanner(policyFile); err != nil {
 		fmt.Printf("NetPolicyScanner err \n")
 		log.Error(err)
 		return err
 	}
-	for _, msg := range []interface{}{
-		netmanage.Policy{},
-	} {
-		network.RegisterMessage(msg)
-	}
-	text, err := network.Marshal(policy)
-	if err != nil {
-		log.Error(err)
-		return err
-	}
+	var err error
 	var developers openpgp.EntityList
 
 	for i := 0; i < adminNum; i++ {
@@ -456,7 +701,7 @@ func GenerateAmdinFiles(policyFile, signaturesFile, configFile, privFile string,
 
 	fpub, _ := os.OpenFile(configFile, os.O_APPEND|os.O_WRONLY, 0660)
 	defer fpub.Close()
-	fpriv, _ := os.OpenFile(privFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0660)
+	fpriv, _ := os.OpenFile(privFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
 	defer fpriv.Close()
 	fpriv.WriteString("Entities = [\n")
 	//ÃÂ¥ÃÂ¾ÃÂªÃÂ§ÃÂÃÂ¯ÃÂ§ÃÂÃÂÃÂ¦ÃÂÃÂÃÂ¦ÃÂ¯ÃÂÃÂ¤ÃÂ¸ÃÂªdeveloperÃÂ§ÃÂÃÂÃÂ¥ÃÂÃÂ¬ÃÂ©ÃÂÃÂ¥ÃÂ¥ÃÂÃÂÃÂ¥ÃÂÃÂ¥fpub, ÃÂ§ÃÂÃÂÃÂ¦ÃÂÃÂÃÂ§ÃÂ§ÃÂÃÂ©ÃÂÃÂ¥ÃÂ¥ÃÂÃÂÃÂ¨ÃÂ¿ÃÂfpriv,
@@ -497,6 +742,17 @@ func GenerateAmdinFiles(policyFile, signaturesFile, configFile, privFile string,
 		privwr.Reset()
 		pubwr.Reset()
 	}
+	//the admins sign the genesis policy data, which covers the conf written above
+	data, err := netmanage.PolicyDataFromFiles(policyFile, configFile, "")
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	text, err := data.SigningBytes()
+	if err != nil {
+		log.Error(err)
+		return err
+	}
 	for _, entity := range developers {
 		//ÃÂ§ÃÂÃÂ¨ÃÂ¥ÃÂ®ÃÂÃÂ¤ÃÂ½ÃÂentityÃÂ§ÃÂÃÂÃÂ§ÃÂ§ÃÂÃÂ©ÃÂÃÂ¥sign textÃÂ¯ÃÂ¼ÃÂÃÂ¥ÃÂ­ÃÂÃÂ¥ÃÂÃÂ¨pubwrÃÂ©ÃÂÃÂÃÂ¯ÃÂ¼ÃÂÃÂ§ÃÂÃÂÃÂ¦ÃÂÃÂsignatures.txtÃÂ¦ÃÂÃÂÃÂ¤ÃÂ»ÃÂ¶
 		openpgp.ArmoredDetachSign(pubwr, entity, bytes.NewReader(text), nil)
@@ -515,13 +771,7 @@ func GenerateAmdinFiles(policyFile, signaturesFile, configFile, privFile string,
 //create a partial GenesisPolicyRequest struct from the files
 func GenerateGenesisPolicy(policyFile, signaturesFile, configFile string) (*netmanage.PolicyData, []string, error) {
 	//policyFile and configFile for policyData {Policy, Conf}
-	policy, err := NetPolicyScanner(policyFile)
-	if err != nil {
-		log.Error(err)
-		return nil, nil, err
-	}
-
-	conf, err := ConfScanner(configFile)
+	policyData, err := netmanage.PolicyDataFromFiles(policyFile, configFile, "")
 	if err != nil {
 		log.Error(err)
 		return nil, nil, err
@@ -533,22 +783,14 @@ func GenerateGenesisPolicy(policyFile, signaturesFile, configFile string) (*netm
 		log.Error(err)
 		return nil, nil, err
 	}
-	//fmt.Printf("GenerateGenesisPolicy policy%v\n",policy)
-	//fmt.Printf("GenerateGenesisPolicy conf pub0 = %s\n",conf.PubKeys[0])
-	//fmt.Printf("GenerateGenesisPolicy signatures%v\n",signatures)
-	return &netmanage.PolicyData{Policy: policy, Conf: conf}, signatures, nil
+	return policyData, signatures, nil
 }
 
-//create a partial NewPolicyRequest struct from the files
+//create a partial NewPolicyRequest struct from the files. The admins' signatures in signaturesFile are bound to the
+//parent block in HashFile
 func GenerateNewPolicy(policyFile, signaturesFile, configFile, HashFile string) (*netmanage.PolicyData, []string, skipchain.SkipBlockID, error) {
-	//policyFile and configFile for policyData {Policy, Conf}
-	policy, err := NetPolicyScanner(policyFile)
-	if err != nil {
-		log.Error(err)
-		return nil, nil, nil, err
-	}
-
-	conf, err := ConfScanner(configFile)
+	//policyFile and configFile for policyData {Policy, Conf}, HashFile for the parent block and the chain
+	policyData, err := netmanage.PolicyDataFromFiles(policyFile, configFile, HashFile)
 	if err != nil {
 		log.Error(err)
 		return nil, nil, nil, err
@@ -560,16 +802,5 @@ func GenerateNewPolicy(policyFile, signaturesFile, configFile, HashFile string)
 		log.Error(err)
 		return nil, nil, nil, err
 	}
-	//fmt.Printf("GenerateGenesisPolicy policy%v\n",policy)
-	//fmt.Printf("GenerateGenesisPolicy conf pub0 = %s\n",conf.PubKeys[0])
-	//fmt.Printf("GenerateGenesisPolicy signatures%v\n",signatures)
-
-	//parentIDFile for ParentBlockID skipchain.SkipBlockID
-	parentBlockID, err := HashScanner(HashFile)
-	if err != nil {
-		log.Error(err)
-		return nil, nil, nil, err
-	}
-	//fmt.Printf("NewPolicyRequest parentBlockID %s\n", string(parentBlockID[:]))
-	return &netmanage.PolicyData{Policy: policy, Conf: conf}, signatures, parentBlockID, nil
+	return policyData, signatures, policyData.ParentID, nil
 }
@@ -1,13 +1,23 @@
 package service
 
 import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"strings"
 	"testing"
+	"time"
 
 	"fmt"
-	//"github.com/dedis/cothority/skipchain"
+	"github.com/BurntSushi/toml"
+	"github.com/dedis/cothority/skipchain"
 	//cosi "github.com/dedis/cothority/cosi/service"
 	"github.com/dedis/netmanage"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/ssh"
 	"gopkg.in/dedis/onet.v1"
 	"gopkg.in/dedis/onet.v1/log"
 	"gopkg.in/dedis/onet.v1/network"
@@ -70,7 +80,10 @@ func TestService_All(t *testing.T) {
 
 	s.(*Service).WriteLatestID(hashFile1)
 
-	newdata, newsigs, parentID, err := GenerateNewPolicy(policyFile2, signaturesFile2, configFile2, hashFile1)
+	data2, err := netmanage.PolicyDataFromFiles(policyFile2, configFile, hashFile1)
+	log.ErrFatal(err)
+	log.ErrFatal(signPolicyFiles(data2, privFile, signaturesFile2))
+	newdata, newsigs, parentID, err := GenerateNewPolicy(policyFile2, signaturesFile2, configFile, hashFile1)
 	//fmt.Printf("22222222222 parentID %s\n", hex.EncodeToString(parentID))
 	respn, errn := s.(*Service).NewPolicyRequest(
 		&netmanage.NewPolicyRequest{Roster: roster, PolicyData: newdata, Signatures: newsigs, ParentBlockID: parentID})
@@ -99,10 +112,644 @@ func TestService_All(t *testing.T) {
 	fmt.Printf("3333333333 TestService_VerifyPolicy end\n")
 
 	pullPolicyFile := "latest_policy.json"
-	err = s.(*Service).WritePolicyFile(rstg, pullPolicyFile)
+	err = s.(*Service).WritePolicyFile(rstg, pullPolicyFile, netmanage.FormatJSON)
 	assert.Equal(t, err, nil)
 }
 
+func TestService_InvalidPolicy(t *testing.T) {
+	local := onet.NewTCPTest()
+	hosts, roster, _ := local.GenTree(2, true)
+	defer local.CloseAll()
+
+	services := local.GetServices(hosts, netManageID)
+	s := services[0].(*Service)
+
+	policy := &netmanage.Policy{Description: "typo", Num: 1, Rules: []netmanage.Rule{
+		{Match: &netmanage.Match{Chain: "INPUT", Protocol: "TPC", Src: "ALL", Sports: "ALL", Dest: "ALL", Dports: "99999"}, Action: "DROP"},
+	}}
+	data := &netmanage.PolicyData{Policy: policy, Conf: &netmanage.Conf{Threshold: 1}}
+
+	_, err := s.GenesisPolicyRequest(
+		&netmanage.GenesisPolicyRequest{Roster: roster, PolicyData: data, BaseH: 2, MaxH: 2})
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrorInvalidPolicy, err.ErrorCode())
+
+	_, err = s.NewPolicyRequest(
+		&netmanage.NewPolicyRequest{Roster: roster, PolicyData: data, ParentBlockID: []byte{1}})
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrorInvalidPolicy, err.ErrorCode())
+
+	// a reference to a group the policy does not define
+	data.Policy = &netmanage.Policy{Description: "missing group", Num: 1, Rules: []netmanage.Rule{
+		{Match: &netmanage.Match{Chain: "INPUT", Service: "ssh", Src: "@admins", Sports: "ALL", Dest: "ALL"}, Action: "ACCEPT"},
+	}}
+	_, err = s.NewPolicyRequest(
+		&netmanage.NewPolicyRequest{Roster: roster, PolicyData: data, ParentBlockID: []byte{1}})
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrorInvalidPolicy, err.ErrorCode())
+}
+
+func TestService_AnalyzePolicies(t *testing.T) {
+	local := onet.NewTCPTest()
+	hosts, roster, _ := local.GenTree(2, true)
+	defer local.CloseAll()
+
+	services := local.GetServices(hosts, netManageID)
+	s := services[0].(*Service)
+
+	policy := &netmanage.Policy{Description: "shadowed drop", Num: 2, Rules: []netmanage.Rule{
+		{Match: &netmanage.Match{Chain: "INPUT", Protocol: "ALL", Src: "ALL", Sports: "ALL", Dest: "ALL", Dports: "ALL"}, Action: "ACCEPT"},
+		{Match: &netmanage.Match{Chain: "INPUT", Protocol: "TCP", Src: "ALL", Sports: "ALL", Dest: "ALL", Dports: "23"}, Action: "DROP"},
+	}}
+	data := &netmanage.PolicyData{Policy: policy, Conf: &netmanage.Conf{Threshold: 1}}
+	req := &netmanage.NewPolicyRequest{Roster: roster, PolicyData: data, ParentBlockID: []byte{1}}
+
+	// without the gate, the request goes on to the approval check
+	resp, err := s.NewPolicyRequest(req)
+	assert.Nil(t, resp)
+	if err != nil {
+		assert.NotEqual(t, ErrorPolicyAnalysis, err.ErrorCode())
+	}
+
+	s.AnalyzePolicies = true
+	_, err = s.NewPolicyRequest(req)
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrorPolicyAnalysis, err.ErrorCode())
+}
+
+func TestService_ExpiringRules(t *testing.T) {
+	now := time.Now().UTC()
+	policy := &netmanage.Policy{Description: "vendor vpn", Num: 2, Rules: []netmanage.Rule{
+		{Match: &netmanage.Match{Chain: "INPUT", Protocol: "UDP", Src: "198.51.100.7", Sports: "ALL", Dest: "ALL", Dports: "1194"},
+			Action: "ACCEPT", NotAfter: now.Add(48 * time.Hour).Format(time.RFC3339)},
+		{Match: &netmanage.Match{Chain: "INPUT", Protocol: "TCP", Src: "10.0.0.0/8", Sports: "ALL", Dest: "ALL", Dports: "22"},
+			Action: "ACCEPT"},
+	}}
+	data := &netmanage.PolicyData{Policy: policy, Conf: &netmanage.Conf{Threshold: 1},
+		Expiry: now.Add(7 * 24 * time.Hour).Format(time.RFC3339)}
+	block := skipchain.NewSkipBlock()
+	block.Hash = []byte{1}
+	var err error
+	block.Data, err = network.Marshal(&netmanage.CosiPolicy{PolicyData: data})
+	log.ErrFatal(err)
+	s := &Service{Storage: &Storage{LatestPolicy: block}}
+
+	resp, cerr := s.ExpiringRulesRequest(&netmanage.ExpiringRulesRequest{Within: "72h"})
+	assert.Nil(t, cerr)
+	assert.Len(t, resp.Rules, 1)
+	assert.Equal(t, 0, resp.Rules[0].Index)
+	assert.Empty(t, resp.Expiry)
+	resp, cerr = s.ExpiringRulesRequest(&netmanage.ExpiringRulesRequest{})
+	assert.Nil(t, cerr)
+	assert.Empty(t, resp.Rules)
+	resp, cerr = s.ExpiringRulesRequest(&netmanage.ExpiringRulesRequest{Within: "30d"})
+	assert.NotNil(t, cerr)
+
+	latest, cerr := s.GetPolicyRequest(&netmanage.GetPolicyRequest{At: now.Add(72 * time.Hour).Format(time.RFC3339)})
+	assert.Nil(t, cerr)
+	assert.False(t, latest.Expired)
+	assert.Equal(t, 2, latest.CosiPolicy.PolicyData.Policy.Num)
+	assert.Equal(t, 1, latest.Active.Num)
+	assert.Equal(t, "22", latest.Active.Rules[0].Match.Dports)
+
+	latest, cerr = s.GetPolicyRequest(&netmanage.GetPolicyRequest{At: now.Add(8 * 24 * time.Hour).Format(time.RFC3339)})
+	assert.Nil(t, cerr)
+	assert.True(t, latest.Expired)
+	assert.Nil(t, latest.Active)
+
+	// an expired policy is refused
+	data.Expiry = now.Add(-time.Hour).Format(time.RFC3339)
+	assert.Equal(t, ErrorInvalidPolicy, checkPolicyData(data).ErrorCode())
+}
+
+//admins with their conf, for the approval tests
+func testAdmins(n, threshold int) ([]*openpgp.Entity, *netmanage.Conf) {
+	conf := &netmanage.Conf{Threshold: threshold}
+	var admins []*openpgp.Entity
+	for i := 0; i < n; i++ {
+		admin, err := openpgp.NewEntity(fmt.Sprint(i), "", "", nil)
+		log.ErrFatal(err)
+		pub := new(bytes.Buffer)
+		w, err := armor.Encode(pub, openpgp.PublicKeyType, nil)
+		log.ErrFatal(err)
+		log.ErrFatal(admin.Serialize(w))
+		w.Close()
+		admins = append(admins, admin)
+		conf.PubKeys = append(conf.PubKeys, pub.String())
+	}
+	return admins, conf
+}
+
+//the admins' detached signatures over text
+func testSign(text []byte, admins ...*openpgp.Entity) []string {
+	var sigs []string
+	for _, admin := range admins {
+		sig := new(bytes.Buffer)
+		log.ErrFatal(openpgp.ArmoredDetachSign(sig, admin, bytes.NewReader(text), nil))
+		sigs = append(sigs, sig.String())
+	}
+	return sigs
+}
+
+//a service whose chain has a genesis block with ID 1 holding data, and a latest block with ID 3 holding latest
+//simulate the admins whose private keys GenerateAmdinFiles wrote into privFile signing the policy data into signaturesFile
+func signPolicyFiles(policyData *netmanage.PolicyData, privFile, signaturesFile string) error {
+	var ring struct {
+		Entities []string
+	}
+	if _, err := toml.DecodeFile(privFile, &ring); err != nil {
+		return err
+	}
+	text, err := policyData.SigningBytes()
+	if err != nil {
+		return err
+	}
+	sigs := new(bytes.Buffer)
+	for _, armored := range ring.Entities {
+		entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+		if err != nil {
+			return err
+		}
+		for _, entity := range entities {
+			if err := openpgp.ArmoredDetachSign(sigs, entity, bytes.NewReader(text), nil); err != nil {
+				return err
+			}
+			sigs.WriteByte('\n')
+		}
+	}
+	return ioutil.WriteFile(signaturesFile, sigs.Bytes(), 0660)
+}
+
+func testChain(data, latest *netmanage.PolicyData) *Service {
+	genesis, block := skipchain.NewSkipBlock(), skipchain.NewSkipBlock()
+	genesis.Hash, block.Hash = []byte{1}, []byte{3}
+	var err error
+	genesis.Data, err = network.Marshal(&netmanage.CosiPolicy{PolicyData: data})
+	log.ErrFatal(err)
+	block.Data, err = network.Marshal(&netmanage.CosiPolicy{PolicyData: latest})
+	log.ErrFatal(err)
+	return &Service{Storage: &Storage{GenesisPolicy: genesis, LatestPolicy: block}}
+}
+
+func TestService_ApprovalCheckBinding(t *testing.T) {
+	admins, conf := testAdmins(1, 1)
+	policy, err := NetPolicyScanner("../netPolicy1.json")
+	log.ErrFatal(err)
+	sign := func(data *netmanage.PolicyData) string {
+		text, err := data.SigningBytes()
+		log.ErrFatal(err)
+		return testSign(text, admins[0])[0]
+	}
+	bound := func(parentID, chainID skipchain.SkipBlockID) *netmanage.PolicyData {
+		return &netmanage.PolicyData{Policy: policy, Conf: conf, Encoding: netmanage.EncodingCanonicalV1,
+			ParentID: parentID, ChainID: chainID, Nonce: "42"}
+	}
+	genesis, parent, latest := []byte{1}, []byte{2}, []byte{3}
+	s := testChain(bound(nil, nil), bound(parent, genesis))
+
+	data := bound(nil, nil)
+	decision, err := s.ApprovalCheck(data, []string{sign(data)})
+	assert.Nil(t, err)
+	assert.True(t, decision.Approved)
+	data = bound(latest, genesis)
+	decision, err = s.ApprovalCheck(data, []string{sign(data)})
+	assert.Nil(t, err)
+	assert.True(t, decision.Approved)
+
+	// signatures collected for an older block cannot roll the chain back
+	data = bound(parent, genesis)
+	_, err = s.ApprovalCheck(data, []string{sign(data)})
+	assert.NotNil(t, err)
+	// nor be used on another chain
+	data = bound(latest, []byte{9})
+	_, err = s.ApprovalCheck(data, []string{sign(data)})
+	assert.NotNil(t, err)
+	// and moving them to the latest block breaks them
+	sig := sign(bound(parent, genesis))
+	_, err = s.ApprovalCheck(bound(latest, genesis), []string{sig})
+	assert.NotNil(t, err)
+	// so does attaching them to another conf or another nonce
+	sig = sign(bound(latest, genesis))
+	data = bound(latest, genesis)
+	data.Conf = &netmanage.Conf{Threshold: 1, PubKeys: []string{conf.PubKeys[0], conf.PubKeys[0]}}
+	_, err = s.ApprovalCheck(data, []string{sig})
+	assert.NotNil(t, err)
+	data = bound(latest, genesis)
+	data.Nonce = "43"
+	_, err = s.ApprovalCheck(data, []string{sig})
+	assert.NotNil(t, err)
+
+	// legacy signatures only cover the policy, they are refused for new requests
+	data = &netmanage.PolicyData{Policy: policy, Conf: conf}
+	_, err = s.ApprovalCheck(data, []string{sign(data)})
+	assert.NotNil(t, err)
+}
+
+func TestService_Takeover(t *testing.T) {
+	admins, conf := testAdmins(3, 2)
+	attackers, attackerConf := testAdmins(1, 1)
+	policy, err := NetPolicyScanner("../netPolicy1.json")
+	log.ErrFatal(err)
+	current := &netmanage.PolicyData{Policy: policy, Conf: conf, Encoding: netmanage.EncodingCanonicalV1}
+	s := testChain(current, current)
+	next := func(conf *netmanage.Conf) *netmanage.PolicyData {
+		return &netmanage.PolicyData{Policy: policy, Conf: conf, Encoding: netmanage.EncodingCanonicalV1,
+			ParentID: []byte{3}, ChainID: []byte{1}}
+	}
+	signPolicy := func(data *netmanage.PolicyData, signers ...*openpgp.Entity) []string {
+		text, err := data.SigningBytes()
+		log.ErrFatal(err)
+		return testSign(text, signers...)
+	}
+	signChange := func(data *netmanage.PolicyData, signers ...*openpgp.Entity) []string {
+		text, err := data.ConfChangeBytes(conf)
+		log.ErrFatal(err)
+		return testSign(text, signers...)
+	}
+	request := func(data *netmanage.PolicyData, sigs, confSigs []string) onet.ClientError {
+		_, cerr := s.NewPolicyRequest(&netmanage.NewPolicyRequest{Roster: &onet.Roster{}, PolicyData: data,
+			Signatures: sigs, ConfSignatures: confSigs, ParentBlockID: data.ParentID})
+		return cerr
+	}
+
+	// an outsider starting the chain over with their own key and threshold
+	genesis := &netmanage.PolicyData{Policy: policy, Conf: attackerConf, Encoding: netmanage.EncodingCanonicalV1}
+	_, cerr := s.GenesisPolicyRequest(&netmanage.GenesisPolicyRequest{Roster: &onet.Roster{}, PolicyData: genesis,
+		BaseH: 2, MaxH: 2, Signatures: signPolicy(genesis, attackers[0])})
+	assert.NotNil(t, cerr)
+	assert.Equal(t, ErrorGenesisPolicy, cerr.ErrorCode())
+	genesisID, latestID := s.chainIDs()
+	assert.Equal(t, []byte{1}, []byte(genesisID))
+	assert.Equal(t, []byte{3}, []byte(latestID))
+
+	// an outsider appending a policy without parent, approved by its own conf
+	_, cerr = s.NewPolicyRequest(&netmanage.NewPolicyRequest{Roster: &onet.Roster{}, PolicyData: genesis,
+		Signatures: signPolicy(genesis, attackers[0]), ParentBlockID: []byte{}})
+	assert.NotNil(t, cerr)
+	assert.Equal(t, ErrorNewPolicy, cerr.ErrorCode())
+	_, err = s.ApprovalCheck(genesis, signPolicy(genesis, attackers[0]))
+	assert.NotNil(t, err)
+
+	// an outsider appending a policy with their own key and threshold
+	data := next(attackerConf)
+	cerr = request(data, signPolicy(data, attackers[0]), signChange(data, attackers[0]))
+	assert.NotNil(t, cerr)
+	assert.Equal(t, ErrorApproval, cerr.ErrorCode())
+
+	// one current admin is not enough, and the refusal says why
+	data = next(conf)
+	cerr = request(data, signPolicy(data, admins[0], admins[0]), nil)
+	assert.NotNil(t, cerr)
+	assert.Equal(t, ErrorApproval, cerr.ErrorCode())
+	assert.Contains(t, cerr.Error(), "overall: 1 of 2, failed")
+
+	// admins approving a policy that slips in a new admin do not approve the new admin
+	data = next(&netmanage.Conf{Threshold: 1, PubKeys: append(conf.PubKeys, attackerConf.PubKeys...)})
+	sigs := signPolicy(data, admins[0], admins[1])
+	cerr = request(data, sigs, nil)
+	assert.NotNil(t, cerr)
+	assert.Equal(t, ErrorApproval, cerr.ErrorCode())
+	decision, err := s.ApprovalCheck(data, sigs)
+	assert.Nil(t, err)
+	assert.True(t, decision.Approved)
+	_, err = s.ConfChangeCheck(data, signChange(data, admins[0], attackers[0]))
+	assert.NotNil(t, err)
+	decision, err = s.ConfChangeCheck(data, signChange(data, admins[0], admins[2]))
+	assert.Nil(t, err)
+	assert.True(t, decision.Approved)
+	// the signatures of the policy do not approve the change
+	_, err = s.ConfChangeCheck(data, sigs)
+	assert.NotNil(t, err)
+
+	// reordering the keys is no change
+	decision, err = s.ConfChangeCheck(next(&netmanage.Conf{Threshold: 2,
+		PubKeys: []string{conf.PubKeys[2], conf.PubKeys[0], conf.PubKeys[1]}}), nil)
+	assert.Nil(t, err)
+	assert.True(t, decision.Approved)
+
+	// a threshold of 0 is refused before any signature
+	data = next(&netmanage.Conf{Threshold: 0, PubKeys: conf.PubKeys})
+	cerr = request(data, nil, nil)
+	assert.NotNil(t, cerr)
+	assert.Equal(t, ErrorInvalidPolicy, cerr.ErrorCode())
+}
+
+func TestService_ApprovalRoles(t *testing.T) {
+	admins, flat := testAdmins(3, 1)
+	// admin 0 is the security team, the others network engineers counting 1 together
+	conf := &netmanage.Conf{Threshold: 2, Admins: []netmanage.Admin{
+		{PubKey: flat.PubKeys[0], Weight: 2, Roles: []string{"security"}},
+		{PubKey: flat.PubKeys[1], Weight: 1, Roles: []string{"network"}},
+		{PubKey: flat.PubKeys[2], Weight: 1, Roles: []string{"network"}},
+	}, Rules: []netmanage.ApprovalRule{{Role: "security", Threshold: 1}}}
+	policy, err := NetPolicyScanner("../netPolicy1.json")
+	log.ErrFatal(err)
+	data := &netmanage.PolicyData{Policy: policy, Conf: conf, Encoding: netmanage.EncodingCanonicalV1}
+	text, err := data.SigningBytes()
+	log.ErrFatal(err)
+	s := &Service{Storage: &Storage{}}
+
+	decision, err := s.ApprovalCheck(data, testSign(text, admins[0]))
+	assert.Nil(t, err)
+	assert.Equal(t, "overall: 2 of 2, passed; role security: 2 of 1, passed", decision.String())
+	// the network engineers reach the overall threshold, security vetoes
+	decision, err = s.ApprovalCheck(data, testSign(text, admins[1], admins[2]))
+	assert.NotNil(t, err)
+	assert.False(t, decision.Approved)
+	assert.Equal(t, "overall: 2 of 2, passed; role security: 0 of 1, failed", decision.String())
+}
+
+func TestService_ApprovalScopes(t *testing.T) {
+	admins, flat := testAdmins(2, 1)
+	// any admin approves, but opening INPUT needs the security team
+	conf := &netmanage.Conf{Threshold: 1, Admins: []netmanage.Admin{
+		{PubKey: flat.PubKeys[0], Roles: []string{"security"}},
+		{PubKey: flat.PubKeys[1], Roles: []string{"network"}},
+	}, Scopes: []netmanage.ApprovalScope{{Name: "input-open", Chain: "INPUT", Action: "ACCEPT", Role: "security", Threshold: 1}}}
+	current, err := NetPolicyScanner("../netPolicy1.json")
+	log.ErrFatal(err)
+	genesis := &netmanage.PolicyData{Policy: current, Conf: conf, Encoding: netmanage.EncodingCanonicalV1}
+	s := testChain(genesis, genesis)
+	proposed := func(rule netmanage.Rule) (*netmanage.PolicyData, []byte) {
+		policy, err := NetPolicyScanner("../netPolicy1.json")
+		log.ErrFatal(err)
+		policy.Rules = append([]netmanage.Rule{rule}, policy.Rules...)
+		policy.Num = len(policy.Rules)
+		data := &netmanage.PolicyData{Policy: policy, Conf: conf, Encoding: netmanage.EncodingCanonicalV1,
+			ParentID: []byte{3}, ChainID: []byte{1}}
+		text, err := data.SigningBytes()
+		log.ErrFatal(err)
+		return data, text
+	}
+
+	data, text := proposed(netmanage.Rule{Match: &netmanage.Match{Chain: "OUTPUT", Protocol: "UDP", Src: "ALL", Sports: "ALL",
+		Dest: "ALL", Dports: "53"}, Action: "ACCEPT"})
+	decision, err := s.ApprovalCheck(data, testSign(text, admins[1]))
+	assert.Nil(t, err)
+	assert.Equal(t, "overall: 1 of 1, passed", decision.String())
+
+	data, text = proposed(netmanage.Rule{Match: &netmanage.Match{Chain: "INPUT", Protocol: "TCP", Src: "ALL", Sports: "ALL",
+		Dest: "ALL", Dports: "22"}, Action: "ACCEPT"})
+	decision, err = s.ApprovalCheck(data, testSign(text, admins[1]))
+	assert.NotNil(t, err)
+	assert.Equal(t, "overall: 1 of 1, passed; scope input-open: 0 of 1, failed", decision.String())
+	decision, err = s.ApprovalCheck(data, testSign(text, admins[0]))
+	assert.Nil(t, err)
+	assert.True(t, decision.Approved)
+}
+
+func TestService_ApprovalReport(t *testing.T) {
+	admins, conf := testAdmins(3, 1)
+	stranger, _ := testAdmins(1, 1)
+	policy, err := NetPolicyScanner("../netPolicy1.json")
+	log.ErrFatal(err)
+	data := &netmanage.PolicyData{Policy: policy, Conf: conf, Encoding: netmanage.EncodingCanonicalV1}
+	text, err := data.SigningBytes()
+	log.ErrFatal(err)
+	s := &Service{Storage: &Storage{}}
+
+	signatures := append(testSign(text, admins[0], admins[0], stranger[0]), testSign([]byte("other"), admins[1])...)
+	decision, err := s.ApprovalCheck(data, append(signatures, "not a signature"))
+	assert.Nil(t, err)
+	alice := admins[0].PrimaryKey.KeyIdString()
+	assert.Equal(t, []string{alice}, decision.Approvers())
+	if assert.Len(t, decision.Signatures, 5) {
+		assert.Equal(t, netmanage.SignatureReport{KeyID: alice, Identity: "0", Valid: true}, decision.Signatures[0])
+		assert.Equal(t, "invalid from "+alice+" (0): the admin already signed in signature 0", decision.Signatures[1].String())
+		assert.Equal(t, "invalid from "+stranger[0].PrimaryKey.KeyIdString()+": the key is not one of the admins",
+			decision.Signatures[2].String())
+		assert.Equal(t, admins[1].PrimaryKey.KeyIdString(), decision.Signatures[3].KeyID)
+		assert.Equal(t, "1", decision.Signatures[3].Identity)
+		assert.False(t, decision.Signatures[3].Valid)
+		assert.Contains(t, decision.Signatures[3].Reason, "the signature does not match")
+		assert.Equal(t, "", decision.Signatures[4].KeyID)
+		assert.Contains(t, decision.Signatures[4].Reason, "unreadable signature")
+	}
+}
+
+func TestService_ApprovalSchemes(t *testing.T) {
+	pgpAdmins, _ := testAdmins(1, 1)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	log.ErrFatal(err)
+	_, sshKey, err := ed25519.GenerateKey(rand.Reader)
+	log.ErrFatal(err)
+	sshSigner, err := ssh.NewSignerFromKey(sshKey)
+	log.ErrFatal(err)
+	signers := []netmanage.Signer{netmanage.NewOpenPGPSigner(pgpAdmins[0]), netmanage.NewEd25519Signer(edKey, "bob"),
+		netmanage.NewSSHSigner(sshSigner, "carol")}
+	conf := &netmanage.Conf{Threshold: 3}
+	for _, signer := range signers {
+		pub, err := signer.PublicKey()
+		log.ErrFatal(err)
+		conf.PubKeys = append(conf.PubKeys, pub)
+	}
+	// bob's key written for SSH is still bob
+	bobSSH, err := ssh.NewSignerFromKey(edKey)
+	log.ErrFatal(err)
+	pub, err := netmanage.NewSSHSigner(bobSSH, "bob").PublicKey()
+	log.ErrFatal(err)
+	conf.PubKeys = append(conf.PubKeys, pub)
+
+	policy, err := NetPolicyScanner("../netPolicy1.json")
+	log.ErrFatal(err)
+	data := &netmanage.PolicyData{Policy: policy, Conf: conf, Encoding: netmanage.EncodingCanonicalV1}
+	text, err := data.SigningBytes()
+	log.ErrFatal(err)
+	sign := func(signers ...netmanage.Signer) []string {
+		var sigs []string
+		for _, signer := range signers {
+			sig, err := signer.Sign(text)
+			log.ErrFatal(err)
+			sigs = append(sigs, sig)
+		}
+		return sigs
+	}
+	s := &Service{Storage: &Storage{}}
+
+	decision, err := s.ApprovalCheck(data, sign(signers...))
+	assert.Nil(t, err)
+	assert.Equal(t, "overall: 3 of 3, passed", decision.String())
+	assert.Equal(t, "bob", decision.Signatures[1].Identity)
+	decision, err = s.ApprovalCheck(data, sign(signers[0], signers[1], netmanage.NewSSHSigner(bobSSH, "bob")))
+	assert.NotNil(t, err)
+	assert.Equal(t, "overall: 2 of 3, failed", decision.String())
+	assert.Contains(t, decision.Signatures[2].Reason, "already signed")
+}
+
+func TestService_Proposals(t *testing.T) {
+	admins, conf := testAdmins(3, 2)
+	policy, err := NetPolicyScanner("../netPolicy1.json")
+	log.ErrFatal(err)
+	genesis := &netmanage.PolicyData{Policy: policy, Conf: conf, Encoding: netmanage.EncodingCanonicalV1}
+	s := testChain(genesis, genesis)
+	data := &netmanage.PolicyData{Policy: policy, Conf: conf, Encoding: netmanage.EncodingCanonicalV1,
+		ParentID: []byte{3}, ChainID: []byte{1}, Nonce: "1"}
+	text, err := data.SigningBytes()
+	log.ErrFatal(err)
+
+	submitted, cerr := s.SubmitProposalRequest(&netmanage.SubmitProposalRequest{Roster: &onet.Roster{}, PolicyData: data})
+	assert.Nil(t, cerr)
+	id := submitted.Status.Proposal.ID
+	assert.Equal(t, "overall: 0 of 2, failed", submitted.Status.Decision.String())
+	// a proposal on top of another block could never be appended
+	stale := *data
+	stale.ParentID = []byte{2}
+	_, cerr = s.SubmitProposalRequest(&netmanage.SubmitProposalRequest{Roster: &onet.Roster{}, PolicyData: &stale})
+	assert.NotNil(t, cerr)
+
+	signed, cerr := s.AddSignatureRequest(&netmanage.AddSignatureRequest{ID: id, Signature: testSign(text, admins[0])[0]})
+	assert.Nil(t, cerr)
+	assert.Equal(t, "overall: 1 of 2, failed", signed.Status.Decision.String())
+	assert.Nil(t, signed.Status.BlockID)
+	for _, refused := range []*netmanage.AddSignatureRequest{
+		{ID: id, Signature: testSign(text, admins[0])[0]},
+		{ID: id, Signature: testSign([]byte("other"), admins[1])[0]},
+		// the conf does not change, there is nothing to sign for it
+		{ID: id, Signature: testSign(text, admins[1])[0], ConfChange: true},
+		{ID: "unknown", Signature: testSign(text, admins[1])[0]},
+	} {
+		_, cerr = s.AddSignatureRequest(refused)
+		assert.NotNil(t, cerr)
+	}
+
+	list, cerr := s.ListProposalsRequest(&netmanage.ListProposalsRequest{})
+	assert.Nil(t, cerr)
+	if assert.Len(t, list.Proposals, 1) {
+		assert.Len(t, list.Proposals[0].Proposal.Signatures, 1)
+	}
+	got, cerr := s.GetProposalRequest(&netmanage.GetProposalRequest{ID: id})
+	assert.Nil(t, cerr)
+	assert.Equal(t, "overall: 1 of 2, failed", got.Status.Decision.String())
+
+	// the proposal is dropped when it expires, and when another block is appended after its parent
+	s.Storage.Proposals[0].Expires = time.Now().Add(-time.Minute).Format(time.RFC3339)
+	_, cerr = s.GetProposalRequest(&netmanage.GetProposalRequest{ID: id})
+	assert.NotNil(t, cerr)
+	_, cerr = s.SubmitProposalRequest(&netmanage.SubmitProposalRequest{Roster: &onet.Roster{}, PolicyData: data})
+	assert.Nil(t, cerr)
+	s.Storage.LatestPolicy.Hash = []byte{4}
+	list, cerr = s.ListProposalsRequest(&netmanage.ListProposalsRequest{})
+	assert.Nil(t, cerr)
+	assert.Empty(t, list.Proposals)
+}
+
+func TestService_ProposalsTTL(t *testing.T) {
+	_, conf := testAdmins(1, 1)
+	policy, err := NetPolicyScanner("../netPolicy1.json")
+	log.ErrFatal(err)
+	genesis := &netmanage.PolicyData{Policy: policy, Conf: conf, Encoding: netmanage.EncodingCanonicalV1}
+	s := testChain(genesis, genesis)
+	data := &netmanage.PolicyData{Policy: policy, Conf: conf, Encoding: netmanage.EncodingCanonicalV1,
+		ParentID: []byte{3}, ChainID: []byte{1}}
+
+	// a week by default
+	submitted, cerr := s.SubmitProposalRequest(&netmanage.SubmitProposalRequest{Roster: &onet.Roster{}, PolicyData: data})
+	assert.Nil(t, cerr)
+	expires, err := time.Parse(time.RFC3339, submitted.Status.Proposal.Expires)
+	log.ErrFatal(err)
+	assert.WithinDuration(t, time.Now().Add(7*24*time.Hour), expires, time.Minute)
+
+	// the proposals of a service with a short ProposalTTL expire before anyone signs them
+	s = testChain(genesis, genesis)
+	s.ProposalTTL = time.Millisecond
+	submitted, cerr = s.SubmitProposalRequest(&netmanage.SubmitProposalRequest{Roster: &onet.Roster{}, PolicyData: data})
+	assert.Nil(t, cerr)
+	time.Sleep(10 * time.Millisecond)
+	_, cerr = s.GetProposalRequest(&netmanage.GetProposalRequest{ID: submitted.Status.Proposal.ID})
+	assert.NotNil(t, cerr)
+	list, cerr := s.ListProposalsRequest(&netmanage.ListProposalsRequest{})
+	assert.Nil(t, cerr)
+	assert.Empty(t, list.Proposals)
+}
+
+func TestService_ProposalsAppend(t *testing.T) {
+	admins, conf := testAdmins(3, 2)
+	policy, err := NetPolicyScanner("../netPolicy1.json")
+	log.ErrFatal(err)
+	genesis := &netmanage.PolicyData{Policy: policy, Conf: conf, Encoding: netmanage.EncodingCanonicalV1}
+	s := testChain(genesis, genesis)
+	data := &netmanage.PolicyData{Policy: policy, Conf: conf, Encoding: netmanage.EncodingCanonicalV1,
+		ParentID: []byte{3}, ChainID: []byte{1}, Nonce: "1"}
+	text, err := data.SigningBytes()
+	log.ErrFatal(err)
+	var appended []*netmanage.NewPolicyRequest
+	failing := func(req *netmanage.NewPolicyRequest) (*netmanage.NewPolicyResponse, onet.ClientError) {
+		appended = append(appended, req)
+		return nil, onet.NewClientErrorCode(ErrorNewPolicy, "the cosi failed")
+	}
+	s.newPolicy = failing
+
+	submitted, cerr := s.SubmitProposalRequest(&netmanage.SubmitProposalRequest{Roster: &onet.Roster{}, PolicyData: data})
+	assert.Nil(t, cerr)
+	id := submitted.Status.Proposal.ID
+	_, cerr = s.AddSignatureRequest(&netmanage.AddSignatureRequest{ID: id, Signature: testSign(text, admins[0])[0]})
+	assert.Nil(t, cerr)
+	assert.Empty(t, appended)
+
+	// the approving signature is kept when the append fails
+	_, cerr = s.AddSignatureRequest(&netmanage.AddSignatureRequest{ID: id, Signature: testSign(text, admins[1])[0]})
+	assert.NotNil(t, cerr)
+	if assert.Len(t, appended, 1) {
+		assert.Equal(t, data, appended[0].PolicyData)
+		assert.Equal(t, []byte(data.ParentID), []byte(appended[0].ParentBlockID))
+		assert.Len(t, appended[0].Signatures, 2)
+	}
+	got, cerr := s.GetProposalRequest(&netmanage.GetProposalRequest{ID: id})
+	assert.Nil(t, cerr)
+	assert.True(t, got.Status.Decision.Approved)
+
+	// the proposals survive a restart of the service, the roster of the test has no aggregate key to encode
+	s.Storage.Proposals[0].Roster = nil
+	buf, err := network.Marshal(s.Storage)
+	log.ErrFatal(err)
+	_, msg, err := network.Unmarshal(buf)
+	log.ErrFatal(err)
+	loaded, ok := msg.(*Storage)
+	if !assert.True(t, ok) {
+		return
+	}
+	s = &Service{Storage: loaded}
+	list, cerr := s.ListProposalsRequest(&netmanage.ListProposalsRequest{})
+	assert.Nil(t, cerr)
+	if assert.Len(t, list.Proposals, 1) {
+		assert.Equal(t, id, list.Proposals[0].Proposal.ID)
+		assert.Equal(t, data, list.Proposals[0].Proposal.PolicyData)
+		assert.Len(t, list.Proposals[0].Proposal.Signatures, 2)
+		assert.Equal(t, "overall: 2 of 2, passed", list.Proposals[0].Decision.String())
+	}
+
+	// a signature does not append the approved proposal again, only an explicit request does
+	s.newPolicy = failing
+	_, cerr = s.AddSignatureRequest(&netmanage.AddSignatureRequest{ID: id, Signature: testSign(text, admins[2])[0]})
+	assert.NotNil(t, cerr)
+	assert.Len(t, appended, 1)
+	_, cerr = s.AppendProposalRequest(&netmanage.AppendProposalRequest{ID: id})
+	assert.NotNil(t, cerr)
+	assert.Len(t, appended, 2)
+
+	// the proposals stay readable during the append, and the proposal is neither signed nor appended twice
+	s.newPolicy = func(req *netmanage.NewPolicyRequest) (*netmanage.NewPolicyResponse, onet.ClientError) {
+		appended = append(appended, req)
+		_, cerr := s.ListProposalsRequest(&netmanage.ListProposalsRequest{})
+		assert.Nil(t, cerr)
+		_, cerr = s.AppendProposalRequest(&netmanage.AppendProposalRequest{ID: id})
+		assert.NotNil(t, cerr)
+		_, cerr = s.AddSignatureRequest(&netmanage.AddSignatureRequest{ID: id, Signature: testSign(text, admins[2])[0]})
+		assert.NotNil(t, cerr)
+		s.Storage.LatestPolicy.Hash = []byte{4}
+		return &netmanage.NewPolicyResponse{BlockID: []byte{4}}, nil
+	}
+	resp, cerr := s.AppendProposalRequest(&netmanage.AppendProposalRequest{ID: id})
+	assert.Nil(t, cerr)
+	assert.Len(t, appended, 3)
+	assert.Equal(t, []byte{4}, []byte(resp.Status.BlockID))
+	assert.Len(t, resp.Status.Proposal.Signatures, 2)
+	assert.Empty(t, s.Storage.appending)
+	list, cerr = s.ListProposalsRequest(&netmanage.ListProposalsRequest{})
+	assert.Nil(t, cerr)
+	assert.Empty(t, list.Proposals)
+}
+
 /*
 func TestService_GenesisPolicyRequest(t *testing.T) {
 	local := onet.NewTCPTest()
@@ -173,7 +820,10 @@ func TestService_NewPolicyRequest(t *testing.T) {
 		s.(*Service).GenesisPolicyRequest(
 			&netmanage.GenesisPolicyRequest{Roster: roster, PolicyData: gdata, BaseH: 2, MaxH: 2, Signatures: gsigs})
 		s.(*Service).WriteLatestID(hashFile1)
-		newdata, newsigs, parentID, err := GenerateNewPolicy(policyFile2,signaturesFile2, configFile2, hashFile1)
+		data2, err := netmanage.PolicyDataFromFiles(policyFile2, configFile, hashFile1)
+		log.ErrFatal(err)
+		log.ErrFatal(signPolicyFiles(data2, privFile, signaturesFile2))
+		newdata, newsigs, parentID, err := GenerateNewPolicy(policyFile2,signaturesFile2, configFile, hashFile1)
 		fmt.Printf("22222222222 parentID %s\n", hex.EncodeToString(parentID))
 		resp, err := s.(*Service).NewPolicyRequest(
 			&netmanage.NewPolicyRequest{Roster: roster, PolicyData: newdata, Signatures: newsigs, ParentBlockID:parentID})
@@ -222,7 +872,10 @@ func TestService_VerifyPolicy(t *testing.T) {
 		s.(*Service).GenesisPolicyRequest(
 			&netmanage.GenesisPolicyRequest{Roster: roster, PolicyData: gdata, BaseH: 2, MaxH: 2, Signatures: gsigs})
 		s.(*Service).WriteLatestID(hashFile1)
-		newdata, newsigs, parentID, err := GenerateNewPolicy(policyFile2,signaturesFile2, configFile2, hashFile1)
+		data2, err := netmanage.PolicyDataFromFiles(policyFile2, configFile, hashFile1)
+		log.ErrFatal(err)
+		log.ErrFatal(signPolicyFiles(data2, privFile, signaturesFile2))
+		newdata, newsigs, parentID, err := GenerateNewPolicy(policyFile2,signaturesFile2, configFile, hashFile1)
 		fmt.Printf("22222222222 parentID %s\n", hex.EncodeToString(parentID))
 		s.(*Service).NewPolicyRequest(
 			&netmanage.NewPolicyRequest{Roster: roster, PolicyData: newdata, Signatures: newsigs, ParentBlockID:parentID})
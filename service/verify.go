@@ -0,0 +1,146 @@
+package service
+
+/*
+The verify.go checks the signatures of large admin sets. The keys of a conf are
+parsed once and cached by the hash of the conf, each signature goes to the
+keys of its issuer instead of being tried against every admin, and the keys
+and the signatures are processed by a bounded pool of workers.
+*/
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/dedis/netmanage"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+//how many confs keep their parsed keys, the latest block's conf and the ones of pending proposals are the usual ones
+const maxCachedConfs = 8
+
+//the parsed keys of a conf
+type confKeys struct {
+	//index in conf.Members() of the admin of each key ID, a key listed twice is the admin listing it first
+	members map[string]int
+	//the verifiers of the keys, by the Signature.Issuer of their signatures
+	issuers map[string][]netmanage.Verifier
+}
+
+//the parsed keys of the latest confs, by conf hash
+type keyCache struct {
+	sync.Mutex
+	confs map[string]*confKeys
+	//the hashes, the first cached first
+	order []string
+}
+
+//the parsed keys of the conf, from the cache when it has them
+func (c *keyCache) keys(conf *netmanage.Conf) (*confKeys, error) {
+	hash, err := conf.Hash()
+	if err != nil {
+		return nil, err
+	}
+	c.Lock()
+	defer c.Unlock()
+	if keys, ok := c.confs[string(hash)]; ok {
+		return keys, nil
+	}
+	keys := parseKeys(conf)
+	if c.confs == nil {
+		c.confs = make(map[string]*confKeys)
+	}
+	if len(c.order) == maxCachedConfs {
+		delete(c.confs, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.confs[string(hash)] = keys
+	c.order = append(c.order, string(hash))
+	return keys, nil
+}
+
+//parse the keys of the admins of conf, a key that cannot be parsed does not approve anything
+func parseKeys(conf *netmanage.Conf) *confKeys {
+	members := conf.Members()
+	verifiers := make([]netmanage.Verifier, len(members))
+	parallel(len(members), func(i int) {
+		verifier, err := netmanage.NewVerifier(members[i].PubKey)
+		if err != nil {
+			log.Error("Could not read the public key of admin", i, err)
+			return
+		}
+		verifiers[i] = verifier
+	})
+
+	keys := &confKeys{members: make(map[string]int), issuers: make(map[string][]netmanage.Verifier)}
+	for i, verifier := range verifiers {
+		if verifier == nil {
+			continue
+		}
+		// a key listed twice, even in another scheme, is one admin who only counts once
+		if _, ok := keys.members[verifier.KeyID()]; !ok {
+			keys.members[verifier.KeyID()] = i
+		}
+		for _, issuer := range verifier.Issuers() {
+			keys.issuers[issuer] = append(keys.issuers[issuer], verifier)
+		}
+	}
+	return keys
+}
+
+//check one signature over signedBuf, made by one of the admins with a key that is neither revoked nor expired at now
+func (keys *confKeys) check(signedBuf []byte, signature string, now time.Time) netmanage.SignatureReport {
+	report := netmanage.SignatureReport{}
+	sig, err := netmanage.ParseSignature(signature)
+	if err != nil {
+		report.Reason = "unreadable signature: " + err.Error()
+		return report
+	}
+	report.KeyID = sig.Issuer
+	var issuer netmanage.Verifier
+	for _, verifier := range keys.issuers[sig.Issuer] {
+		if verifier.Issued(sig) {
+			issuer = verifier
+			break
+		}
+	}
+	if issuer == nil {
+		report.Reason = "the key is not one of the admins"
+		return report
+	}
+	report.KeyID, report.Identity = issuer.KeyID(), issuer.Identity()
+	if err := issuer.CheckKey(sig, now); err != nil {
+		report.Reason = err.Error()
+		return report
+	}
+	if err := issuer.Verify(signedBuf, sig); err != nil {
+		report.Reason = "the signature does not match: " + err.Error()
+		return report
+	}
+	report.Valid = true
+	return report
+}
+
+//run f for every i below n, on at most one goroutine per CPU
+func parallel(n int, f func(i int)) {
+	workers := runtime.NumCPU()
+	if workers > n {
+		workers = n
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
@@ -0,0 +1,101 @@
+package service
+
+import (
+	"crypto/rand"
+	"fmt"
+	"testing"
+
+	"github.com/dedis/netmanage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+func TestKeyCache(t *testing.T) {
+	_, conf := testAdmins(2, 1)
+	var cache keyCache
+	keys, err := cache.keys(conf)
+	require.Nil(t, err)
+	assert.Len(t, keys.members, 2)
+	again, err := cache.keys(&netmanage.Conf{Threshold: 1, PubKeys: append([]string(nil), conf.PubKeys...)})
+	require.Nil(t, err)
+	assert.True(t, keys == again, "the same conf is parsed once")
+
+	// the first cached conf is dropped when the cache is full
+	for i := 2; i <= maxCachedConfs+1; i++ {
+		_, err = cache.keys(&netmanage.Conf{Threshold: i, PubKeys: conf.PubKeys})
+		require.Nil(t, err)
+	}
+	again, err = cache.keys(conf)
+	require.Nil(t, err)
+	assert.False(t, keys == again)
+	assert.Len(t, cache.confs, maxCachedConfs)
+}
+
+// benchSigners are the admins of the benchmarks, generated once for all sizes
+var benchSigners = map[netmanage.Scheme][]netmanage.Signer{}
+
+func benchAdmins(b *testing.B, scheme netmanage.Scheme, n int) []netmanage.Signer {
+	for len(benchSigners[scheme]) < n {
+		var signer netmanage.Signer
+		switch scheme {
+		case netmanage.SchemeOpenPGP:
+			// short keys, the benchmark measures the verification and not the key generation
+			entity, err := openpgp.NewEntity(fmt.Sprint(len(benchSigners[scheme])), "", "", &packet.Config{RSABits: 1024})
+			require.Nil(b, err)
+			signer = netmanage.NewOpenPGPSigner(entity)
+		case netmanage.SchemeEd25519:
+			_, key, err := ed25519.GenerateKey(rand.Reader)
+			require.Nil(b, err)
+			signer = netmanage.NewEd25519Signer(key, "")
+		}
+		benchSigners[scheme] = append(benchSigners[scheme], signer)
+	}
+	return benchSigners[scheme][:n]
+}
+
+// BenchmarkApprove checks the signatures of every admin of a conf, with the
+// keys cached like for the blocks after the first, and parsed again like for
+// a new conf. The signed bytes hold the conf, so each signature hashes the
+// keys of every admin and the time grows faster than the number of admins.
+func BenchmarkApprove(b *testing.B) {
+	policy, err := NetPolicyScanner("../netPolicy1.json")
+	require.Nil(b, err)
+	for _, scheme := range []netmanage.Scheme{netmanage.SchemeOpenPGP, netmanage.SchemeEd25519} {
+		for _, n := range []int{10, 100, 500, 1000} {
+			signers := benchAdmins(b, scheme, n)
+			conf := &netmanage.Conf{Threshold: n/2 + 1}
+			for _, signer := range signers {
+				pub, err := signer.PublicKey()
+				require.Nil(b, err)
+				conf.PubKeys = append(conf.PubKeys, pub)
+			}
+			data := &netmanage.PolicyData{Policy: policy, Conf: conf, Encoding: netmanage.EncodingCanonicalV1}
+			text, err := data.SigningBytes()
+			require.Nil(b, err)
+			var signatures []string
+			for _, signer := range signers {
+				sig, err := signer.Sign(text)
+				require.Nil(b, err)
+				signatures = append(signatures, sig)
+			}
+
+			for _, cached := range []bool{true, false} {
+				name := fmt.Sprintf("%s/admins=%d/cached=%t", scheme, n, cached)
+				b.Run(name, func(b *testing.B) {
+					s := &Service{Storage: &Storage{}}
+					for i := 0; i < b.N; i++ {
+						if !cached {
+							s.keys = keyCache{}
+						}
+						if _, err := s.ApprovalCheck(data, signatures); err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// The signbytes command prints the exact bytes admins sign to approve a
+// policy, so that they can be signed by any tool, like
+//
+//	signbytes -conf config.toml -parent blockID1.toml netPolicy2.json | gpg --armor --detach-sign >> signatures.txt
+//	signbytes -conf config.toml -parent blockID1.toml netPolicy2.json | ssh-keygen -Y sign -n netmanage -f id_ed25519 >> signatures.txt
+//
+// The signed bytes cover the conf and, for a new policy, the parent block and
+// the chain written in the -parent file, so the signatures are only valid for
+// a request on top of that block. A genesis policy has no -parent.
+//
+// A policy whose conf changes the admins or the threshold also needs the
+// current admins to sign the change itself: with -from and the current conf it
+// prints those bytes. With -cosi it prints the bytes the roster cosigns for
+// the policy data instead, along with the key IDs of its -approvers.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dedis/netmanage"
+)
+
+func main() {
+	confFile := flag.String("conf", "", "conf file with the threshold and the admins' public keys")
+	parentFile := flag.String("parent", "", "file with the IDs of the parent block and of the chain, empty for a genesis policy")
+	expiry := flag.String("expiry", "", "RFC3339 time the policy expires at")
+	nonce := flag.String("nonce", "", "nonce of the proposal")
+	fromFile := flag.String("from", "", "current conf, to print the bytes approving the change to -conf")
+	cosi := flag.Bool("cosi", false, "print the bytes the roster cosigns instead of the ones the admins sign")
+	approvers := flag.String("approvers", "", "comma separated key IDs of the admins who approved the policy, with -cosi")
+	legacy := flag.Bool("legacy", false, "use the encoding of the blocks signed before the canonical one")
+	revoke := flag.String("revoke", "", "key ID of the admin key to revoke, to print the bytes approving its revocation")
+	reason := flag.String("reason", "", "why the key is revoked, with -revoke")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s -conf config.toml [flags] policy.json\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -parent blockID.toml -revoke keyID [-reason text] [-nonce nonce]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *revoke != "" {
+		if flag.NArg() != 0 || *parentFile == "" {
+			flag.Usage()
+			os.Exit(2)
+		}
+		rev := &netmanage.Revocation{KeyID: *revoke, Reason: *reason, Nonce: *nonce}
+		var err error
+		if rev.ParentID, err = netmanage.HashScanner(*parentFile); err != nil {
+			fail(err)
+		}
+		if rev.ChainID, err = netmanage.ChainIDScanner(*parentFile); err != nil {
+			fail(err)
+		}
+		buf, err := rev.SigningBytes()
+		if err != nil {
+			fail(err)
+		}
+		os.Stdout.Write(buf)
+		return
+	}
+	if flag.NArg() != 1 || *confFile == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	data, err := netmanage.PolicyDataFromFiles(flag.Arg(0), *confFile, *parentFile)
+	if err != nil {
+		fail(err)
+	}
+	data.Expiry, data.Nonce = *expiry, *nonce
+	if *legacy {
+		data.Encoding = netmanage.EncodingLegacy
+	}
+
+	var buf []byte
+	if *fromFile != "" {
+		var current *netmanage.Conf
+		if current, err = netmanage.ConfScanner(*fromFile); err != nil {
+			fail(err)
+		}
+		buf, err = data.ConfChangeBytes(current)
+	} else if *cosi {
+		cosiPolicy := &netmanage.CosiPolicy{PolicyData: data}
+		if *approvers != "" {
+			cosiPolicy.Approvers = strings.Split(*approvers, ",")
+		}
+		buf, err = cosiPolicy.CosiBytes()
+	} else {
+		buf, err = data.SigningBytes()
+	}
+	if err != nil {
+		fail(err)
+	}
+	os.Stdout.Write(buf)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "signbytes:", err)
+	os.Exit(1)
+}
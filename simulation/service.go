@@ -1,6 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+
 	"github.com/BurntSushi/toml"
 	"github.com/dedis/netmanage"
 	netservice "github.com/dedis/netmanage/service"
@@ -8,6 +12,7 @@ import (
 	"gopkg.in/dedis/onet.v1/log"
 	"gopkg.in/dedis/onet.v1/app"
 	"gopkg.in/dedis/onet.v1/simul/monitor"
+	"golang.org/x/crypto/openpgp"
 	"fmt"
 )
 
@@ -120,19 +125,26 @@ func (s *SimulationService) Run(config *onet.SimulationConfig) error {
 	}
 	
 	gdata, gsigs, err := netservice.GenerateGenesisPolicy(policyFile,signaturesFile,configFile)
-	
+	log.ErrFatal(err)
+
+	//the chain has a single genesis block, the rounds append their new policies on top of it
+	roundGenesis := monitor.NewTimeMeasure("GenesisPolicyRequest")
+	ioGenesis := monitor.NewCounterIOMeasure("GenesisPolicyRequest",config.Server)
+	log.Lvl2("Sending GenerateGenesisPolicy request to", service)
+	_, err = service.GenesisPolicyRequest(&netmanage.GenesisPolicyRequest{Roster: config.Roster, PolicyData: gdata, BaseH: s.BaseHeight, MaxH: s.MaxHeight, Signatures: gsigs})
+	log.ErrFatal(err)
+	roundGenesis.Record()
+	ioGenesis.Record()
+
 	for round := 0; round < s.Rounds; round++ {
 		log.Lvl1("Starting round", round)
-		roundGenesis := monitor.NewTimeMeasure("GenesisPolicyRequest")
-		ioGenesis := monitor.NewCounterIOMeasure("GenesisPolicyRequest",config.Server)
-		log.Lvl2("Sending GenerateGenesisPolicy request to", service)
-		_, err = service.GenesisPolicyRequest(&netmanage.GenesisPolicyRequest{Roster: config.Roster, PolicyData: gdata, BaseH: s.BaseHeight, MaxH: s.MaxHeight, Signatures: gsigs})
-		log.ErrFatal(err)			
-		roundGenesis.Record()
-		ioGenesis.Record()
-		
 		service.WriteLatestID(hashFile1)
-		newdata, newsigs, parentID, err := netservice.GenerateNewPolicy(policyFile2, signaturesFile2, configFile2, hashFile1)
+		//the admins of the genesis policy sign the new policy on top of the latest block
+		data2, err := netmanage.PolicyDataFromFiles(policyFile2, configFile, hashFile1)
+		log.ErrFatal(err)
+		log.ErrFatal(signPolicyFiles(data2, privFile, signaturesFile2))
+		newdata, newsigs, parentID, err := netservice.GenerateNewPolicy(policyFile2, signaturesFile2, configFile, hashFile1)
+		log.ErrFatal(err)
 		
 		roundNewPolicy := monitor.NewTimeMeasure("NewPolicyRequest")
 		ioNewPolicy := monitor.NewCounterIOMeasure("NewPolicyRequest",config.Server)
@@ -158,3 +170,31 @@ func (s *SimulationService) Run(config *onet.SimulationConfig) error {
 	}
 	return nil	
 }
+
+//simulate the admins whose private keys GenerateAmdinFiles wrote into privFile signing the policy data into signaturesFile
+func signPolicyFiles(policyData *netmanage.PolicyData, privFile, signaturesFile string) error {
+	var ring struct {
+		Entities []string
+	}
+	if _, err := toml.DecodeFile(privFile, &ring); err != nil {
+		return err
+	}
+	text, err := policyData.SigningBytes()
+	if err != nil {
+		return err
+	}
+	sigs := new(bytes.Buffer)
+	for _, armored := range ring.Entities {
+		entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+		if err != nil {
+			return err
+		}
+		for _, entity := range entities {
+			if err := openpgp.ArmoredDetachSign(sigs, entity, bytes.NewReader(text), nil); err != nil {
+				return err
+			}
+			sigs.WriteByte('\n')
+		}
+	}
+	return ioutil.WriteFile(signaturesFile, sigs.Bytes(), 0660)
+}
@@ -13,8 +13,16 @@ func init() {
 		GenesisPolicyRequest{}, GenesisPolicyResponse{},
 		NewPolicyRequest{}, NewPolicyResponse{},
 		GetPolicyRequest{}, GetPolicyResponse{},
+		ExpiringRulesRequest{}, ExpiringRulesResponse{},
 		VerifyPolicyRequest{}, VerifyPolicyResponse{},
+		SubmitProposalRequest{}, SubmitProposalResponse{},
+		AddSignatureRequest{}, AddSignatureResponse{},
+		ListProposalsRequest{}, ListProposalsResponse{},
+		GetProposalRequest{}, GetProposalResponse{},
+		AppendProposalRequest{}, AppendProposalResponse{},
+		RevokeKeyRequest{}, RevokeKeyResponse{},
 		Policy{}, 
+		ChainDef{}, AddressGroup{}, ServiceGroup{},
 		PolicyData{},
 		CosiPolicy{},
 	} {
@@ -30,14 +38,57 @@ type Policy struct {
 	//number of rules it contains
 	Num int
 	Rules []Rule
+
+	//custom chains and the default policy of the built-in chains
+	Chains []ChainDef
+	//named address lists, referenced as "@name" in Match.Src/Dest
+	AddressGroups []AddressGroup
+	//named protocol and ports, referenced by name in Match.Service
+	ServiceGroups []ServiceGroup
+}
+
+//a custom chain rules can jump to, or the default policy of a built-in chain
+type ChainDef struct {
+	//"filter" or "nat", empty is the filter table
+	Table string
+	Name string
+	//ACCEPT or DROP for a built-in chain, empty for a custom chain
+	Policy string
+}
+
+//a named list of addresses and prefixes shared by several rules
+type AddressGroup struct {
+	Name string
+	Addresses []string
+}
+
+//a named protocol and destination ports shared by several rules
+type ServiceGroup struct {
+	Name string
+	Protocol string
+	Ports string
 }
 
 //network rule
 type Rule struct {
 	Match *Match
 	Action string
+	//custom chain a JUMP or GOTO continues in
+	Target string
+	//address and ports the SNAT/DNAT actions translate to, like "10.0.0.1" and "8080" or "8000:8010"
+	ToAddress string
+	ToPorts string
+	//reply a REJECT sends, like "port-unreachable" or "tcp-reset", empty is port-unreachable
+	RejectWith string
+	//prefix and syslog level of the LOG action, empty level is "warning"
+	LogPrefix string
+	LogLevel string
+	//RFC3339 times the rule is in effect from and until, like "2018-01-08T10:00:00Z", empty is unbounded
+	NotBefore string
+	NotAfter string
 }
 
+//the fields of the first policies come first and keep their order, network.Marshal numbers the fields by their position
 type Match struct {
 	Chain string
 	Protocol string
@@ -45,20 +96,88 @@ type Match struct {
 	Sports string
 	Dest string
 	Dports string
+	//IPv4, IPv6 or ALL; when empty, the family of the Src/Dest addresses, or both families if there is none
+	Family string
+	//name of a ServiceGroup giving the protocol and destination ports, Protocol and Dports are then left empty
+	Service string
+	//conntrack states, like "ESTABLISHED,RELATED", empty matches any state
+	State string
+	//netfilter table, "filter" or "nat", empty is the filter table
+	Table string
+	//rate the rule matches at most, like "10/second", empty is no limit
+	Limit string
+	//packets matched at once before the limit applies, 0 is 5
+	LimitBurst int
+	//gives every source address its own limit
+	LimitPerSource bool
+	//interfaces the packets come in and go out through, like "wan0" or "eth+" for every ethN, empty is any
+	InIface string
+	OutIface string
 }
 
 //confFile contains the public keys of admins & signature threshold
 type Conf struct {
+	//total weight of the approving admins needed, every admin of PubKeys weighs 1
 	Threshold  int
+	//armored OpenPGP, SSH or Ed25519 keys, each choosing the scheme of its admin's signatures, see verifier.go
 	PubKeys    []string
+
+	//admins with a weight or roles, approving along with the ones of PubKeys
+	Admins []Admin
+	//further thresholds the approving admins of a role must reach, like 2 from "security"
+	Rules []ApprovalRule
+	//parts of the policy whose changes also need the approval of their own admins
+	Scopes []ApprovalScope
+	//total weight of the admins needed to revoke the key of another admin, 0 is half of Threshold, see revocation.go
+	RevocationThreshold int
+}
+
+//an admin counting for more or less than 1, or holding roles
+type Admin struct {
+	PubKey string
+	//0 weighs 1
+	Weight int
+	Roles []string
+}
+
+//the total weight of the approving admins holding Role must reach Threshold
+type ApprovalRule struct {
+	Role string
+	Threshold int
+}
+
+//a change to a rule matching part of the traffic of the scope needs the total weight of the approving admins holding
+//Role to reach Threshold. Empty or ALL matchers match anything, like the fields of Match.
+type ApprovalScope struct {
+	Name string
+	Table string
+	Chain string
+	Action string
+	Protocol string
+	Src string
+	Dest string
+	Dports string
+
+	Role string
+	Threshold int
 }
 
 type PolicyData struct {
 	Policy *Policy
 	Conf *Conf
+	//RFC3339 time after which routers must not apply the policy anymore, empty never expires
+	Expiry string
+	//how the signed bytes are built, see encoding.go; blocks from before it was added are EncodingLegacy
+	Encoding Encoding
 	
-	//just the hash of last policy, is it necessary??
-	//lastPolicyHash string	
+	//the block the policy is appended after and the genesis block of its chain, both empty for a genesis policy.
+	//They are part of the admins' signatures, which cannot be replayed on top of another block
+	ParentID skipchain.SkipBlockID
+	ChainID skipchain.SkipBlockID
+	//chosen by whoever proposes the policy, tells apart proposals of the same policy
+	Nonce string
+	//set on the block of a RevokeKeyRequest, which keeps the policy and removes the key from the conf
+	Revocation *Revocation
 	
 	//the merkle root of Policy, Conf and ParentHash,
 	//hash but should be calculated when need to be signed, the admin (users) only need to provide the above 3 items
@@ -70,6 +189,11 @@ type CosiPolicy struct {
 
 	//cosi signature of the PolicyData's merkle root
 	CoSignature *cosisign.SignatureResponse
+
+	//key IDs of the admins who approved the PolicyData, and its change of the conf, cosigned along with it.
+	//After CoSignature, for the blocks written before them to keep reading their CoSignature
+	Approvers []string
+	ConfApprovers []string
 }
 
 
@@ -86,6 +210,8 @@ type GenesisPolicyRequest struct {
 type GenesisPolicyResponse struct {
 	GenesisBlock *skipchain.SkipBlock
 	BlockID skipchain.SkipBlockID
+	//the admins' signatures and the thresholds they reached
+	Approval *ApprovalDecision
 }
 
 //ignore this first: validate the PolicyData, if it is validated with threshold sigs of admins
@@ -96,6 +222,8 @@ type NewPolicyRequest struct {
 	
 	//admins' signatures of the PolicyData's merkle root
 	Signatures []string
+	//signatures of the current admins over the ConfChange, when PolicyData changes the admins or the threshold
+	ConfSignatures []string
 	
 	//which one is better? I think ParentBlockID is better. This is expected to be the latest block in the chain.
 	ParentBlockID skipchain.SkipBlockID
@@ -106,16 +234,47 @@ type NewPolicyRequest struct {
 type NewPolicyResponse struct {
 	BlockID skipchain.SkipBlockID
 	LatestBlock *skipchain.SkipBlock
+	//the admins' signatures and the thresholds they reached, for the policy and for the change of the conf
+	Approval *ApprovalDecision
+	ConfApproval *ApprovalDecision
 }
 
 type GetPolicyRequest struct {
 	//Roster *onet.Roster
 	//KnownLatestID skipchain.SkipBlockID
+
+	//RFC3339 time the returned Active rules are in effect at, empty is now
+	At string
 }
 
 
 type GetPolicyResponse struct {
 	CosiPolicy *CosiPolicy
+	//the signed policy with only the rules in effect at the requested time, nil when the policy has expired
+	Active *Policy
+	Expired bool
+}
+
+//list the rules of the latest policy that stop being in effect soon
+type ExpiringRulesRequest struct {
+	//how far ahead to look, a duration like "48h", empty is 24h
+	Within string
+}
+
+type ExpiringRulesResponse struct {
+	BlockID skipchain.SkipBlockID
+	//the rules in effect now that end within the window, the first ending first
+	Rules []ExpiringRule
+	//the expiry of the whole policy when it falls within the window
+	Expiry string
+}
+
+//a rule of a policy and the time it stops being in effect
+type ExpiringRule struct {
+	//position of the rule in Policy.Rules
+	Index int
+	Rule Rule
+	NotAfter string
 }
 
 /*
@@ -131,3 +290,93 @@ type VerifyPolicyRequest struct {
 type VerifyPolicyResponse struct {
 	IsValid bool
 }
+
+//a new policy waiting on the service for the signatures of the admins, it is cosigned and appended once approved
+type Proposal struct {
+	//hex of the sha256 of the bytes the admins sign, see PolicyData.SigningBytes
+	ID string
+	Roster *onet.Roster
+	PolicyData *PolicyData
+	//the admins' signatures of the PolicyData, and of its ConfChange when it changes the admins or the thresholds
+	Signatures []string
+	ConfSignatures []string
+	//RFC3339 times the proposal was submitted and is dropped if not approved by then
+	Submitted string
+	Expires string
+}
+
+//a proposal and how far the signatures collected so far are from approving it
+type ProposalStatus struct {
+	Proposal *Proposal
+	//the decisions over Signatures and ConfSignatures, nil when they could not be checked
+	Decision *ApprovalDecision
+	ConfDecision *ApprovalDecision
+	//why the signatures could not be checked, like a parent block that is not the latest anymore
+	Error string
+	//the block the proposal was appended as, once approved
+	BlockID skipchain.SkipBlockID
+}
+
+//submit a new policy for the admins to sign, PolicyData.ParentID is the block it is appended after
+type SubmitProposalRequest struct {
+	Roster *onet.Roster
+	PolicyData *PolicyData
+}
+
+type SubmitProposalResponse struct {
+	Status *ProposalStatus
+}
+
+//add the detached signature of one admin to a proposal
+type AddSignatureRequest struct {
+	ID string
+	Signature string
+	//the signature is over the ConfChangeBytes of the proposal instead of its SigningBytes
+	ConfChange bool
+}
+
+//the status after the signature, with the BlockID set when it approved the proposal
+type AddSignatureResponse struct {
+	Status *ProposalStatus
+}
+
+type ListProposalsRequest struct {
+}
+
+type ListProposalsResponse struct {
+	//the pending proposals, the first submitted first
+	Proposals []*ProposalStatus
+}
+
+type GetProposalRequest struct {
+	ID string
+}
+
+type GetProposalResponse struct {
+	Status *ProposalStatus
+}
+
+//append again an approved proposal whose append failed
+type AppendProposalRequest struct {
+	ID string
+}
+
+//the status with the BlockID the proposal was appended as
+type AppendProposalResponse struct {
+	Status *ProposalStatus
+}
+
+//remove a compromised admin key from the conf of the latest block, with the signatures of the other admins over
+//Revocation.SigningBytes reaching the RevocationQuorum of the conf
+type RevokeKeyRequest struct {
+	Roster *onet.Roster
+	Revocation *Revocation
+	Signatures []string
+}
+
+type RevokeKeyResponse struct {
+	BlockID skipchain.SkipBlockID
+	LatestBlock *skipchain.SkipBlock
+	//the admins' signatures and the quorum they reached
+	Approval *ApprovalDecision
+}
@@ -0,0 +1,558 @@
+package netmanage
+
+/*
+The verifier.go checks the admin signatures of the schemes a Conf may list,
+each admin key choosing its scheme by its format:
+
+  - OpenPGP, an armored public key block, signing armored detached
+    signatures like gpg --armor --detach-sign
+  - SSH, a public key in the authorized_keys format, signing the armored
+    signatures of ssh-keygen -Y sign -n netmanage
+  - Ed25519, a key written "ed25519 <base64 key> [comment]", signing one
+    line "ed25519-signature <base64 key> <base64 signature>"
+
+The approvals of all schemes count toward the same thresholds. An Ed25519 key
+has the same KeyID whether it is written as a raw or as an SSH key, so the
+admin owning it counts once. An OpenPGP key carrying a revocation signature,
+or past its expiry, does not approve anything anymore; the other schemes have
+neither, their keys are revoked by removing them from the conf.
+*/
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+	"golang.org/x/crypto/ssh"
+)
+
+// Scheme is the kind of key and signature of an admin
+type Scheme int
+
+const (
+	// SchemeOpenPGP is an armored OpenPGP key and detached signature
+	SchemeOpenPGP Scheme = iota
+	// SchemeEd25519 is a raw Ed25519 key and signature
+	SchemeEd25519
+	// SchemeSSH is an SSH key and a signature of ssh-keygen -Y sign
+	SchemeSSH
+)
+
+// String returns the name of the scheme
+func (s Scheme) String() string {
+	switch s {
+	case SchemeOpenPGP:
+		return "openpgp"
+	case SchemeEd25519:
+		return "ed25519"
+	case SchemeSSH:
+		return "ssh"
+	}
+	return fmt.Sprintf("unknown(%d)", int(s))
+}
+
+// SSHNamespace is the namespace of the SSH signatures of the admins, the -n of
+// ssh-keygen -Y sign
+const SSHNamespace = "netmanage"
+
+const (
+	pgpSignatureHead = "-----BEGIN PGP SIGNATURE-----"
+	sshSignatureHead = "-----BEGIN SSH SIGNATURE-----"
+	sshSignatureTail = "-----END SSH SIGNATURE-----"
+	pgpKeyHead       = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+	ed25519KeyType   = "ed25519"
+	ed25519SigType   = "ed25519-signature"
+	sshSigMagic      = "SSHSIG"
+)
+
+// Signature is an admin signature read by ParseSignature
+type Signature struct {
+	Scheme Scheme
+	// Issuer is the KeyID of the key the signature claims to be made with,
+	// for OpenPGP it may be the one of a subkey
+	Issuer string
+
+	pgp        []byte
+	pgpIssuer  uint64
+	ssh        *sshSignature
+	sshKey     ssh.PublicKey
+	ed25519Sig []byte
+}
+
+// the blob of an SSH signature, after its magic
+type sshSignature struct {
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// ParseSignature reads an admin signature of any scheme
+func ParseSignature(text string) (*Signature, error) {
+	text = strings.TrimSpace(text)
+	switch {
+	case strings.HasPrefix(text, pgpSignatureHead):
+		block, err := armor.Decode(strings.NewReader(text))
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(block.Body)
+		if err != nil {
+			return nil, err
+		}
+		sig := &Signature{Scheme: SchemeOpenPGP, pgp: body}
+		p, err := packet.Read(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		switch s := p.(type) {
+		case *packet.Signature:
+			if s.IssuerKeyId == nil {
+				return nil, errors.New("the signature has no issuer")
+			}
+			sig.pgpIssuer = *s.IssuerKeyId
+		case *packet.SignatureV3:
+			sig.pgpIssuer = s.IssuerKeyId
+		default:
+			return nil, errors.New("not a signature")
+		}
+		sig.Issuer = fmt.Sprintf("%016X", sig.pgpIssuer)
+		return sig, nil
+
+	case strings.HasPrefix(text, sshSignatureHead):
+		if !strings.HasSuffix(text, sshSignatureTail) {
+			return nil, errors.New("the SSH signature has no end")
+		}
+		body := strings.Join(strings.Fields(text[len(sshSignatureHead):len(text)-len(sshSignatureTail)]), "")
+		blob, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.HasPrefix(blob, []byte(sshSigMagic)) {
+			return nil, errors.New("not an SSH signature")
+		}
+		s := &sshSignature{}
+		if err := ssh.Unmarshal(blob[len(sshSigMagic):], s); err != nil {
+			return nil, err
+		}
+		if s.Version != 1 {
+			return nil, fmt.Errorf("unsupported SSH signature version %d", s.Version)
+		}
+		key, err := ssh.ParsePublicKey(s.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		return &Signature{Scheme: SchemeSSH, Issuer: ssh.FingerprintSHA256(key), ssh: s, sshKey: key}, nil
+
+	case strings.HasPrefix(text, ed25519SigType+" "):
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, errors.New("an Ed25519 signature is written " + ed25519SigType + " <base64 key> <base64 signature>")
+		}
+		key, err := parseEd25519Key(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		sig, err := base64.StdEncoding.DecodeString(fields[2])
+		if err != nil || len(sig) != ed25519.SignatureSize {
+			return nil, errors.New("invalid Ed25519 signature")
+		}
+		return &Signature{Scheme: SchemeEd25519, Issuer: ed25519KeyID(key), ed25519Sig: sig}, nil
+	}
+	return nil, errors.New("unknown signature format")
+}
+
+// Verifier checks the signatures made with one admin key
+type Verifier interface {
+	Scheme() Scheme
+	// KeyID identifies the key in the signature reports and the approvers
+	// of a block
+	KeyID() string
+	// Identity is the name of the owner of the key, it may be empty
+	Identity() string
+	// Issuers returns the Signature.Issuer of the signatures made with the
+	// key, its KeyID and, for OpenPGP, the ones of its subkeys
+	Issuers() []string
+	// Issued tells if the signature claims to be made with the key
+	Issued(sig *Signature) bool
+	// CheckKey tells why the key sig was issued with cannot approve at
+	// now, like a revoked or expired OpenPGP key, nil when it can
+	CheckKey(sig *Signature, now time.Time) error
+	// Verify checks the signature over data
+	Verify(data []byte, sig *Signature) error
+}
+
+// NewVerifier returns the verifier of an admin public key of any scheme
+func NewVerifier(pubKey string) (Verifier, error) {
+	text := strings.TrimSpace(pubKey)
+	switch {
+	case strings.HasPrefix(text, pgpKeyHead):
+		keys, err := openpgp.ReadArmoredKeyRing(strings.NewReader(text))
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			return nil, errors.New("the OpenPGP key block has no key")
+		}
+		return &pgpVerifier{keys}, nil
+	case strings.HasPrefix(text, ed25519KeyType+" "):
+		fields := strings.SplitN(text, " ", 3)
+		key, err := parseEd25519Key(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		v := &ed25519Verifier{key: key}
+		if len(fields) == 3 {
+			v.comment = strings.TrimSpace(fields[2])
+		}
+		return v, nil
+	}
+	key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(text))
+	if err != nil {
+		return nil, errors.New("unknown public key format")
+	}
+	return &sshVerifier{key, comment}, nil
+}
+
+type pgpVerifier struct {
+	keys openpgp.EntityList
+}
+
+func (v *pgpVerifier) Scheme() Scheme { return SchemeOpenPGP }
+
+func (v *pgpVerifier) KeyID() string { return v.keys[0].PrimaryKey.KeyIdString() }
+
+// Identity returns the primary identity of the key, or the first by name
+func (v *pgpVerifier) Identity() string {
+	var names []string
+	for name, identity := range v.keys[0].Identities {
+		if identity.SelfSignature != nil && identity.SelfSignature.IsPrimaryId != nil && *identity.SelfSignature.IsPrimaryId {
+			return name
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	sort.Strings(names)
+	return names[0]
+}
+
+func (v *pgpVerifier) Issuers() []string {
+	var issuers []string
+	for _, entity := range v.keys {
+		issuers = append(issuers, entity.PrimaryKey.KeyIdString())
+		for _, subkey := range entity.Subkeys {
+			issuers = append(issuers, subkey.PublicKey.KeyIdString())
+		}
+	}
+	return issuers
+}
+
+func (v *pgpVerifier) Issued(sig *Signature) bool {
+	return sig.Scheme == SchemeOpenPGP && len(v.keys.KeysById(sig.pgpIssuer)) > 0
+}
+
+// CheckKey checks the revocations and the expiry of the primary key, and of
+// the subkey when it issued the signature
+func (v *pgpVerifier) CheckKey(sig *Signature, now time.Time) error {
+	err := errors.New("the signature is not made with the key")
+	for _, key := range v.keys.KeysById(sig.pgpIssuer) {
+		if err = checkPGPKey(key, now); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func checkPGPKey(key openpgp.Key, now time.Time) error {
+	entity := key.Entity
+	if len(entity.Revocations) > 0 {
+		return pgpRevoked("the key", entity.Revocations[0])
+	}
+	//a revoked user ID leaves the key valid, only the revocations of the key and of its subkeys count
+	var self *packet.Signature
+	for _, identity := range entity.Identities {
+		if identity.SelfSignature == nil {
+			continue
+		}
+		if self == nil || identity.SelfSignature.IsPrimaryId != nil && *identity.SelfSignature.IsPrimaryId {
+			self = identity.SelfSignature
+		}
+	}
+	if err := pgpExpired("the key", entity.PrimaryKey, self, now); err != nil {
+		return err
+	}
+	if key.PublicKey == entity.PrimaryKey {
+		return nil
+	}
+	if key.SelfSignature.SigType == packet.SigTypeSubkeyRevocation || key.SelfSignature.RevocationReason != nil {
+		return pgpRevoked("the subkey "+key.PublicKey.KeyIdString(), key.SelfSignature)
+	}
+	return pgpExpired("the subkey "+key.PublicKey.KeyIdString(), key.PublicKey, key.SelfSignature, now)
+}
+
+func pgpRevoked(what string, revocation *packet.Signature) error {
+	if revocation.RevocationReasonText != "" {
+		return fmt.Errorf("%s was revoked: %s", what, revocation.RevocationReasonText)
+	}
+	return errors.New(what + " was revoked")
+}
+
+// the lifetime of the self-signature counts from the creation of the key,
+// not of the self-signature as packet.Signature.KeyExpired has it
+func pgpExpired(what string, key *packet.PublicKey, self *packet.Signature, now time.Time) error {
+	if self == nil || self.KeyLifetimeSecs == nil || *self.KeyLifetimeSecs == 0 {
+		return nil
+	}
+	expiry := key.CreationTime.Add(time.Duration(*self.KeyLifetimeSecs) * time.Second)
+	if now.After(expiry) {
+		return fmt.Errorf("%s expired on %s", what, expiry.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (v *pgpVerifier) Verify(data []byte, sig *Signature) error {
+	if sig.Scheme != SchemeOpenPGP {
+		return errors.New("not an OpenPGP signature")
+	}
+	_, err := openpgp.CheckDetachedSignature(v.keys, bytes.NewReader(data), bytes.NewReader(sig.pgp))
+	return err
+}
+
+type sshVerifier struct {
+	key     ssh.PublicKey
+	comment string
+}
+
+func (v *sshVerifier) Scheme() Scheme { return SchemeSSH }
+
+func (v *sshVerifier) KeyID() string { return ssh.FingerprintSHA256(v.key) }
+
+func (v *sshVerifier) Identity() string { return v.comment }
+
+func (v *sshVerifier) Issuers() []string { return []string{v.KeyID()} }
+
+func (v *sshVerifier) Issued(sig *Signature) bool {
+	return sig.Scheme == SchemeSSH && bytes.Equal(sig.sshKey.Marshal(), v.key.Marshal())
+}
+
+func (v *sshVerifier) CheckKey(sig *Signature, now time.Time) error { return nil }
+
+func (v *sshVerifier) Verify(data []byte, sig *Signature) error {
+	if sig.Scheme != SchemeSSH {
+		return errors.New("not an SSH signature")
+	}
+	if sig.ssh.Namespace != SSHNamespace {
+		return fmt.Errorf("the SSH signature is for namespace %q, not %q", sig.ssh.Namespace, SSHNamespace)
+	}
+	signed, err := sshSignedData(sig.ssh.HashAlgorithm, data)
+	if err != nil {
+		return err
+	}
+	s := &ssh.Signature{}
+	if err := ssh.Unmarshal(sig.ssh.Signature, s); err != nil {
+		return err
+	}
+	// like ssh-keygen, refuse the RSA signatures over SHA-1
+	if s.Format == ssh.KeyAlgoRSA {
+		return errors.New("SSH RSA signatures over SHA-1 are refused")
+	}
+	return v.key.Verify(signed, s)
+}
+
+// sshSignedData returns what ssh-keygen -Y sign signs for data
+func sshSignedData(hashAlgorithm string, data []byte) ([]byte, error) {
+	var h hash.Hash
+	switch hashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return nil, fmt.Errorf("unsupported SSH signature hash %q", hashAlgorithm)
+	}
+	h.Write(data)
+	return append([]byte(sshSigMagic), ssh.Marshal(&struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{SSHNamespace, "", hashAlgorithm, h.Sum(nil)})...), nil
+}
+
+type ed25519Verifier struct {
+	key     ed25519.PublicKey
+	comment string
+}
+
+func (v *ed25519Verifier) Scheme() Scheme { return SchemeEd25519 }
+
+func (v *ed25519Verifier) KeyID() string { return ed25519KeyID(v.key) }
+
+func (v *ed25519Verifier) Identity() string { return v.comment }
+
+func (v *ed25519Verifier) Issuers() []string { return []string{v.KeyID()} }
+
+func (v *ed25519Verifier) Issued(sig *Signature) bool {
+	return sig.Scheme == SchemeEd25519 && sig.Issuer == v.KeyID()
+}
+
+func (v *ed25519Verifier) CheckKey(sig *Signature, now time.Time) error { return nil }
+
+func (v *ed25519Verifier) Verify(data []byte, sig *Signature) error {
+	if sig.Scheme != SchemeEd25519 {
+		return errors.New("not an Ed25519 signature")
+	}
+	if !ed25519.Verify(v.key, data, sig.ed25519Sig) {
+		return errors.New("invalid Ed25519 signature")
+	}
+	return nil
+}
+
+func parseEd25519Key(text string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(text)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid Ed25519 public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// ed25519KeyID is the SSH fingerprint of the key
+func ed25519KeyID(key ed25519.PublicKey) string {
+	pub, err := ssh.NewPublicKey(key)
+	if err != nil {
+		return ""
+	}
+	return ssh.FingerprintSHA256(pub)
+}
+
+// Signer makes the admin signatures a Verifier of the same key checks
+type Signer interface {
+	Scheme() Scheme
+	// PublicKey returns the key to list in a Conf
+	PublicKey() (string, error)
+	// Sign returns the signature of data, in the format ParseSignature reads
+	Sign(data []byte) (string, error)
+}
+
+// NewOpenPGPSigner returns a signer of armored detached signatures
+func NewOpenPGPSigner(entity *openpgp.Entity) Signer {
+	return &pgpSigner{entity}
+}
+
+// NewEd25519Signer returns a signer of raw Ed25519 signatures, the comment of
+// its public key is the identity of the admin
+func NewEd25519Signer(key ed25519.PrivateKey, comment string) Signer {
+	return &ed25519Signer{key, comment}
+}
+
+// NewSSHSigner returns a signer of the signatures of ssh-keygen -Y sign, the
+// comment of its public key is the identity of the admin
+func NewSSHSigner(signer ssh.Signer, comment string) Signer {
+	return &sshSigner{signer, comment}
+}
+
+type pgpSigner struct {
+	entity *openpgp.Entity
+}
+
+func (s *pgpSigner) Scheme() Scheme { return SchemeOpenPGP }
+
+func (s *pgpSigner) PublicKey() (string, error) {
+	buf := new(bytes.Buffer)
+	w, err := armor.Encode(buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return "", err
+	}
+	if err := s.entity.Serialize(w); err != nil {
+		return "", err
+	}
+	w.Close()
+	return buf.String(), nil
+}
+
+func (s *pgpSigner) Sign(data []byte) (string, error) {
+	buf := new(bytes.Buffer)
+	if err := openpgp.ArmoredDetachSign(buf, s.entity, bytes.NewReader(data), nil); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+type ed25519Signer struct {
+	key     ed25519.PrivateKey
+	comment string
+}
+
+func (s *ed25519Signer) Scheme() Scheme { return SchemeEd25519 }
+
+func (s *ed25519Signer) PublicKey() (string, error) {
+	key := ed25519KeyType + " " + base64.StdEncoding.EncodeToString(s.key.Public().(ed25519.PublicKey))
+	if s.comment != "" {
+		key += " " + s.comment
+	}
+	return key, nil
+}
+
+func (s *ed25519Signer) Sign(data []byte) (string, error) {
+	return fmt.Sprintf("%s %s %s", ed25519SigType, base64.StdEncoding.EncodeToString(s.key.Public().(ed25519.PublicKey)),
+		base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, data))), nil
+}
+
+type sshSigner struct {
+	signer  ssh.Signer
+	comment string
+}
+
+func (s *sshSigner) Scheme() Scheme { return SchemeSSH }
+
+func (s *sshSigner) PublicKey() (string, error) {
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(s.signer.PublicKey())))
+	if s.comment != "" {
+		key += " " + s.comment
+	}
+	return key, nil
+}
+
+func (s *sshSigner) Sign(data []byte) (string, error) {
+	signed, err := sshSignedData("sha512", data)
+	if err != nil {
+		return "", err
+	}
+	var sig *ssh.Signature
+	if as, ok := s.signer.(ssh.AlgorithmSigner); ok && s.signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		sig, err = as.SignWithAlgorithm(rand.Reader, signed, ssh.KeyAlgoRSASHA512)
+	} else {
+		sig, err = s.signer.Sign(rand.Reader, signed)
+	}
+	if err != nil {
+		return "", err
+	}
+	blob := append([]byte(sshSigMagic), ssh.Marshal(&sshSignature{Version: 1, PublicKey: s.signer.PublicKey().Marshal(),
+		Namespace: SSHNamespace, HashAlgorithm: "sha512", Signature: ssh.Marshal(sig)})...)
+	body := base64.StdEncoding.EncodeToString(blob)
+	buf := new(bytes.Buffer)
+	buf.WriteString(sshSignatureHead + "\n")
+	for len(body) > 70 {
+		buf.WriteString(body[:70] + "\n")
+		body = body[70:]
+	}
+	buf.WriteString(body + "\n" + sshSignatureTail + "\n")
+	return buf.String(), nil
+}
@@ -0,0 +1,167 @@
+package netmanage_test
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dedis/netmanage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/ssh"
+)
+
+func readTestdata(t *testing.T, name string) string {
+	buf, err := ioutil.ReadFile("testdata/" + name)
+	require.Nil(t, err)
+	return string(buf)
+}
+
+func TestVerifier_SSHKeygen(t *testing.T) {
+	// the signatures of ssh-keygen -Y sign -n netmanage over testdata/ssh/message
+	message := []byte(readTestdata(t, "ssh/message"))
+	for _, key := range []string{"ed", "rsa"} {
+		verifier, err := netmanage.NewVerifier(readTestdata(t, "ssh/"+key+".pub"))
+		require.Nil(t, err, key)
+		assert.Equal(t, netmanage.SchemeSSH, verifier.Scheme())
+		sig, err := netmanage.ParseSignature(readTestdata(t, "ssh/"+key+".sig"))
+		require.Nil(t, err, key)
+		assert.Equal(t, verifier.KeyID(), sig.Issuer)
+		assert.True(t, verifier.Issued(sig), key)
+		assert.Nil(t, verifier.Verify(message, sig), key)
+		assert.NotNil(t, verifier.Verify([]byte("netmanage test!"), sig), key)
+	}
+
+	verifier, err := netmanage.NewVerifier(readTestdata(t, "ssh/ed.pub"))
+	require.Nil(t, err)
+	assert.Equal(t, "SHA256:sGu1PNwvaexBKJJsaVAE04Cz+Ca7CrccSDbeIAqWb3Y", verifier.KeyID())
+	assert.Equal(t, "alice@lab", verifier.Identity())
+	sig, err := netmanage.ParseSignature(readTestdata(t, "ssh/wrongns.sig"))
+	require.Nil(t, err)
+	assert.True(t, verifier.Issued(sig))
+	assert.NotNil(t, verifier.Verify(message, sig))
+	rsa, err := netmanage.ParseSignature(readTestdata(t, "ssh/rsa.sig"))
+	require.Nil(t, err)
+	assert.False(t, verifier.Issued(rsa))
+}
+
+func TestVerifier_CheckKey(t *testing.T) {
+	// gpg keys signing testdata/ssh/message, one revoked after signing,
+	// one valid for January 2020 and one with a revoked user ID
+	message := []byte(readTestdata(t, "ssh/message"))
+	revoked, err := netmanage.NewVerifier(readTestdata(t, "pgp/revoked.asc"))
+	require.Nil(t, err)
+	sig, err := netmanage.ParseSignature(readTestdata(t, "pgp/revoked.sig"))
+	require.Nil(t, err)
+	require.True(t, revoked.Issued(sig))
+	err = revoked.CheckKey(sig, time.Now())
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "the key was revoked")
+	assert.NotNil(t, revoked.Verify(message, sig))
+
+	expired, err := netmanage.NewVerifier(readTestdata(t, "pgp/expired.asc"))
+	require.Nil(t, err)
+	sig, err = netmanage.ParseSignature(readTestdata(t, "pgp/expired.sig"))
+	require.Nil(t, err)
+	require.True(t, expired.Issued(sig))
+	assert.Nil(t, expired.Verify(message, sig))
+	assert.Nil(t, expired.CheckKey(sig, time.Date(2020, 1, 15, 0, 0, 0, 0, time.UTC)))
+	err = expired.CheckKey(sig, time.Now())
+	require.NotNil(t, err)
+	assert.Equal(t, "the key expired on 2020-02-01T12:00:00Z", err.Error())
+
+	// a gpg key whose first user ID was revoked after adding another one
+	// still signs
+	renamed, err := netmanage.NewVerifier(readTestdata(t, "pgp/renamed.asc"))
+	require.Nil(t, err)
+	sig, err = netmanage.ParseSignature(readTestdata(t, "pgp/renamed.sig"))
+	require.Nil(t, err)
+	require.True(t, renamed.Issued(sig))
+	assert.Nil(t, renamed.Verify(message, sig))
+	assert.Nil(t, renamed.CheckKey(sig, time.Now()))
+
+	// the other schemes are revoked by leaving the conf
+	ssh, err := netmanage.NewVerifier(readTestdata(t, "ssh/ed.pub"))
+	require.Nil(t, err)
+	sig, err = netmanage.ParseSignature(readTestdata(t, "ssh/ed.sig"))
+	require.Nil(t, err)
+	assert.Nil(t, ssh.CheckKey(sig, time.Now()))
+}
+
+func TestSigner_Schemes(t *testing.T) {
+	entity, err := openpgp.NewEntity("alice", "", "alice@lab", nil)
+	require.Nil(t, err)
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	sshKey, err := ssh.NewSignerFromKey(key)
+	require.Nil(t, err)
+
+	message := []byte("the policy")
+	for _, signer := range []netmanage.Signer{
+		netmanage.NewOpenPGPSigner(entity),
+		netmanage.NewEd25519Signer(key, "bob@lab"),
+		netmanage.NewSSHSigner(sshKey, "carol@lab"),
+	} {
+		name := signer.Scheme().String()
+		pub, err := signer.PublicKey()
+		require.Nil(t, err, name)
+		verifier, err := netmanage.NewVerifier(pub)
+		require.Nil(t, err, name)
+		assert.Equal(t, signer.Scheme(), verifier.Scheme())
+		text, err := signer.Sign(message)
+		require.Nil(t, err, name)
+		sig, err := netmanage.ParseSignature(text)
+		require.Nil(t, err, name)
+		assert.Equal(t, signer.Scheme(), sig.Scheme)
+		assert.True(t, verifier.Issued(sig), name)
+		assert.Nil(t, verifier.Verify(message, sig), name)
+		assert.NotNil(t, verifier.Verify([]byte("another policy"), sig), name)
+	}
+
+	// the same Ed25519 key is one admin, whether it is written raw or for SSH
+	raw, err := netmanage.NewEd25519Signer(key, "").PublicKey()
+	require.Nil(t, err)
+	rawVerifier, err := netmanage.NewVerifier(raw)
+	require.Nil(t, err)
+	sshPub, err := netmanage.NewSSHSigner(sshKey, "").PublicKey()
+	require.Nil(t, err)
+	sshVerifier, err := netmanage.NewVerifier(sshPub)
+	require.Nil(t, err)
+	assert.Equal(t, sshVerifier.KeyID(), rawVerifier.KeyID())
+}
+
+func TestParseSignature_Invalid(t *testing.T) {
+	for _, text := range []string{
+		"",
+		"signature",
+		"ed25519-signature AAAA",
+		"ed25519-signature AAAA AAAA",
+		"-----BEGIN SSH SIGNATURE-----\nAAAA\n",
+		"-----BEGIN SSH SIGNATURE-----\nAAAA\n-----END SSH SIGNATURE-----",
+		"-----BEGIN PGP SIGNATURE-----\n\nAAAA\n-----END PGP SIGNATURE-----",
+	} {
+		_, err := netmanage.ParseSignature(text)
+		assert.NotNil(t, err, text)
+	}
+	_, err := netmanage.NewVerifier("ssh-ed25519 AAAA")
+	assert.NotNil(t, err)
+}
+
+func TestSigScanner_Schemes(t *testing.T) {
+	signatures, err := netmanage.SigScanner("testdata/signatures-mixed.txt")
+	require.Nil(t, err)
+	require.Len(t, signatures, 4)
+	var schemes []netmanage.Scheme
+	for _, text := range signatures {
+		if sig, err := netmanage.ParseSignature(text); err == nil {
+			schemes = append(schemes, sig.Scheme)
+		}
+	}
+	// the OpenPGP signature is cut short
+	assert.Equal(t, []netmanage.Scheme{netmanage.SchemeSSH, netmanage.SchemeEd25519, netmanage.SchemeSSH}, schemes)
+	assert.Equal(t, strings.TrimSpace(readTestdata(t, "ssh/ed.sig")), strings.TrimSpace(signatures[0]))
+}